@@ -16,16 +16,43 @@ type Config struct {
 	Listen               string
 	Conf                 Configs
 	Forwarders           Forwarders
+	LocalRecords         LocalRecords
+	LocalDomains         LocalDomains
+	HostsFiles           HostsFiles
+	Blocklists           FilterLists
+	Allowlists           FilterLists
+	BlocklistRefresh     time.Duration
+	BlockResponse        string
 	LogQueries           bool
+	QueryLogFile         string
+	QueryLogMaxSize      string
+	QueryLogRotate       time.Duration
+	QueryLogMaxBackups   string
+	QueryLogCompress     bool
+	QueryLogRemote       string
+	MetricsListen        string
+	DNSTap               string
+	Control              string
 	CacheSize            string
 	CacheMaxAge          time.Duration
+	CacheMaxStale        time.Duration
+	CacheNegative        bool
+	CacheNegativeMaxAge  time.Duration
+	PrefetchHits         string
+	PrefetchTTL          time.Duration
 	MaxTTL               time.Duration
+	UDPPayloadSize       string
+	Padding              bool
+	ECS                  string
 	ReportClientInfo     bool
 	DetectCaptivePortals bool
 	HPM                  bool
+	EndpointStrategy     string
 	BogusPriv            bool
 	UseHosts             bool
+	ValidateQueries      bool
 	Timeout              time.Duration
+	MaxQPS               string
 	SetupRouter          bool
 	AutoActivate         bool
 }
@@ -78,6 +105,8 @@ func (c *Config) flagSet(cmd string) flagSet {
 			"each query:\n"+
 			"* 10.0.3.0/24=abcdef: A CIDR can be used to restrict a configuration to\n"+
 			"  a subnet.\n"+
+			"* 10.0.3.4=abcdef: An IP can be used to restrict a configuration to a\n"+
+			"  specific host.\n"+
 			"* 00:1c:42:2e:60:4a=abcdef: A MAC address can be used to restrict\n"+
 			"  configuration to a specific host on the LAN.\n"+
 			"\n"+
@@ -90,13 +119,105 @@ func (c *Config) flagSet(cmd string) flagSet {
 			"is [DOMAIN=]SERVER_ADDR[,SERVER_ADDR...].\n"+
 			"\n"+
 			"A SERVER_ADDR can ben either an IP[:PORT] for DNS53 (unencrypted UDP,\n"+
-			"TCP), or a HTTPS URL for a DNS over HTTPS server. For DoH, a bootstrap\n"+
-			"IP can be specified as follow: https://dns.nextdns.io#45.90.28.0.\n"+
+			"TCP), a HTTPS URL for a DNS over HTTPS server, or a tls://HOST[:PORT]\n"+
+			"URL for a DNS over TLS server. For DoH and DoT, a bootstrap IP can be\n"+
+			"specified as follow: https://dns.nextdns.io#45.90.28.0.\n"+
 			"Several servers can be specified, separated by comas to implement\n"+
 			"failover."+
 			"\n"+
-			"This parameter can be repeated. The first match wins.")
+			"This parameter can be repeated. The forwarder with the longest\n"+
+			"matching domain wins, e.g. corp.example.com is used over example.com.")
+	fs.Var(&c.LocalRecords, "local-record",
+		"A record to answer locally without contacting any upstream.\n"+
+			"\n"+
+			"The format of this parameter is NAME=[TYPE:]VALUE, where TYPE is one of\n"+
+			"A, AAAA, CNAME, PTR or TXT, and can be omitted for IP addresses:\n"+
+			"\n"+
+			"* nas.home=192.168.1.10: An A record, with the matching PTR record.\n"+
+			"* www.home=CNAME:nas.home: An alias to another name.\n"+
+			"* nas.home=TXT:hello: A TXT record.\n"+
+			"\n"+
+			"This parameter can be repeated to define several records.")
+	fs.Var(&c.LocalDomains, "local-domain",
+		"A domain answered with the local records only. Queries for names of\n"+
+			"this domain and its subdomains without a local record are answered\n"+
+			"with NXDOMAIN instead of being forwarded to an upstream.\n"+
+			"\n"+
+			"This parameter can be repeated.")
+	fs.Var(&c.HostsFiles, "hosts-file",
+		"A file in the /etc/hosts format to answer locally without contacting\n"+
+			"any upstream.\n"+
+			"\n"+
+			"When a directory is specified, all the files it contains are loaded.\n"+
+			"Files are checked for changes every 5 seconds and reloaded when added,\n"+
+			"removed or modified.\n"+
+			"\n"+
+			"This parameter can be repeated to load several files or directories.")
+	fs.Var(&c.Blocklists, "blocklist",
+		"A list of domains to block locally, independently of the NextDNS\n"+
+			"configuration, as a file path or an HTTP(S) URL.\n"+
+			"\n"+
+			"Lists can use the hosts format, one domain per line, wildcards like\n"+
+			"*.example.com, regular expressions like /^ads[0-9]+\\./ or the ABP\n"+
+			"format (||example.com^, with @@||example.com^ for exceptions).\n"+
+			"Domains also block their subdomains.\n"+
+			"\n"+
+			"A list can be prefixed with a condition, in the same format as for the\n"+
+			"config parameter, to only apply it to some clients, like\n"+
+			"28:a0:2b:56:e9:66=/etc/nextdns/kids.txt. Clients matching a condition\n"+
+			"get the lists of their condition in addition to the lists defined\n"+
+			"without condition. The first matching condition wins.\n"+
+			"\n"+
+			"This parameter can be repeated to load several lists.")
+	fs.Var(&c.Allowlists, "allowlist",
+		"A list of domains never blocked by the blocklists, in the same formats\n"+
+			"and with the same optional condition.\n"+
+			"\n"+
+			"This parameter can be repeated to load several lists.")
+	fs.DurationVar(&c.BlocklistRefresh, "blocklist-refresh", 24*time.Hour,
+		"Interval at which the blocklists and allowlists are reloaded.")
+	fs.StringVar(&c.BlockResponse, "block-response", "nxdomain",
+		"Response to queries blocked by the blocklists: nxdomain, null (0.0.0.0\n"+
+			"and :: addresses) or refused.")
 	fs.BoolVar(&c.LogQueries, "log-queries", false, "Log DNS query.")
+	fs.StringVar(&c.QueryLogFile, "query-log-file", "",
+		"Path of a file where all queries are logged as JSON lines, independently\n"+
+			"of log-queries. Disabled if empty.")
+	fs.StringVar(&c.QueryLogMaxSize, "query-log-max-size", "10MB",
+		"Size at which the query log file is rotated. The value can be\n"+
+			"expressed with unit like kB, MB, GB. Use 0 to disable size based\n"+
+			"rotation.")
+	fs.DurationVar(&c.QueryLogRotate, "query-log-rotate", 24*time.Hour,
+		"Interval at which the query log file is rotated. Use 0 to disable time\n"+
+			"based rotation.")
+	fs.StringVar(&c.QueryLogMaxBackups, "query-log-max-backups", "7",
+		"Number of rotated query log files to keep. Use 0 to keep them all.")
+	fs.BoolVar(&c.QueryLogCompress, "query-log-compress", true,
+		"Compress rotated query log files with gzip.")
+	fs.StringVar(&c.QueryLogRemote, "query-log-remote", "",
+		"Remote server where all queries are logged, independently of\n"+
+			"log-queries, so they can be shipped off-box:\n"+
+			"\n"+
+			"* syslog+udp://HOST:PORT, syslog+tcp://HOST:PORT or\n"+
+			"  syslog+tls://HOST:PORT: An RFC5424 syslog server, the query being\n"+
+			"  sent as JSON.\n"+
+			"* fluentd://HOST:PORT[/TAG]: A Fluentd or fluent-bit forward input.\n"+
+			"\n"+
+			"Disabled if empty.")
+	fs.StringVar(&c.DNSTap, "dnstap", "",
+		"Address of a dnstap receiver to stream queries and responses to using\n"+
+			"the Frame Streams protocol. The address is either a unix socket path\n"+
+			"like unix:/var/run/dnstap.sock, or a TCP address like\n"+
+			"tcp:127.0.0.1:6000. Disabled if empty.")
+	fs.StringVar(&c.MetricsListen, "metrics-listen", "",
+		"Listen address for an HTTP server exposing Prometheus metrics on\n"+
+			"/metrics. Metrics are disabled if empty.")
+	fs.StringVar(&c.Control, "control", "",
+		"Path of a unix socket serving a JSON API to manage the daemon while\n"+
+			"running, as used by the control command: status, endpoint health,\n"+
+			"cache stats and flush, reload, log level and temporarily disabling\n"+
+			"the local filtering. The control command uses /var/run/nextdns.sock\n"+
+			"by default. Disabled if empty.")
 	fs.StringVar(&c.CacheSize, "cache-size", "0",
 		"Set the size of the cache in byte. Use 0 to disable caching. The value\n"+
 			"can be expressed with unit like kB, MB, GB. The cache is automatically\n"+
@@ -104,6 +225,27 @@ func (c *Config) flagSet(cmd string) flagSet {
 	fs.DurationVar(&c.CacheMaxAge, "cache-max-age", 0,
 		"If set to greater than 0, a cached entry will be considered stale after\n"+
 			"this duration, even if the record's TTL is higher.")
+	fs.DurationVar(&c.CacheMaxStale, "cache-max-stale", 0,
+		"If set to greater than 0, an expired cached entry is only returned when\n"+
+			"the upstream fails if it expired less than this duration ago. If 0,\n"+
+			"expired entries are returned regardless of their age.")
+	fs.BoolVar(&c.CacheNegative, "cache-negative", true,
+		"Cache negative responses (NXDOMAIN and NODATA) for the TTL defined by\n"+
+			"their SOA record as specified by RFC2308.")
+	fs.DurationVar(&c.CacheNegativeMaxAge, "cache-negative-max-age", 0,
+		"If set to greater than 0, a cached negative response will be considered\n"+
+			"stale after this duration, even if its TTL is higher.")
+	fs.StringVar(&c.PrefetchHits, "prefetch-hits", "0",
+		"If set to greater than 0, a cached response hit this number of times\n"+
+			"is refreshed in the background when about to expire, so popular\n"+
+			"names are always answered from the cache. Requires the cache.")
+	fs.DurationVar(&c.PrefetchTTL, "prefetch-ttl", 0,
+		"Remaining TTL under which a popular cached response is prefetched.\n"+
+			"If 0, 10s is used.")
+	fs.StringVar(&c.UDPPayloadSize, "udp-payload-size", "1232",
+		"UDP payload size advertised in the EDNS OPT record of queries sent to\n"+
+			"plain DNS upstreams. Queries without an OPT record are sent as is.\n"+
+			"The default is the value recommended by the DNS flag day 2020.")
 	fs.DurationVar(&c.MaxTTL, "max-ttl", 0,
 		"If set to greater than 0, defines the maximum TTL value that will be\n"+
 			"handed out to clients. The specified maximum TTL will be given to\n"+
@@ -112,6 +254,18 @@ func (c *Config) flagSet(cmd string) flagSet {
 			"freshness. This is best used in conjunction with the cache to force\n"+
 			"clients not to rely on their own cache in order to pick up\n"+
 			"configuration changes faster.")
+	fs.BoolVar(&c.Padding, "padding", false,
+		"Pad queries sent over DoH and DoT with the EDNS0 padding option to a\n"+
+			"multiple of 128 bytes as recommended by RFC8467, so their size leaks\n"+
+			"less information about the queried names.")
+	fs.StringVar(&c.ECS, "ecs", "passthrough",
+		"Define how the EDNS Client Subnet option of queries is handled, for\n"+
+			"NextDNS and the forwarders alike, whatever their protocol:\n"+
+			"  passthrough: forward the option sent by the client, if any.\n"+
+			"  strip:       remove the option for privacy.\n"+
+			"  client:      send the subnet of public client IPs truncated to /24\n"+
+			"               for IPv4 and /56 for IPv6.\n"+
+			"  <cidr>:      always send this subnet (e.g. 203.0.113.0/24).")
 	fs.BoolVar(&c.ReportClientInfo, "report-client-info", false,
 		"Embed clients information with queries.")
 	fs.BoolVar(&c.DetectCaptivePortals, "detect-captive-portals", false,
@@ -124,6 +278,20 @@ func (c *Config) flagSet(cmd string) flagSet {
 		"When enabled, use DNS servers located in jurisdictions with strong\n"+
 			"privacy laws. Available locations are: Switzerland, Iceland, Finland,\n"+
 			"Panama and Hong Kong.")
+	fs.StringVar(&c.EndpointStrategy, "endpoint-strategy", "ordered",
+		"Order in which the NextDNS endpoints are tested to select the one\n"+
+			"receiving the queries:\n"+
+			"\n"+
+			"* ordered: The order of preference of the endpoints.\n"+
+			"* fastest: The lowest test latency first.\n"+
+			"* lowest-error-rate: The least failed tests first.\n"+
+			"* round-robin: A different endpoint on each selection.\n"+
+			"* sticky: The selected endpoint until it fails, then the next one.")
+	fs.BoolVar(&c.ValidateQueries, "validate-queries", true,
+		"Answer FORMERR to received queries that are not well formed: a\n"+
+			"truncated header, more than one question, no question without an OPT\n"+
+			"record or data after the records. Disable to pass any payload through\n"+
+			"to the upstream, like when fuzzing.")
 	fs.BoolVar(&c.BogusPriv, "bogus-priv", true,
 		"Bogus private reverse lookups.\n"+
 			"\n"+
@@ -134,6 +302,11 @@ func (c *Config) flagSet(cmd string) flagSet {
 	fs.BoolVar(&c.UseHosts, "use-hosts", true,
 		"Lookup /etc/hosts before sending queries to upstream resolver.")
 	fs.DurationVar(&c.Timeout, "timeout", 5*time.Second, "Maximum duration allowed for a request before failing.")
+	fs.StringVar(&c.MaxQPS, "max-qps", "0",
+		"If set to greater than 0, limits the queries sent to NextDNS to this\n"+
+			"number per second, to stay below the rate at which the service\n"+
+			"throttles clients. Bursts are smoothed by briefly queuing the queries\n"+
+			"over the rate. Cached responses are not limited.")
 	fs.BoolVar(&c.SetupRouter, "setup-router", false,
 		"Automatically configure NextDNS for a router setup.\n"+
 			"Common types of router are detected to integrate gracefuly. Changes\n"+
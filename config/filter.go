@@ -0,0 +1,137 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/nextdns/nextdns/filter"
+)
+
+// filterList defines a filter source, a file path or an HTTP(S) URL, with an
+// optional condition.
+type filterList struct {
+	Source string
+	condition
+}
+
+// newFilterList parses a filter source with an optional condition.
+func newFilterList(v string) (filterList, error) {
+	v = strings.TrimSpace(v)
+	if idx := strings.IndexByte(v, '='); idx != -1 {
+		// URLs may contain a =, the prefix is only a condition if it parses
+		// as such.
+		if cond, err := parseCondition(strings.TrimSpace(v[:idx])); err == nil {
+			l := filterList{Source: strings.TrimSpace(v[idx+1:]), condition: cond}
+			if l.Source == "" {
+				return l, errors.New("empty filter list source")
+			}
+			return l, nil
+		}
+	}
+	if v == "" {
+		return filterList{}, errors.New("empty filter list source")
+	}
+	return filterList{Source: v}, nil
+}
+
+func (l filterList) String() string {
+	if cond := l.condition.String(); cond != "" {
+		return fmt.Sprintf("%s=%s", cond, l.Source)
+	}
+	return l.Source
+}
+
+// FilterLists is a list of filter sources with conditions.
+type FilterLists []filterList
+
+// String is the method to format the flag's value
+func (l *FilterLists) String() string {
+	return fmt.Sprint(*l)
+}
+
+func (l *FilterLists) Strings() []string {
+	if l == nil {
+		return nil
+	}
+	var s []string
+	for _, fl := range *l {
+		s = append(s, fl.String())
+	}
+	return s
+}
+
+// Set is the method to set the flag value, part of the flag.Value interface.
+func (l *FilterLists) Set(value string) error {
+	fl, err := newFilterList(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, fl)
+	return nil
+}
+
+// ClientFilters is a set of filters selected by client.
+type ClientFilters struct {
+	// Default is the filter of the clients matching no condition, loading the
+	// lists defined without condition.
+	Default *filter.Filter
+
+	clients []clientFilter
+}
+
+type clientFilter struct {
+	condition
+	filter *filter.Filter
+}
+
+// NewClientFilters returns the filters defined by blocklists and allowlists.
+// A filter is created for each condition, loading the lists of the condition
+// on top of Default, so the lists defined without condition are only loaded
+// once.
+func NewClientFilters(blocklists, allowlists FilterLists) *ClientFilters {
+	cf := &ClientFilters{Default: &filter.Filter{}}
+	get := func(cond condition) *filter.Filter {
+		if cond.String() == "" {
+			return cf.Default
+		}
+		for _, c := range cf.clients {
+			if c.condition.Equal(cond) {
+				return c.filter
+			}
+		}
+		f := &filter.Filter{Base: cf.Default}
+		cf.clients = append(cf.clients, clientFilter{cond, f})
+		return f
+	}
+	for _, l := range blocklists {
+		f := get(l.condition)
+		f.Blocklists = append(f.Blocklists, l.Source)
+	}
+	for _, l := range allowlists {
+		f := get(l.condition)
+		f.Allowlists = append(f.Allowlists, l.Source)
+	}
+	return cf
+}
+
+// Get returns the filter of the client with ip and mac. The first matching
+// condition wins.
+func (cf *ClientFilters) Get(ip net.IP, mac net.HardwareAddr) *filter.Filter {
+	for _, c := range cf.clients {
+		if c.Match(ip, mac) {
+			return c.filter
+		}
+	}
+	return cf.Default
+}
+
+// All returns all the filters of cf, starting with Default.
+func (cf *ClientFilters) All() []*filter.Filter {
+	fs := []*filter.Filter{cf.Default}
+	for _, c := range cf.clients {
+		fs = append(fs, c.filter)
+	}
+	return fs
+}
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestNewClientFilters(t *testing.T) {
+	var block, allow FilterLists
+	for _, v := range []string{
+		"/etc/nextdns/ads.txt",
+		"28:a0:2b:56:e9:66=/etc/nextdns/kids.txt",
+		"https://example.com/list?format=hosts",
+		"10.0.3.0/24=https://example.com/guests.txt",
+	} {
+		if err := block.Set(v); err != nil {
+			t.Fatalf("Set(%s) = Err %v", v, err)
+		}
+	}
+	if err := allow.Set("10.0.3.0/24=/etc/nextdns/guests-allow.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := block.Strings()[2], "https://example.com/list?format=hosts"; got != want {
+		t.Errorf("Strings()[2] = %v, want %v", got, want)
+	}
+
+	cf := NewClientFilters(block, allow)
+	if got := len(cf.All()); got != 3 {
+		t.Fatalf("len(All()) = %d, want 3", got)
+	}
+	mac, _ := net.ParseMAC("28:a0:2b:56:e9:66")
+	tests := []struct {
+		name  string
+		ip    net.IP
+		mac   net.HardwareAddr
+		block []string
+		allow []string
+	}{
+		{"Default", net.ParseIP("10.0.2.1"), nil,
+			[]string{"/etc/nextdns/ads.txt", "https://example.com/list?format=hosts"},
+			nil},
+		{"MAC", net.ParseIP("10.0.3.1"), mac,
+			[]string{"/etc/nextdns/kids.txt"},
+			nil},
+		{"Subnet", net.ParseIP("10.0.3.1"), nil,
+			[]string{"https://example.com/guests.txt"},
+			[]string{"/etc/nextdns/guests-allow.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := cf.Get(tt.ip, tt.mac)
+			if !reflect.DeepEqual(f.Blocklists, tt.block) {
+				t.Errorf("Blocklists = %v, want %v", f.Blocklists, tt.block)
+			}
+			if !reflect.DeepEqual(f.Allowlists, tt.allow) {
+				t.Errorf("Allowlists = %v, want %v", f.Allowlists, tt.allow)
+			}
+			// The lists without condition are shared through Default.
+			if f != cf.Default && f.Base != cf.Default {
+				t.Errorf("Base = %p, want Default %p", f.Base, cf.Default)
+			}
+		})
+	}
+}
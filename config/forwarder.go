@@ -23,7 +23,7 @@ func newResolver(v string) (Resolver, error) {
 	r.addr = v
 	if idx != -1 {
 		r.addr = strings.TrimSpace(v[idx+1:])
-		r.Domain = fqdn(strings.TrimSpace(v[:idx]))
+		r.Domain = fqdn(strings.ToLower(strings.TrimSpace(v[:idx])))
 	}
 	var err error
 	r.Resolver, err = resolver.New(r.addr)
@@ -33,6 +33,7 @@ func newResolver(v string) (Resolver, error) {
 // Match resturns true if the rule matches domain.
 func (r Resolver) Match(domain string) bool {
 	if r.Domain != "" {
+		domain = strings.ToLower(domain)
 		if domain != r.Domain && !isSubDomain(domain, r.Domain) {
 			return false
 		}
@@ -61,14 +62,19 @@ func isSubDomain(sub, domain string) bool {
 // Forwarders is a list of Resolver with rules.
 type Forwarders []Resolver
 
-// Get returns the server matching the domain conditions.
+// Get returns the server matching the domain conditions. When several servers
+// match, the one with the longest domain wins, so a forwarder defined for a
+// sub-domain takes precedence over one for its parent domain.
 func (f *Forwarders) Get(domain string) resolver.Resolver {
+	var match resolver.Resolver
+	matchLen := -1
 	for _, s := range *f {
-		if s.Match(domain) {
-			return s.Resolver
+		if len(s.Domain) > matchLen && s.Match(domain) {
+			match = s.Resolver
+			matchLen = len(s.Domain)
 		}
 	}
-	return nil
+	return match
 }
 
 // String is the method to format the flag's value
@@ -0,0 +1,43 @@
+package config
+
+import "testing"
+
+func TestForwarders_Get(t *testing.T) {
+	var f Forwarders
+	for _, v := range []string{
+		"example.com=1.1.1.1",
+		"corp.example.com=tls://dns.corp.example.com#10.0.0.1",
+		"10.in-addr.arpa=10.0.0.53",
+		"9.9.9.9",
+	} {
+		if err := f.Set(v); err != nil {
+			t.Fatalf("Set(%q) err = %v", v, err)
+		}
+	}
+	tests := []struct {
+		domain string
+		want   string
+	}{
+		{"example.com.", "example.com.=1.1.1.1"},
+		{"www.example.com.", "example.com.=1.1.1.1"},
+		{"corp.example.com.", "corp.example.com.=tls://dns.corp.example.com#10.0.0.1"},
+		{"Host.CORP.example.com.", "corp.example.com.=tls://dns.corp.example.com#10.0.0.1"},
+		{"1.0.0.10.in-addr.arpa.", "10.in-addr.arpa.=10.0.0.53"},
+		{"notexample.com.", "9.9.9.9"},
+		{"nextdns.io.", "9.9.9.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			got := f.Get(tt.domain)
+			for _, r := range f {
+				if r.Resolver == got {
+					if r.String() != tt.want {
+						t.Errorf("Get(%q) = %v, want %v", tt.domain, r, tt.want)
+					}
+					return
+				}
+			}
+			t.Errorf("Get(%q) = %v, want %v", tt.domain, got, tt.want)
+		})
+	}
+}
@@ -7,36 +7,34 @@ import (
 	"strings"
 )
 
-// config defines a configuration ID with some optional conditions.
-type config struct {
-	Config string
+// condition restricts a setting to the clients matching a subnet or a MAC
+// address. An empty condition matches all clients.
+type condition struct {
 	Prefix *net.IPNet
 	MAC    net.HardwareAddr
 }
 
-// newConfig parses a configuration id with an optional condition.
-func newConfig(v string) (config, error) {
-	idx := strings.IndexByte(v, '=')
-	if idx == -1 {
-		return config{Config: v}, nil
-	}
-
-	cond := strings.TrimSpace(v[:idx])
-	conf := strings.TrimSpace(v[idx+1:])
-	c := config{Config: conf}
-
+// parseCondition parses a condition: a CIDR, an IP or a MAC address.
+func parseCondition(cond string) (condition, error) {
+	var c condition
 	if _, ipnet, err := net.ParseCIDR(cond); err == nil {
 		c.Prefix = ipnet
+	} else if ip := net.ParseIP(cond); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		c.Prefix = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
 	} else if mac, err := net.ParseMAC(cond); err == nil {
 		c.MAC = mac
 	} else {
-		return config{}, fmt.Errorf("%s: invalid condition format", cond)
+		return condition{}, fmt.Errorf("%s: invalid condition format", cond)
 	}
 	return c, nil
 }
 
-// Match resturns true if the rule matches ip and mac.
-func (c config) Match(ip net.IP, mac net.HardwareAddr) bool {
+// Match resturns true if the condition matches ip and mac.
+func (c condition) Match(ip net.IP, mac net.HardwareAddr) bool {
 	if c.Prefix != nil {
 		if ip == nil {
 			return false
@@ -56,12 +54,46 @@ func (c config) Match(ip net.IP, mac net.HardwareAddr) bool {
 	return true
 }
 
-func (c config) String() string {
+// Equal returns true if c and c2 define the same criteria.
+func (c condition) Equal(c2 condition) bool {
+	return c.String() == c2.String()
+}
+
+// String returns the condition in the format parsed by parseCondition, or an
+// empty string for an empty condition.
+func (c condition) String() string {
 	if c.MAC != nil {
-		return fmt.Sprintf("%s=%s", c.MAC, c.Config)
+		return c.MAC.String()
 	}
 	if c.Prefix != nil {
-		return fmt.Sprintf("%s=%s", c.Prefix, c.Config)
+		return c.Prefix.String()
+	}
+	return ""
+}
+
+// config defines a configuration ID with some optional conditions.
+type config struct {
+	Config string
+	condition
+}
+
+// newConfig parses a configuration id with an optional condition.
+func newConfig(v string) (config, error) {
+	idx := strings.IndexByte(v, '=')
+	if idx == -1 {
+		return config{Config: v}, nil
+	}
+
+	cond, err := parseCondition(strings.TrimSpace(v[:idx]))
+	if err != nil {
+		return config{}, err
+	}
+	return config{Config: strings.TrimSpace(v[idx+1:]), condition: cond}, nil
+}
+
+func (c config) String() string {
+	if cond := c.condition.String(); cond != "" {
+		return fmt.Sprintf("%s=%s", cond, c.Config)
 	}
 	return c.Config
 }
@@ -103,9 +135,7 @@ func (cs *Configs) Set(value string) error {
 	}
 	// Replace if c match the same criteria of an existing config
 	for i, _c := range *cs {
-		if (c.MAC != nil && _c.MAC != nil && bytes.Equal(c.MAC, _c.MAC)) ||
-			(c.Prefix != nil && _c.Prefix != nil && c.Prefix.String() == _c.Prefix.String()) ||
-			(c.MAC == nil && c.Prefix == nil && _c.MAC == nil && _c.Prefix == nil) {
+		if c.condition.Equal(_c.condition) {
 			(*cs)[i] = c
 			return nil
 		}
@@ -43,6 +43,30 @@ func TestConfigs_Get(t *testing.T) {
 			args{ip: net.ParseIP("10.10.10.21"), mac: parseMAC("28:a0:2b:56:e9:66")},
 			"conf2",
 		},
+		{"IPMatch",
+			[]string{
+				"10.10.10.0/27=conf1",
+				"10.10.10.21=conf2",
+			},
+			args{ip: net.ParseIP("10.10.10.21"), mac: parseMAC("84:89:ad:7c:e3:db")},
+			"conf1",
+		},
+		{"IPMatchFirst",
+			[]string{
+				"10.10.10.21=conf2",
+				"10.10.10.0/27=conf1",
+			},
+			args{ip: net.ParseIP("10.10.10.21"), mac: parseMAC("84:89:ad:7c:e3:db")},
+			"conf2",
+		},
+		{"IPNoMatch",
+			[]string{
+				"10.10.10.21=conf2",
+				"conf4",
+			},
+			args{ip: net.ParseIP("10.10.10.22"), mac: parseMAC("84:89:ad:7c:e3:db")},
+			"conf4",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
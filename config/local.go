@@ -0,0 +1,167 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/nextdns/nextdns/hosts"
+	"github.com/nextdns/nextdns/proxy"
+	"github.com/nextdns/nextdns/resolver/query"
+)
+
+// LocalRecord is a record answered by the proxy without contacting the
+// upstream.
+type LocalRecord struct {
+	Name  string
+	Type  query.Type
+	Value string
+}
+
+var localRecordTypes = map[string]query.Type{
+	"A":     query.TypeA,
+	"AAAA":  query.TypeAAAA,
+	"CNAME": query.TypeCNAME,
+	"PTR":   query.TypePTR,
+	"TXT":   query.TypeTXT,
+}
+
+// newLocalRecord parses a record definition with the NAME=[TYPE:]VALUE
+// format. TYPE can be omitted for IP addresses.
+func newLocalRecord(v string) (LocalRecord, error) {
+	var r LocalRecord
+	idx := strings.IndexByte(v, '=')
+	if idx == -1 {
+		return r, fmt.Errorf("%s: missing record value", v)
+	}
+	r.Name = fqdn(strings.ToLower(strings.TrimSpace(v[:idx])))
+	r.Value = strings.TrimSpace(v[idx+1:])
+	if idx := strings.IndexByte(r.Value, ':'); idx != -1 {
+		if t, found := localRecordTypes[strings.ToUpper(r.Value[:idx])]; found {
+			r.Type = t
+			r.Value = r.Value[idx+1:]
+		}
+	}
+	if r.Type == 0 {
+		ip := net.ParseIP(r.Value)
+		switch {
+		case ip == nil:
+			return r, fmt.Errorf("%s: missing record type", v)
+		case ip.To4() != nil:
+			r.Type = query.TypeA
+		default:
+			r.Type = query.TypeAAAA
+		}
+	}
+	// Validate the record.
+	if err := (&proxy.Zone{}).Add(r.Name, r.Type, r.Value); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+func (r LocalRecord) String() string {
+	return fmt.Sprintf("%s=%v:%s", r.Name, r.Type, r.Value)
+}
+
+// LocalRecords is a list of LocalRecord.
+type LocalRecords []LocalRecord
+
+// Zone returns a proxy.Zone with the records of l, authoritative for domains.
+func (l LocalRecords) Zone(domains LocalDomains) *proxy.Zone {
+	z := &proxy.Zone{}
+	for _, r := range l {
+		// Records are validated by Set.
+		_ = z.Add(r.Name, r.Type, r.Value)
+	}
+	for _, d := range domains {
+		// Domains are validated by Set.
+		_ = z.AddDomain(d)
+	}
+	return z
+}
+
+// String is the method to format the flag's value
+func (l *LocalRecords) String() string {
+	return fmt.Sprint(*l)
+}
+
+func (l *LocalRecords) Strings() []string {
+	if l == nil {
+		return nil
+	}
+	var s []string
+	for _, r := range *l {
+		s = append(s, r.String())
+	}
+	return s
+}
+
+// Set is the method to set the flag value, part of the flag.Value interface.
+func (l *LocalRecords) Set(value string) error {
+	r, err := newLocalRecord(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, r)
+	return nil
+}
+
+// LocalDomains is a list of domains answered locally only.
+type LocalDomains []string
+
+// String is the method to format the flag's value
+func (d *LocalDomains) String() string {
+	return fmt.Sprint(*d)
+}
+
+func (d *LocalDomains) Strings() []string {
+	if d == nil {
+		return nil
+	}
+	return *d
+}
+
+// Set is the method to set the flag value, part of the flag.Value interface.
+func (d *LocalDomains) Set(value string) error {
+	value = fqdn(strings.ToLower(strings.TrimSpace(value)))
+	// Validate the domain.
+	if err := (&proxy.Zone{}).AddDomain(value); err != nil {
+		return err
+	}
+	*d = append(*d, value)
+	return nil
+}
+
+// HostsFiles is a list of hosts files or directories of hosts files.
+type HostsFiles []string
+
+// Source returns a hosts.Source loading the files of h, or nil if h is empty.
+func (h HostsFiles) Source() *hosts.Source {
+	if len(h) == 0 {
+		return nil
+	}
+	return &hosts.Source{Paths: append([]string(nil), h...)}
+}
+
+// String is the method to format the flag's value
+func (h *HostsFiles) String() string {
+	return fmt.Sprint(*h)
+}
+
+func (h *HostsFiles) Strings() []string {
+	if h == nil {
+		return nil
+	}
+	return *h
+}
+
+// Set is the method to set the flag value, part of the flag.Value interface.
+func (h *HostsFiles) Set(value string) error {
+	if value = strings.TrimSpace(value); value == "" {
+		return errors.New("empty hosts file path")
+	}
+	*h = append(*h, value)
+	return nil
+}
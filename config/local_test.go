@@ -0,0 +1,58 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestLocalRecords_Set(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"nas.home=192.168.1.10", "nas.home.=A:192.168.1.10", false},
+		{"NAS.home=2001:db8::1", "nas.home.=AAAA:2001:db8::1", false},
+		{"www.home=CNAME:nas.home", "www.home.=CNAME:nas.home", false},
+		{"nas.home=txt:v=spf1 -all", "nas.home.=TXT:v=spf1 -all", false},
+		{"nas.home=nas", "", true},
+		{"nas.home=A:2001:db8::1", "", true},
+		{"nas.home", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			var l LocalRecords
+			err := l.Set(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Set() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := l.Strings(); len(got) != 1 || got[0] != tt.want {
+				t.Errorf("Set() = %v, want %v", got, tt.want)
+			}
+			// The stored value must be parsed back identically.
+			var l2 LocalRecords
+			if err := l2.Set(l.Strings()[0]); err != nil || l2[0] != l[0] {
+				t.Errorf("Set(String()) = %v, %v, want %v", l2, err, l)
+			}
+		})
+	}
+}
+
+func TestLocalDomains_Set(t *testing.T) {
+	var d LocalDomains
+	for _, v := range []string{"home", "Lan."} {
+		if err := d.Set(v); err != nil {
+			t.Fatalf("Set(%s) err = %v", v, err)
+		}
+	}
+	if got := d.Strings(); len(got) != 2 || got[0] != "home." || got[1] != "lan." {
+		t.Errorf("Strings() = %v, want [home. lan.]", got)
+	}
+	for _, v := range []string{"", "."} {
+		if err := d.Set(v); err == nil {
+			t.Errorf("Set(%q) err = nil", v)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/nextdns/nextdns/control"
+	"github.com/nextdns/nextdns/filter"
+	"github.com/nextdns/nextdns/host"
+	"github.com/nextdns/nextdns/resolver/query"
+)
+
+// defaultControlSocket is the control socket used by the control command if
+// not specified.
+const defaultControlSocket = "/var/run/nextdns.sock"
+
+// healthCheckTimeout is the maximum duration of the health control command.
+const healthCheckTimeout = 10 * time.Second
+
+// setupControl serves the control commands of p on the unix socket at path
+// while the daemon is running. Log levels are changed on log.
+func setupControl(p *proxySvc, path string, log *host.LevelLogger) {
+	started := time.Now()
+
+	// Filtering is disabled until the unix nano time stored in
+	// filteringDisabledUntil.
+	var filteringDisabledUntil int64
+	filteringDisabled := func() (time.Time, bool) {
+		until := time.Unix(0, atomic.LoadInt64(&filteringDisabledUntil))
+		return until, time.Now().Before(until)
+	}
+	if p.Filter != nil || p.GetFilter != nil {
+		f, getFilter := p.Filter, p.GetFilter
+		p.Filter = nil
+		p.GetFilter = func(q query.Query) *filter.Filter {
+			if _, disabled := filteringDisabled(); disabled {
+				return nil
+			}
+			if getFilter != nil {
+				return getFilter(q)
+			}
+			return f
+		}
+	}
+
+	s := &control.Server{
+		Path: path,
+		ErrorLog: func(err error) {
+			p.log.Errorf("Control: %v", err)
+		},
+	}
+	s.Handle("status", func(args json.RawMessage) (interface{}, error) {
+		status := map[string]interface{}{
+			"version":   version,
+			"platform":  platform,
+			"listen":    p.Addr,
+			"uptime":    time.Since(started).Truncate(time.Second).String(),
+			"log_level": log.Level().String(),
+		}
+		if until, disabled := filteringDisabled(); disabled {
+			status["filtering_disabled_until"] = until
+		}
+		return status, nil
+	})
+	s.Handle("health", func(args json.RawMessage) (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+		defer cancel()
+		h, err := p.resolver.Manager.HealthCheck(ctx)
+		if err != nil {
+			return nil, err
+		}
+		health := map[string]interface{}{
+			"endpoint":   h.Endpoint.String(),
+			"protocol":   h.Protocol.String(),
+			"healthy":    h.Healthy,
+			"latency_ms": h.Latency.Milliseconds(),
+		}
+		if h.Error != nil {
+			health["error"] = h.Error.Error()
+		}
+		return health, nil
+	})
+	s.Handle("cache-stats", func(args json.RawMessage) (interface{}, error) {
+		st := p.resolver.CacheStats()
+		stats := map[string]interface{}{
+			"hits":   st.Hits,
+			"misses": st.Misses,
+			"stale":  st.Stale,
+		}
+		if p.cache != nil {
+			stats["entries"] = p.cache.Len()
+		}
+		return stats, nil
+	})
+	s.Handle("cache-flush", func(args json.RawMessage) (interface{}, error) {
+		if p.cache == nil {
+			return nil, errors.New("cache disabled")
+		}
+		p.cache.Purge()
+		p.log.Info("Cache flushed")
+		return nil, nil
+	})
+	s.Handle("reload", func(args json.RawMessage) (interface{}, error) {
+		// Restarting the proxy re-runs OnInit, reloading the filter lists
+		// and re-testing the endpoints.
+		return nil, p.Restart()
+	})
+	s.Handle("log-level", func(args json.RawMessage) (interface{}, error) {
+		var a struct {
+			Level string `json:"level"`
+		}
+		if len(args) > 0 {
+			if err := json.Unmarshal(args, &a); err != nil {
+				return nil, err
+			}
+		}
+		if a.Level != "" {
+			level, err := host.ParseLevel(a.Level)
+			if err != nil {
+				return nil, err
+			}
+			log.SetLevel(level)
+			p.log.Infof("Log level set to %s", level)
+		}
+		return map[string]string{"level": log.Level().String()}, nil
+	})
+	s.Handle("disable-filtering", func(args json.RawMessage) (interface{}, error) {
+		var a struct {
+			Minutes int `json:"minutes"`
+		}
+		if len(args) > 0 {
+			if err := json.Unmarshal(args, &a); err != nil {
+				return nil, err
+			}
+		}
+		if a.Minutes <= 0 {
+			return nil, errors.New("minutes must be positive")
+		}
+		until := time.Now().Add(time.Duration(a.Minutes) * time.Minute)
+		atomic.StoreInt64(&filteringDisabledUntil, until.UnixNano())
+		p.log.Infof("Filtering disabled for %d minutes", a.Minutes)
+		return map[string]time.Time{"until": until}, nil
+	})
+	s.Handle("enable-filtering", func(args json.RawMessage) (interface{}, error) {
+		atomic.StoreInt64(&filteringDisabledUntil, 0)
+		p.log.Info("Filtering enabled")
+		return nil, nil
+	})
+
+	// The control socket is kept open across restarts so the reload command
+	// can be answered.
+	var cancel context.CancelFunc
+	p.OnStarted = append(p.OnStarted, func() {
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		go func() {
+			p.log.Infof("Serving control API on %s", path)
+			if err := s.ListenAndServe(ctx); err != nil && !errors.Is(err, context.Canceled) {
+				p.log.Errorf("Control: %v", err)
+			}
+		}()
+	})
+	p.OnStopped = append(p.OnStopped, func() {
+		if cancel != nil {
+			cancel()
+		}
+		_ = os.Remove(path)
+	})
+}
+
+func ctl(args []string) error {
+	fs := flag.NewFlagSet("nextdns "+args[0], flag.ExitOnError)
+	path := fs.String("control", defaultControlSocket, "Path of the control socket of the daemon.")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), "usage: \n"+
+			"  control [-control PATH] status\n"+
+			"  control [-control PATH] health\n"+
+			"  control [-control PATH] cache-stats\n"+
+			"  control [-control PATH] cache-flush\n"+
+			"  control [-control PATH] reload\n"+
+			"  control [-control PATH] log-level [debug|info|warning|error]\n"+
+			"  control [-control PATH] disable-filtering MINUTES\n"+
+			"  control [-control PATH] enable-filtering\n")
+	}
+	_ = fs.Parse(args[1:])
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	cmd := fs.Arg(0)
+	var cmdArgs interface{}
+	switch cmd {
+	case "log-level":
+		if fs.NArg() > 1 {
+			cmdArgs = map[string]string{"level": fs.Arg(1)}
+		}
+	case "disable-filtering":
+		minutes, err := strconv.Atoi(fs.Arg(1))
+		if err != nil {
+			return fmt.Errorf("%s: invalid number of minutes", fs.Arg(1))
+		}
+		cmdArgs = map[string]int{"minutes": minutes}
+	}
+	var result json.RawMessage
+	if err := control.Send(*path, cmd, cmdArgs, &result); err != nil {
+		return err
+	}
+	if len(result) == 0 || string(result) == "null" {
+		return nil
+	}
+	var out interface{}
+	if err := json.Unmarshal(result, &out); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
@@ -0,0 +1,177 @@
+// Package control implements a JSON API served over a unix socket to manage
+// a running daemon.
+//
+// Each request and response is a JSON object on a single line. A connection
+// can be used for several requests, answered in order:
+//
+//	{"command":"disable-filtering","args":{"minutes":10}}
+//	{"result":{"until":"2020-01-02T03:04:05Z"}}
+//
+// A failed request is answered with an error in place of a result:
+//
+//	{"error":"unknown command: foo"}
+package control
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultIdleTimeout is the default value for Server IdleTimeout.
+const DefaultIdleTimeout = time.Minute
+
+// Request is a command sent to a Server.
+type Request struct {
+	Command string          `json:"command"`
+	Args    json.RawMessage `json:"args,omitempty"`
+}
+
+// Response is the answer of a Server to a Request.
+type Response struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// Handler handles a command with its JSON encoded args, which may be empty.
+// The returned result is JSON encoded in the response.
+type Handler func(args json.RawMessage) (interface{}, error)
+
+// Server serves commands on a unix socket.
+type Server struct {
+	// Path is the path of the unix socket. Any existing file at this path is
+	// removed on listen. The socket is only accessible to its owner.
+	Path string
+
+	// IdleTimeout is the maximum duration to wait for the next request on a
+	// connection before closing it. If zero, DefaultIdleTimeout is used.
+	IdleTimeout time.Duration
+
+	// ErrorLog specifies an optional log function for errors occurring while
+	// serving connections.
+	ErrorLog func(error)
+
+	mu       sync.RWMutex
+	handlers map[string]Handler
+}
+
+// Handle registers h for command.
+func (s *Server) Handle(command string, h Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.handlers == nil {
+		s.handlers = map[string]Handler{}
+	}
+	s.handlers[command] = h
+}
+
+// ListenAndServe listens on Path and serves the commands until ctx is
+// cancelled.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	_ = os.Remove(s.Path)
+	l, err := listen(s.Path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(s.Path, 0600); err != nil {
+		l.Close()
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		go s.serve(c)
+	}
+}
+
+func (s *Server) serve(c net.Conn) {
+	defer c.Close()
+	timeout := s.IdleTimeout
+	if timeout <= 0 {
+		timeout = DefaultIdleTimeout
+	}
+	dec := json.NewDecoder(bufio.NewReader(c))
+	enc := json.NewEncoder(c)
+	for {
+		var req Request
+		if err := c.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return
+		}
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		if err := enc.Encode(s.handle(req)); err != nil {
+			s.logErr(err)
+			return
+		}
+	}
+}
+
+func (s *Server) handle(req Request) Response {
+	s.mu.RLock()
+	h := s.handlers[req.Command]
+	s.mu.RUnlock()
+	if h == nil {
+		return Response{Error: fmt.Sprintf("unknown command: %s", req.Command)}
+	}
+	result, err := h(req.Args)
+	if err != nil {
+		return Response{Error: err.Error()}
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		return Response{Error: err.Error()}
+	}
+	return Response{Result: b}
+}
+
+func (s *Server) logErr(err error) {
+	if s.ErrorLog != nil {
+		s.ErrorLog(err)
+	}
+}
+
+// Send sends command with args to the server listening on the unix socket at
+// path, and decodes its result into result if not nil.
+func Send(path, command string, args, result interface{}) error {
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	req := Request{Command: command}
+	if args != nil {
+		if req.Args, err = json.Marshal(args); err != nil {
+			return err
+		}
+	}
+	if err := json.NewEncoder(c).Encode(req); err != nil {
+		return err
+	}
+	var resp Response
+	if err := json.NewDecoder(c).Decode(&resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	if result == nil || len(resp.Result) == 0 {
+		return nil
+	}
+	return json.Unmarshal(resp.Result, result)
+}
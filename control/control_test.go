@@ -0,0 +1,111 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "control.sock")
+
+	s := &Server{Path: path}
+	s.Handle("echo", func(args json.RawMessage) (interface{}, error) {
+		var a struct{ Msg string }
+		if err := json.Unmarshal(args, &a); err != nil {
+			return nil, err
+		}
+		return a, nil
+	})
+	s.Handle("fail", func(args json.RawMessage) (interface{}, error) {
+		return nil, errors.New("failed")
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.ListenAndServe(ctx)
+	}()
+	waitSocket(t, path)
+	if fi, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("socket mode = %v, want %v", perm, os.FileMode(0600))
+	}
+
+	var res struct{ Msg string }
+	if err := Send(path, "echo", map[string]string{"msg": "hello"}, &res); err != nil {
+		t.Errorf("echo: %v", err)
+	} else if res.Msg != "hello" {
+		t.Errorf("echo = %q, want %q", res.Msg, "hello")
+	}
+	if err := Send(path, "fail", nil, nil); err == nil || err.Error() != "failed" {
+		t.Errorf("fail: err = %v, want failed", err)
+	}
+	if err := Send(path, "foo", nil, nil); err == nil || err.Error() != "unknown command: foo" {
+		t.Errorf("foo: err = %v, want unknown command", err)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("ListenAndServe() = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for ListenAndServe to return")
+	}
+}
+
+func TestServer_IdleTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "control.sock")
+
+	s := &Server{Path: path, IdleTimeout: 50 * time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = s.ListenAndServe(ctx)
+	}()
+	waitSocket(t, path)
+
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// An idle connection is closed by the server.
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read() err = %v, want %v", err, io.EOF)
+	}
+}
+
+// waitSocket waits for the socket at path to be created.
+func waitSocket(t *testing.T, path string) {
+	t.Helper()
+	for i := 0; ; i++ {
+		if _, err := os.Stat(path); err == nil {
+			return
+		}
+		if i == 100 {
+			t.Fatal("timeout waiting for socket")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,17 @@
+// +build aix darwin dragonfly linux netbsd openbsd solaris freebsd
+
+package control
+
+import (
+	"net"
+	"syscall"
+)
+
+// listen creates the unix socket at path with no access for the group and
+// others from the start, as the socket file mode is subject to the umask. The
+// umask is process wide, so it is only changed for the time of the call.
+func listen(path string) (net.Listener, error) {
+	old := syscall.Umask(0177)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
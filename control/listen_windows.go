@@ -0,0 +1,10 @@
+// +build windows
+
+package control
+
+import "net"
+
+// listen creates the unix socket at path.
+func listen(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net"
+	"strings"
+
+	"github.com/nextdns/nextdns/dnstap"
+	"github.com/nextdns/nextdns/host"
+	"github.com/nextdns/nextdns/proxy"
+)
+
+// setupDNSTap streams the messages of p to the dnstap receiver at addr, a
+// unix socket path optionally prefixed by unix:, or a host:port optionally
+// prefixed by tcp:.
+func setupDNSTap(p *proxySvc, addr string) {
+	network := "tcp"
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+	case strings.HasPrefix(addr, "tcp:"):
+		addr = strings.TrimPrefix(addr, "tcp:")
+	case strings.HasPrefix(addr, "/"):
+		network = "unix"
+	}
+	identity, _ := host.Name()
+	s := &dnstap.Sender{
+		Network:  network,
+		Addr:     addr,
+		Identity: identity,
+		Version:  "nextdns " + version,
+		ErrorLog: func(err error) {
+			p.log.Errorf("%v", err)
+		},
+	}
+	p.MessageLog = func(m proxy.MessageInfo) {
+		msg := &dnstap.Message{
+			Type:         dnstap.ClientQuery,
+			Protocol:     dnstap.ProtocolUDP,
+			QueryTime:    m.QueryTime,
+			QueryMessage: m.Query,
+		}
+		if m.Protocol == "TCP" {
+			msg.Protocol = dnstap.ProtocolTCP
+		}
+		switch a := m.PeerAddr.(type) {
+		case *net.UDPAddr:
+			msg.QueryAddr, msg.QueryPort = a.IP, a.Port
+		case *net.TCPAddr:
+			msg.QueryAddr, msg.QueryPort = a.IP, a.Port
+		}
+		s.Send(msg)
+		if m.Response != nil {
+			msg.Type = dnstap.ClientResponse
+			msg.ResponseTime = m.ResponseTime
+			msg.ResponseMessage = m.Response
+			s.Send(msg)
+		}
+	}
+	p.OnInit = append(p.OnInit, s.Start)
+}
@@ -0,0 +1,144 @@
+// Package dnstap implements a dnstap sender, streaming DNS messages encoded
+// with protobuf over the Frame Streams protocol as defined by
+// https://dnstap.info.
+package dnstap
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// MessageType is the type of a dnstap message.
+type MessageType uint64
+
+// Message types defined by dnstap.proto.
+const (
+	ClientQuery    MessageType = 5
+	ClientResponse MessageType = 6
+)
+
+// SocketProtocol is the transport protocol of a dnstap message.
+type SocketProtocol uint64
+
+// Socket protocols defined by dnstap.proto.
+const (
+	ProtocolUDP SocketProtocol = 1
+	ProtocolTCP SocketProtocol = 2
+)
+
+// Message is a dnstap message describing a DNS message received or sent by
+// the proxy.
+type Message struct {
+	Type      MessageType
+	Protocol  SocketProtocol
+	QueryAddr net.IP
+	QueryPort int
+
+	QueryTime    time.Time
+	QueryMessage []byte
+
+	// ResponseTime and ResponseMessage are only set for response messages.
+	ResponseTime    time.Time
+	ResponseMessage []byte
+}
+
+// Fields of the Dnstap and Message protobuf messages of dnstap.proto.
+const (
+	dnstapIdentity = 1
+	dnstapVersion  = 2
+	dnstapMessage  = 14
+	dnstapType     = 15
+
+	messageType             = 1
+	messageSocketFamily     = 2
+	messageSocketProtocol   = 3
+	messageQueryAddress     = 4
+	messageQueryPort        = 6
+	messageQueryTimeSec     = 8
+	messageQueryTimeNsec    = 9
+	messageQueryMessage     = 10
+	messageResponseTimeSec  = 12
+	messageResponseTimeNsec = 13
+	messageResponseMessage  = 14
+
+	dnstapTypeMessage = 1
+
+	socketFamilyINET  = 1
+	socketFamilyINET6 = 2
+)
+
+// Protobuf wire types.
+const (
+	wireVarint  = 0
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// marshal returns the protobuf encoding of m wrapped in a Dnstap message
+// with identity and version.
+func (m *Message) marshal(identity, version string) []byte {
+	var msg []byte
+	msg = appendVarintField(msg, messageType, uint64(m.Type))
+	if ip := m.QueryAddr; ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			msg = appendVarintField(msg, messageSocketFamily, socketFamilyINET)
+			ip = ip4
+		} else {
+			msg = appendVarintField(msg, messageSocketFamily, socketFamilyINET6)
+		}
+		msg = appendVarintField(msg, messageSocketProtocol, uint64(m.Protocol))
+		msg = appendBytesField(msg, messageQueryAddress, ip)
+		msg = appendVarintField(msg, messageQueryPort, uint64(m.QueryPort))
+	}
+	if !m.QueryTime.IsZero() {
+		msg = appendVarintField(msg, messageQueryTimeSec, uint64(m.QueryTime.Unix()))
+		msg = appendFixed32Field(msg, messageQueryTimeNsec, uint32(m.QueryTime.Nanosecond()))
+	}
+	if m.QueryMessage != nil {
+		msg = appendBytesField(msg, messageQueryMessage, m.QueryMessage)
+	}
+	if !m.ResponseTime.IsZero() {
+		msg = appendVarintField(msg, messageResponseTimeSec, uint64(m.ResponseTime.Unix()))
+		msg = appendFixed32Field(msg, messageResponseTimeNsec, uint32(m.ResponseTime.Nanosecond()))
+	}
+	if m.ResponseMessage != nil {
+		msg = appendBytesField(msg, messageResponseMessage, m.ResponseMessage)
+	}
+
+	var b []byte
+	if identity != "" {
+		b = appendBytesField(b, dnstapIdentity, []byte(identity))
+	}
+	if version != "" {
+		b = appendBytesField(b, dnstapVersion, []byte(version))
+	}
+	b = appendBytesField(b, dnstapMessage, msg)
+	b = appendVarintField(b, dnstapType, dnstapTypeMessage)
+	return b
+}
+
+func appendKey(b []byte, field, wireType int) []byte {
+	return appendVarint(b, uint64(field<<3|wireType))
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	return appendVarint(appendKey(b, field, wireVarint), v)
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = appendVarint(appendKey(b, field, wireBytes), uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendFixed32Field(b []byte, field int, v uint32) []byte {
+	b = appendKey(b, field, wireFixed32)
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
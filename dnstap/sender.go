@@ -0,0 +1,229 @@
+package dnstap
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// contentType is the Frame Streams content type of dnstap.
+const contentType = "protobuf:dnstap.Dnstap"
+
+// Frame Streams control frame types and fields.
+const (
+	controlAccept = 1
+	controlStart  = 2
+	controlStop   = 3
+	controlReady  = 4
+	controlFinish = 5
+
+	controlFieldContentType = 1
+
+	maxControlFrameSize = 512
+)
+
+const (
+	// DefaultQueueSize is the default value for Sender QueueSize.
+	DefaultQueueSize = 1024
+
+	// reconnectDelay is the delay between two connection attempts.
+	reconnectDelay = 5 * time.Second
+
+	// ioTimeout is the timeout of the handshake and of each write.
+	ioTimeout = 5 * time.Second
+)
+
+// Sender streams dnstap messages to a Frame Streams receiver, like fstrm
+// capture tools, fluent-bit or PacketBeat, using a bidirectional Frame Streams
+// connection. Messages sent while the receiver is not connected or too slow
+// are dropped.
+type Sender struct {
+	// Network is the network of the receiver: unix or tcp.
+	Network string
+
+	// Addr is the address of the receiver: a socket path for unix, or a
+	// host:port for tcp.
+	Addr string
+
+	// Identity and Version identify the sender in each message.
+	Identity string
+	Version  string
+
+	// QueueSize is the number of messages buffered while sending. If 0,
+	// DefaultQueueSize is used.
+	QueueSize int
+
+	// ErrorLog specifies an optional log function for connection errors.
+	ErrorLog func(error)
+
+	once    sync.Once
+	queue   chan []byte
+	dropped uint64
+}
+
+func (s *Sender) init() {
+	s.once.Do(func() {
+		size := s.QueueSize
+		if size <= 0 {
+			size = DefaultQueueSize
+		}
+		s.queue = make(chan []byte, size)
+	})
+}
+
+// Send queues m to be sent to the receiver. The messages of m are copied and
+// can be reused after the call.
+func (s *Sender) Send(m *Message) {
+	s.init()
+	select {
+	case s.queue <- m.marshal(s.Identity, s.Version):
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+// Dropped returns the number of messages dropped because the queue was full.
+func (s *Sender) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Start connects to the receiver and sends the queued messages until ctx is
+// cancelled, reconnecting on error.
+func (s *Sender) Start(ctx context.Context) {
+	s.init()
+	for {
+		err := s.run(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil && s.ErrorLog != nil {
+			s.ErrorLog(fmt.Errorf("dnstap: %v", err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+// run sends messages on a new connection until ctx is cancelled or an error
+// occurs.
+func (s *Sender) run(ctx context.Context) error {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, s.Network, s.Addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	r := bufio.NewReader(c)
+	w := bufio.NewWriter(c)
+	_ = c.SetDeadline(time.Now().Add(ioTimeout))
+	if err = handshake(r, w); err != nil {
+		return fmt.Errorf("handshake: %v", err)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			_ = c.SetDeadline(time.Now().Add(ioTimeout))
+			if err = writeControl(w, controlStop, false); err != nil {
+				return err
+			}
+			if err = w.Flush(); err != nil {
+				return err
+			}
+			return readControl(r, controlFinish)
+		case frame := <-s.queue:
+			_ = c.SetDeadline(time.Now().Add(ioTimeout))
+			if err = writeFrame(w, frame); err != nil {
+				return err
+			}
+			if len(s.queue) == 0 {
+				// Flush once the queue is drained to batch writes.
+				if err = w.Flush(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// handshake performs the bidirectional Frame Streams handshake.
+func handshake(r io.Reader, w *bufio.Writer) error {
+	if err := writeControl(w, controlReady, true); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := readControl(r, controlAccept); err != nil {
+		return err
+	}
+	if err := writeControl(w, controlStart, true); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// writeFrame writes a data frame.
+func writeFrame(w io.Writer, frame []byte) error {
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(frame)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+// writeControl writes a control frame of type typ, with the dnstap content
+// type if withContentType is true.
+func writeControl(w io.Writer, typ uint32, withContentType bool) error {
+	ctrl := make([]byte, 4, 16+len(contentType))
+	binary.BigEndian.PutUint32(ctrl, typ)
+	if withContentType {
+		var field [8]byte
+		binary.BigEndian.PutUint32(field[:4], controlFieldContentType)
+		binary.BigEndian.PutUint32(field[4:], uint32(len(contentType)))
+		ctrl = append(append(ctrl, field[:]...), contentType...)
+	}
+	// A control frame is escaped by a zero length.
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[4:], uint32(len(ctrl)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(ctrl)
+	return err
+}
+
+// readControl reads a control frame, returning an error if its type is not
+// want.
+func readControl(r io.Reader, want uint32) error {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(hdr[:4]) != 0 {
+		return errors.New("expected control frame")
+	}
+	length := binary.BigEndian.Uint32(hdr[4:])
+	if length < 4 || length > maxControlFrameSize {
+		return fmt.Errorf("invalid control frame length: %d", length)
+	}
+	ctrl := make([]byte, length)
+	if _, err := io.ReadFull(r, ctrl); err != nil {
+		return err
+	}
+	if typ := binary.BigEndian.Uint32(ctrl); typ != want {
+		return fmt.Errorf("unexpected control frame type: %d", typ)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package dnstap
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// readFields decodes the protobuf fields of b by field number. Varints are
+// returned as uint64, fixed32 as uint32 and bytes as []byte.
+func readFields(t *testing.T, b []byte) map[int]interface{} {
+	t.Helper()
+	fields := map[int]interface{}{}
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatal("invalid key")
+		}
+		b = b[n:]
+		switch field := int(key >> 3); key & 7 {
+		case wireVarint:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatal("invalid varint")
+			}
+			fields[field] = v
+			b = b[n:]
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				t.Fatal("invalid bytes")
+			}
+			fields[field] = b[n : n+int(l)]
+			b = b[n+int(l):]
+		case wireFixed32:
+			fields[field] = binary.LittleEndian.Uint32(b)
+			b = b[4:]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+	return fields
+}
+
+func TestSender(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	frames := make(chan []byte)
+	stopped := make(chan error, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			stopped <- err
+			return
+		}
+		defer c.Close()
+		r := bufio.NewReader(c)
+		w := bufio.NewWriter(c)
+		if err := readControl(r, controlReady); err != nil {
+			stopped <- err
+			return
+		}
+		_ = writeControl(w, controlAccept, true)
+		_ = w.Flush()
+		if err := readControl(r, controlStart); err != nil {
+			stopped <- err
+			return
+		}
+		for {
+			var length uint32
+			if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+				stopped <- err
+				return
+			}
+			if length == 0 {
+				// Control frame: must be STOP.
+				var ctrl [8]byte
+				if _, err := io.ReadFull(r, ctrl[:]); err != nil {
+					stopped <- err
+					return
+				}
+				if typ := binary.BigEndian.Uint32(ctrl[4:]); typ != controlStop {
+					stopped <- fmt.Errorf("unexpected control frame type: %d", typ)
+					return
+				}
+				_ = writeControl(w, controlFinish, false)
+				stopped <- w.Flush()
+				return
+			}
+			frame := make([]byte, length)
+			if _, err := io.ReadFull(r, frame); err != nil {
+				stopped <- err
+				return
+			}
+			frames <- frame
+		}
+	}()
+
+	s := &Sender{Network: "tcp", Addr: l.Addr().String(), Identity: "test", Version: "v1"}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Start(ctx)
+		close(done)
+	}()
+
+	qtime := time.Unix(1577934245, 42)
+	s.Send(&Message{
+		Type:         ClientQuery,
+		Protocol:     ProtocolUDP,
+		QueryAddr:    net.ParseIP("192.168.1.10"),
+		QueryPort:    5353,
+		QueryTime:    qtime,
+		QueryMessage: []byte("query"),
+	})
+	var frame []byte
+	select {
+	case frame = <-frames:
+	case err := <-stopped:
+		t.Fatalf("receiver: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for frame")
+	}
+	d := readFields(t, frame)
+	if string(d[dnstapIdentity].([]byte)) != "test" || string(d[dnstapVersion].([]byte)) != "v1" || d[dnstapType] != uint64(dnstapTypeMessage) {
+		t.Errorf("dnstap = %v", d)
+	}
+	m := readFields(t, d[dnstapMessage].([]byte))
+	want := map[int]interface{}{
+		messageType:           uint64(ClientQuery),
+		messageSocketFamily:   uint64(socketFamilyINET),
+		messageSocketProtocol: uint64(ProtocolUDP),
+		messageQueryAddress:   []byte{192, 168, 1, 10},
+		messageQueryPort:      uint64(5353),
+		messageQueryTimeSec:   uint64(1577934245),
+		messageQueryTimeNsec:  uint32(42),
+		messageQueryMessage:   []byte("query"),
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("message = %v, want %v", m, want)
+	}
+
+	cancel()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("receiver: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for stop")
+	}
+	<-done
+}
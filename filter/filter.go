@@ -0,0 +1,206 @@
+// Package filter implements a local domain filter, independent of the
+// NextDNS configuration, loading its rules from files or URLs.
+package filter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRefreshInterval is the default interval at which filter sources are
+// reloaded.
+const DefaultRefreshInterval = 24 * time.Hour
+
+// DefaultMaxListSize is the default maximum size in bytes of a source.
+const DefaultMaxListSize = 64 << 20
+
+// DefaultDownloadTimeout is the timeout of the downloads of URL sources when
+// no Client is set.
+const DefaultDownloadTimeout = 2 * time.Minute
+
+var defaultClient = &http.Client{Timeout: DefaultDownloadTimeout}
+
+// Response defines how queries for blocked domains are answered.
+type Response int
+
+const (
+	// ResponseNXDomain answers blocked queries with NXDOMAIN.
+	ResponseNXDomain Response = iota
+
+	// ResponseNull answers blocked A and AAAA queries with the unspecified
+	// address (0.0.0.0 or ::), and other queries with no answer.
+	ResponseNull
+
+	// ResponseRefused answers blocked queries with REFUSED.
+	ResponseRefused
+)
+
+// Filter matches domains against rules loaded from blocklists and allowlists.
+// Allowlists take precedence over blocklists. See parseList for the
+// supported list formats.
+type Filter struct {
+	// Blocklists are the sources of the blocked domains. A source is either a
+	// file path or an HTTP(S) URL.
+	Blocklists []string
+
+	// Allowlists are the sources of the domains never blocked.
+	Allowlists []string
+
+	// Base is an optional filter whose rules apply in addition to the rules
+	// of the filter, so common lists are loaded and stored only once. Its
+	// sources are loaded independently, by its own Start or Load.
+	Base *Filter
+
+	// Response defines how blocked queries are answered.
+	Response Response
+
+	// RefreshInterval is the interval at which the sources are reloaded by
+	// Start. If 0, DefaultRefreshInterval is used.
+	RefreshInterval time.Duration
+
+	// Client is the HTTP client used to download URL sources. If nil, a
+	// client with a timeout of DefaultDownloadTimeout is used.
+	Client *http.Client
+
+	// MaxListSize is the maximum size in bytes of a source, above which it
+	// fails to load. If 0, DefaultMaxListSize is used.
+	MaxListSize int64
+
+	// ErrorLog specifies an optional log function for errors occurring while
+	// loading sources.
+	ErrorLog func(error)
+
+	mu    sync.RWMutex
+	block rules
+	allow rules
+	lists map[string]*list
+}
+
+// Match returns true if name is blocked by the filter.
+func (f *Filter) Match(name string) bool {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	block, allow := f.match(name)
+	return block && !allow
+}
+
+// match returns whether name is matched by the block and allow rules of f and
+// its base filters.
+func (f *Filter) match(name string) (block, allow bool) {
+	if f.Base != nil {
+		block, allow = f.Base.match(name)
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if !block {
+		block = f.block.match(name)
+	}
+	if !allow {
+		allow = f.allow.match(name)
+	}
+	return block, allow
+}
+
+// Start loads the sources of the filter, and reloads them every
+// RefreshInterval until ctx is cancelled.
+func (f *Filter) Start(ctx context.Context) {
+	interval := f.RefreshInterval
+	if interval <= 0 {
+		interval = DefaultRefreshInterval
+	}
+	for {
+		if err := f.Load(ctx); err != nil && f.ErrorLog != nil {
+			f.ErrorLog(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Load loads the sources of the filter. The previously loaded rules of a
+// source are kept if it fails to load, the first error being returned.
+func (f *Filter) Load(ctx context.Context) error {
+	var firstErr error
+	lists := map[string]*list{}
+	var block, allow rules
+	load := func(sources []string, allowlist bool) {
+		for _, source := range sources {
+			l, err := f.loadList(ctx, source, allowlist)
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("%s: %v", source, err)
+				}
+				f.mu.RLock()
+				l = f.lists[source]
+				f.mu.RUnlock()
+				if l == nil {
+					continue
+				}
+			}
+			lists[source] = l
+			block.merge(l.block)
+			allow.merge(l.allow)
+		}
+	}
+	load(f.Blocklists, false)
+	load(f.Allowlists, true)
+	f.mu.Lock()
+	f.block = block
+	f.allow = allow
+	f.lists = lists
+	f.mu.Unlock()
+	return firstErr
+}
+
+func (f *Filter) loadList(ctx context.Context, source string, allow bool) (*list, error) {
+	r, err := f.open(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	max := f.MaxListSize
+	if max == 0 {
+		max = DefaultMaxListSize
+	}
+	lr := &io.LimitedReader{R: r, N: max + 1}
+	l, err := parseList(lr, allow)
+	if err != nil {
+		return nil, err
+	}
+	if lr.N == 0 {
+		return nil, fmt.Errorf("larger than %d bytes", max)
+	}
+	return l, nil
+}
+
+// open returns the content of source.
+func (f *Filter) open(ctx context.Context, source string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return os.Open(source)
+	}
+	req, err := http.NewRequest("GET", source, nil)
+	if err != nil {
+		return nil, err
+	}
+	c := f.Client
+	if c == nil {
+		c = defaultClient
+	}
+	res, err := c.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("status: %d", res.StatusCode)
+	}
+	return res.Body, nil
+}
@@ -0,0 +1,199 @@
+package filter
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseList(t *testing.T) {
+	l, err := parseList(strings.NewReader(`
+# hosts format
+0.0.0.0 ads.example.com tracker.example.com # inline comment
+127.0.0.1 localhost localhost.localdomain
+::1 ip6-localhost
+! ABP format
+[Adblock Plus 2.0]
+||abp.example.com^
+||path.example.com/ads^
+||modifier.example.com^$third-party
+@@||good.abp.example.com^
+plain.example.net
+*.wild.example.org
+ads*.example.io
+/^ad[0-9]+\.example\.fr$/
+invalid,domain
+`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		block bool
+		allow bool
+	}{
+		{"ads.example.com", true, false},
+		{"sub.ads.example.com", true, false},
+		{"tracker.example.com", true, false},
+		{"example.com", false, false},
+		{"localhost", false, false},
+		{"localhost.localdomain", false, false},
+		{"abp.example.com", true, false},
+		{"good.abp.example.com", true, true},
+		{"path.example.com", false, false},
+		{"modifier.example.com", false, false},
+		{"plain.example.net", true, false},
+		{"wild.example.org", false, false},
+		{"a.wild.example.org", true, false},
+		{"b.a.wild.example.org", true, false},
+		{"otherwild.example.org", false, false},
+		{"ads42.example.io", true, false},
+		{"ad42.example.fr", true, false},
+		{"adx.example.fr", false, false},
+		{"invalid,domain", false, false},
+	}
+	for _, tt := range tests {
+		if got := l.block.match(tt.name); got != tt.block {
+			t.Errorf("block.match(%s) = %v, want %v", tt.name, got, tt.block)
+		}
+		if got := l.allow.match(tt.name); got != tt.allow {
+			t.Errorf("allow.match(%s) = %v, want %v", tt.name, got, tt.allow)
+		}
+	}
+	// *.wild.example.org is stored as a suffix, only ads*.example.io and the
+	// regular expression are compiled.
+	if got := len(l.block.patterns); got != 2 {
+		t.Errorf("block patterns = %d, want 2", got)
+	}
+	if !l.block.suffixes["wild.example.org"] {
+		t.Error("*.wild.example.org not stored as a suffix")
+	}
+}
+
+func TestFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	allowlist := filepath.Join(dir, "allow")
+	if err := ioutil.WriteFile(allowlist, []byte("good.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var blocklist atomic.Value
+	blocklist.Store("example.com\n")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		list := blocklist.Load().(string)
+		if list == "" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(list))
+	}))
+	defer ts.Close()
+
+	f := &Filter{Blocklists: []string{ts.URL}, Allowlists: []string{allowlist}}
+	if err := f.Load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	check := func(name string, want bool) {
+		t.Helper()
+		if got := f.Match(name); got != want {
+			t.Errorf("Match(%s) = %v, want %v", name, got, want)
+		}
+	}
+	check("www.Example.com.", true)
+	check("good.example.com.", false)
+	check("example.net.", false)
+
+	// The previous rules of a source are kept when it fails to load.
+	blocklist.Store("")
+	if err := f.Load(context.Background()); err == nil {
+		t.Error("Load() expected error")
+	}
+	check("www.example.com.", true)
+
+	// Missing sources are reported.
+	f.Allowlists = append(f.Allowlists, filepath.Join(dir, "missing"))
+	if err := f.Load(context.Background()); err == nil {
+		t.Error("Load() expected error")
+	}
+}
+
+func TestFilter_MaxListSize(t *testing.T) {
+	list := "example.com\nexample.net\n"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(list))
+	}))
+	defer ts.Close()
+
+	f := &Filter{Blocklists: []string{ts.URL}, MaxListSize: int64(len(list))}
+	if err := f.Load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !f.Match("example.net.") {
+		t.Error("Match(example.net.) = false, want true")
+	}
+	// A list larger than MaxListSize is not truncated but fails to load.
+	f = &Filter{Blocklists: []string{ts.URL}, MaxListSize: int64(len(list)) - 1}
+	if err := f.Load(context.Background()); err == nil {
+		t.Error("Load() expected error")
+	}
+	if f.Match("example.com.") {
+		t.Error("Match(example.com.) = true, want false")
+	}
+}
+
+func TestFilter_Base(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	base := &Filter{
+		Blocklists: []string{write("ads", "ads.example.com\nexample.net\n")},
+		Allowlists: []string{write("allow", "good.ads.example.com\n")},
+	}
+	kids := &Filter{
+		Base:       base,
+		Blocklists: []string{write("kids", "games.example.com\n")},
+		Allowlists: []string{write("kids-allow", "ok.example.net\n")},
+	}
+	for _, f := range []*Filter{base, kids} {
+		if err := f.Load(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name string
+		base bool
+		kids bool
+	}{
+		{"ads.example.com.", true, true},
+		{"good.ads.example.com.", false, false},
+		{"games.example.com.", false, true},
+		{"www.example.net.", true, true},
+		{"ok.example.net.", true, false},
+	}
+	for _, tt := range tests {
+		if got := base.Match(tt.name); got != tt.base {
+			t.Errorf("base.Match(%s) = %v, want %v", tt.name, got, tt.base)
+		}
+		if got := kids.Match(tt.name); got != tt.kids {
+			t.Errorf("kids.Match(%s) = %v, want %v", tt.name, got, tt.kids)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package filter
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// rules is a set of domain rules.
+type rules struct {
+	// domains are matched with their subdomains.
+	domains map[string]bool
+
+	// suffixes are only matched with their subdomains, as *.domain rules.
+	suffixes map[string]bool
+
+	// patterns are matched against the whole name, without the trailing dot.
+	patterns []*regexp.Regexp
+}
+
+func (r *rules) addDomain(domain string) {
+	if r.domains == nil {
+		r.domains = map[string]bool{}
+	}
+	r.domains[domain] = true
+}
+
+func (r *rules) addSuffix(domain string) {
+	if r.suffixes == nil {
+		r.suffixes = map[string]bool{}
+	}
+	r.suffixes[domain] = true
+}
+
+func (r *rules) addPattern(re *regexp.Regexp) {
+	r.patterns = append(r.patterns, re)
+}
+
+// merge adds the rules of r2 to r.
+func (r *rules) merge(r2 rules) {
+	for domain := range r2.domains {
+		r.addDomain(domain)
+	}
+	for domain := range r2.suffixes {
+		r.addSuffix(domain)
+	}
+	r.patterns = append(r.patterns, r2.patterns...)
+}
+
+// match returns true if name, lowercased and without the trailing dot, is
+// matched by a rule of r.
+func (r *rules) match(name string) bool {
+	for domain := name; domain != ""; {
+		if r.domains[domain] || (domain != name && r.suffixes[domain]) {
+			return true
+		}
+		idx := strings.IndexByte(domain, '.')
+		if idx == -1 {
+			break
+		}
+		domain = domain[idx+1:]
+	}
+	for _, re := range r.patterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// list is the content of a filter source.
+type list struct {
+	block rules
+	allow rules
+}
+
+// parseList parses the rules of a list. The following formats are supported,
+// and can be mixed in the same list:
+//
+//   - hosts format: 0.0.0.0 ads.example.com
+//   - one domain per line: ads.example.com
+//   - wildcards: *.ads.example.com or ads*.example.com
+//   - regular expressions: /^ads[0-9]+\./
+//   - ABP style: ||ads.example.com^, with @@||example.com^ for exceptions
+//
+// Domains also match their subdomains. When allow is true, all the rules of
+// the list are exceptions. Unsupported rules are ignored.
+func parseList(r io.Reader, allow bool) (*list, error) {
+	l := &list{}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+			// Comments and ABP headers.
+			continue
+		}
+		set := &l.block
+		if strings.HasPrefix(line, "@@") {
+			line = line[2:]
+			set = &l.allow
+		}
+		if allow {
+			set = &l.allow
+		}
+		if len(line) > 2 && line[0] == '/' && line[len(line)-1] == '/' {
+			if re, err := regexp.Compile(line[1 : len(line)-1]); err == nil {
+				set.addPattern(re)
+			}
+			continue
+		}
+		if idx := strings.IndexByte(line, '#'); idx != -1 {
+			line = line[:idx]
+		}
+		if strings.HasPrefix(line, "||") {
+			line = strings.TrimSuffix(strings.TrimSuffix(line[2:], "|"), "^")
+			if strings.ContainsAny(line, "$/^|") {
+				// Rules with modifiers or paths do not apply to DNS.
+				continue
+			}
+			addRule(set, line)
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) > 1 && net.ParseIP(f[0]) != nil {
+			for _, name := range f[1:] {
+				if strings.IndexByte(name, '.') != -1 && name != "localhost.localdomain" {
+					// Skip the localhost entries of hosts files.
+					addRule(set, name)
+				}
+			}
+			continue
+		}
+		if len(f) == 1 {
+			addRule(set, f[0])
+		}
+	}
+	return l, s.Err()
+}
+
+// addRule adds the domain or wildcard rule to set. Wildcards other than a
+// leading *. label are compiled to regular expressions.
+func addRule(set *rules, rule string) {
+	rule = strings.TrimSuffix(strings.ToLower(rule), ".")
+	if rule == "" {
+		return
+	}
+	for _, c := range rule {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == '*') {
+			return
+		}
+	}
+	if strings.IndexByte(rule, '*') == -1 {
+		set.addDomain(rule)
+		return
+	}
+	if strings.HasPrefix(rule, "*.") && strings.IndexByte(rule[2:], '*') == -1 {
+		// Subdomain wildcards are the most common, no need for a regexp.
+		set.addSuffix(rule[2:])
+		return
+	}
+	pattern := strings.Replace(regexp.QuoteMeta(rule), `\*`, `.*`, -1)
+	set.addPattern(regexp.MustCompile("^" + pattern + "$"))
+}
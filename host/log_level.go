@@ -0,0 +1,94 @@
+package host
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Level is the minimum severity of the messages written by a LevelLogger.
+type Level int32
+
+const (
+	// LevelDebug writes all the messages, including the DNS queries.
+	LevelDebug Level = iota - 1
+
+	// LevelInfo writes all the messages. It is the default.
+	LevelInfo
+
+	// LevelWarning drops the informational messages.
+	LevelWarning
+
+	// LevelError only writes the errors.
+	LevelError
+)
+
+// ParseLevel returns the level named s: debug, info, warning or error.
+func ParseLevel(s string) (Level, error) {
+	switch s {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warning":
+		return LevelWarning, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("%s: invalid log level", s)
+}
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarning:
+		return "warning"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int32(l))
+}
+
+// LevelLogger is a Logger dropping the messages below its level, which can
+// be changed at any time. Debug messages are informational messages the
+// caller only logs when Level returns LevelDebug.
+type LevelLogger struct {
+	Logger
+	level int32
+}
+
+// Level returns the current level of l.
+func (l *LevelLogger) Level() Level {
+	return Level(atomic.LoadInt32(&l.level))
+}
+
+// SetLevel changes the level of l.
+func (l *LevelLogger) SetLevel(level Level) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+func (l *LevelLogger) Info(v ...interface{}) {
+	if l.Level() <= LevelInfo {
+		l.Logger.Info(v...)
+	}
+}
+
+func (l *LevelLogger) Infof(format string, a ...interface{}) {
+	if l.Level() <= LevelInfo {
+		l.Logger.Infof(format, a...)
+	}
+}
+
+func (l *LevelLogger) Warning(v ...interface{}) {
+	if l.Level() <= LevelWarning {
+		l.Logger.Warning(v...)
+	}
+}
+
+func (l *LevelLogger) Warningf(format string, a ...interface{}) {
+	if l.Level() <= LevelWarning {
+		l.Logger.Warningf(format, a...)
+	}
+}
@@ -99,11 +99,37 @@ func readHosts() {
 
 	hs := make(map[string][]string)
 	is := make(map[string][]string)
-	var file *file
-	if file, err = open(hp); file == nil {
+	if err = parseHosts(hp, hs, is); err != nil {
 		fmt.Println("return 1", err)
 		return
 	}
+	for _, lh := range []string{"localhost", "localhost.localdomain."} {
+		if len(hs[lh]) == 0 {
+			// Some systemd based systems like arch linux have an empty hosts
+			// file and rely on systemd-resolved to handle special hostnames
+			// like localhost. As we don't want to rely on systemd, we have to
+			// handle this special case by ourselves. We still let the system
+			// redefine those hosts if deemed necessary.
+			hs[lh] = []string{"127.0.0.1", "::1"}
+		}
+	}
+	// Update the data cache.
+	hosts.expire = now.Add(cacheMaxAge)
+	hosts.path = hp
+	hosts.byName = hs
+	hosts.byAddr = is
+	hosts.mtime = mtime
+	hosts.size = size
+}
+
+// parseHosts reads the hosts file at path, adding its addresses by name to hs
+// and its names by address to is.
+func parseHosts(path string, hs, is map[string][]string) error {
+	file, err := open(path)
+	if file == nil {
+		return err
+	}
+	defer file.close()
 	for line, ok := file.readLine(); ok; line, ok = file.readLine() {
 		if i := strings.IndexByte(line, '#'); i >= 0 {
 			// Discard comments.
@@ -126,22 +152,5 @@ func readHosts() {
 			is[addr] = append(is[addr], name)
 		}
 	}
-	for _, lh := range []string{"localhost", "localhost.localdomain."} {
-		if len(hs[lh]) == 0 {
-			// Some systemd based systems like arch linux have an empty hosts
-			// file and rely on systemd-resolved to handle special hostnames
-			// like localhost. As we don't want to rely on systemd, we have to
-			// handle this special case by ourselves. We still let the system
-			// redefine those hosts if deemed necessary.
-			hs[lh] = []string{"127.0.0.1", "::1"}
-		}
-	}
-	// Update the data cache.
-	hosts.expire = now.Add(cacheMaxAge)
-	hosts.path = hp
-	hosts.byName = hs
-	hosts.byAddr = is
-	hosts.mtime = mtime
-	hosts.size = size
-	file.close()
+	return nil
 }
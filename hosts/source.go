@@ -0,0 +1,144 @@
+package hosts
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultCheckInterval is the default interval at which the files of a Source
+// are checked for changes.
+const DefaultCheckInterval = 5 * time.Second
+
+// Source is a set of hosts files, in the /etc/hosts format, loaded from Paths.
+//
+// Files are loaded by Load, or by Start which checks them for changes every
+// CheckInterval and reloads the set when a file is added, removed or
+// modified, so host lists can be updated without restarting. Lookups only
+// read the last loaded set and never access the files.
+type Source struct {
+	// Paths are the hosts files to load. When a path is a directory, all the
+	// regular files it contains are loaded, except hidden files. Paths not
+	// existing yet are ignored until they are created.
+	Paths []string
+
+	// CheckInterval is the interval at which Start checks the files for
+	// changes. If 0, DefaultCheckInterval is used.
+	CheckInterval time.Duration
+
+	table atomic.Value // *table
+
+	mu    sync.Mutex // serializes loads
+	files []fileStat
+}
+
+// table is the parsed content of the files of a Source.
+type table struct {
+	byName map[string][]string
+	byAddr map[string][]string
+}
+
+type fileStat struct {
+	path  string
+	mtime time.Time
+	size  int64
+}
+
+// LookupHost looks up the addresses for the given host from the source.
+func (s *Source) LookupHost(host string) []string {
+	t, _ := s.table.Load().(*table)
+	if t == nil {
+		return nil
+	}
+	lowerHost := []byte(host)
+	lowerASCIIBytes(lowerHost)
+	return copyStrings(t.byName[absDomainName(lowerHost)])
+}
+
+// LookupAddr looks up the hosts for the given address from the source.
+func (s *Source) LookupAddr(addr string) []string {
+	t, _ := s.table.Load().(*table)
+	if t == nil {
+		return nil
+	}
+	if addr = parseLiteralIP(addr); addr == "" {
+		return nil
+	}
+	return copyStrings(t.byAddr[addr])
+}
+
+// Start loads the files of the source, and reloads them when they change,
+// checking them every CheckInterval until ctx is cancelled.
+func (s *Source) Start(ctx context.Context) {
+	interval := s.CheckInterval
+	if interval <= 0 {
+		interval = DefaultCheckInterval
+	}
+	for {
+		s.Load()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Load loads the files of the source if they changed since the last load.
+func (s *Source) Load() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files := s.list()
+	if s.table.Load() != nil && reflect.DeepEqual(files, s.files) {
+		return
+	}
+	t := &table{
+		byName: make(map[string][]string),
+		byAddr: make(map[string][]string),
+	}
+	for _, f := range files {
+		// A file removed since listed is just ignored until the next load.
+		_ = parseHosts(f.path, t.byName, t.byAddr)
+	}
+	s.table.Store(t)
+	s.files = files
+}
+
+// list returns the hosts files of the source in the order they are loaded.
+func (s *Source) list() []fileStat {
+	var files []fileStat
+	for _, path := range s.Paths {
+		st, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if !st.IsDir() {
+			files = append(files, fileStat{path, st.ModTime(), st.Size()})
+			continue
+		}
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			if !e.Mode().IsRegular() || strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			files = append(files, fileStat{filepath.Join(path, e.Name()), e.ModTime(), e.Size()})
+		}
+	}
+	return files
+}
+
+func copyStrings(s []string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+	return append([]string(nil), s...)
+}
@@ -0,0 +1,82 @@
+package hosts
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, data string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a", "192.168.1.10 nas.home NAS\n")
+	write(".a.swp", "10.0.0.1 swap.home\n")
+
+	s := &Source{Paths: []string{"testdata/hosts", dir, filepath.Join(dir, "missing")}}
+	checkHost := func(host string, want []string) {
+		t.Helper()
+		if got := s.LookupHost(host); !reflect.DeepEqual(got, want) {
+			t.Errorf("LookupHost(%s) = %v, want %v", host, got, want)
+		}
+	}
+	// Nothing is loaded before Load.
+	checkHost("nas.home", nil)
+	s.Load()
+	checkHost("odin", []string{"127.0.0.2", "127.0.0.3", "::2"})
+	checkHost("nas.home", []string{"192.168.1.10"})
+	checkHost("swap.home", nil)
+	if got, want := s.LookupAddr("192.168.1.10"), []string{"nas.home.", "NAS"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("LookupAddr() = %v, want %v", got, want)
+	}
+
+	// Changes are picked up on the next load.
+	write("a", "192.168.1.11 nas.home\n")
+	write("b", "192.168.1.20 printer.home\n")
+	checkHost("nas.home", []string{"192.168.1.10"})
+	s.Load()
+	checkHost("nas.home", []string{"192.168.1.11"})
+	checkHost("printer.home", []string{"192.168.1.20"})
+
+	if err := os.Remove(filepath.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+	s.Load()
+	checkHost("printer.home", nil)
+}
+
+func TestSource_Start(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hosts")
+	s := &Source{Paths: []string{path}, CheckInterval: 10 * time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Start(ctx)
+
+	// The file is loaded in the background once created.
+	if err := ioutil.WriteFile(path, []byte("192.168.1.10 nas.home\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for s.LookupHost("nas.home") == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("hosts file not loaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -29,10 +29,13 @@ var commands = []command{
 	{"run", run, "run the daemon"},
 
 	{"config", cfg, "manage configuration"},
+	{"control", ctl, "manage the running daemon"},
 
 	{"activate", activation, "setup the system to use NextDNS as a resolver"},
 	{"deactivate", activation, "restore the resolver configuration"},
 
+	{"selftest", selfTest, "test connectivity with NextDNS or the given servers"},
+
 	{"version", showVersion, "show current version"},
 }
 
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/nextdns/nextdns/metrics"
+	"github.com/nextdns/nextdns/proxy"
+	"github.com/nextdns/nextdns/resolver/endpoint"
+)
+
+// activeClientWindow is the duration during which a client is counted as
+// active after its last query.
+const activeClientWindow = 5 * time.Minute
+
+// setupMetrics serves the metrics of p on addr at /metrics while the proxy is
+// running.
+func setupMetrics(p *proxySvc, addr string) {
+	queries := &metrics.CounterVec{
+		Name:   "nextdns_queries_total",
+		Help:   "Number of DNS queries received by type and response code.",
+		Labels: []string{"type", "rcode"},
+	}
+	upstream := &metrics.HistogramVec{
+		Name:   "nextdns_upstream_duration_seconds",
+		Help:   "Duration of the queries sent to an upstream by endpoint and transport.",
+		Labels: []string{"endpoint", "transport"},
+	}
+	endpointErrors := &metrics.CounterVec{
+		Name:   "nextdns_endpoint_errors_total",
+		Help:   "Number of failed endpoint tests by endpoint.",
+		Labels: []string{"endpoint"},
+	}
+	endpointChanges := &metrics.CounterVec{
+		Name: "nextdns_endpoint_changes_total",
+		Help: "Number of times the active endpoint changed.",
+	}
+	clients := &metrics.ActiveSet{Window: activeClientWindow}
+
+	r := &metrics.Registry{}
+	r.Register(queries)
+	r.Register(upstream)
+	r.Register(endpointErrors)
+	r.Register(endpointChanges)
+	for _, m := range []struct {
+		name, help string
+		value      func() uint64
+	}{
+		{"nextdns_cache_hits_total", "Number of queries answered from the cache.", func() uint64 { return p.resolver.CacheStats().Hits }},
+		{"nextdns_cache_misses_total", "Number of cacheable queries not found in the cache.", func() uint64 { return p.resolver.CacheStats().Misses }},
+		{"nextdns_cache_stale_total", "Number of queries answered with a stale cached response.", func() uint64 { return p.resolver.CacheStats().Stale }},
+	} {
+		value := m.value
+		r.Register(&metrics.Func{Name: m.name, Help: m.help, Type: "counter", Value: func() float64 {
+			return float64(value())
+		}})
+	}
+	r.Register(&metrics.Func{
+		Name: "nextdns_active_clients",
+		Help: "Number of clients seen in the last 5 minutes.",
+		Type: "gauge",
+		Value: func() float64 {
+			return float64(clients.Count())
+		},
+	})
+
+	queryLog := p.QueryLog
+	p.QueryLog = func(q proxy.QueryInfo) {
+		if queryLog != nil {
+			queryLog(q)
+		}
+		rcode := q.RCode
+		if rcode == "" && q.Error != nil {
+			rcode = "ERROR"
+		}
+		queries.Inc(q.Type, rcode)
+		if q.PeerIP != nil {
+			clients.Seen(q.PeerIP.String())
+		}
+		if !q.FromCache && q.UpstreamEndpoint != "" && q.Error == nil {
+			upstream.Observe(q.UpstreamDuration.Seconds(), endpointLabel(q.UpstreamEndpoint), q.UpstreamTransport)
+		}
+	}
+	m := p.resolver.Manager
+	onError := m.OnError
+	m.OnError = func(e endpoint.Endpoint, err error) {
+		if onError != nil {
+			onError(e, err)
+		}
+		endpointErrors.Inc(endpointLabel(e.String()))
+	}
+	onChange := m.OnChange
+	m.OnChange = func(e endpoint.Endpoint) {
+		if onChange != nil {
+			onChange(e)
+		}
+		endpointChanges.Inc()
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r)
+	p.OnInit = append(p.OnInit, func(ctx context.Context) {
+		s := &http.Server{Addr: addr, Handler: mux}
+		go func() {
+			<-ctx.Done()
+			s.Close()
+		}()
+		p.log.Infof("Serving metrics on %s", addr)
+		if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			p.log.Errorf("Metrics server: %v", err)
+		}
+	})
+}
+
+// endpointLabel returns the scheme and host of the endpoint e, without the
+// path holding the configuration ID nor the bootstrap IPs.
+func endpointLabel(e string) string {
+	if u, err := url.Parse(e); err == nil && u.Host != "" {
+		return u.Scheme + "://" + u.Host
+	}
+	return e
+}
@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+// ActiveSet counts the distinct keys seen within Window, like the clients
+// active in the last minutes.
+type ActiveSet struct {
+	Window time.Duration
+
+	mu     sync.Mutex
+	seen   map[string]time.Time
+	pruned time.Time
+	now    func() time.Time // time.Now if nil
+}
+
+// Seen marks key as active. Expired keys are forgotten every Window, so the
+// set does not grow when Count is never called.
+func (a *ActiveSet) Seen(key string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.seen == nil {
+		a.seen = map[string]time.Time{}
+	}
+	now := a.time()
+	a.seen[key] = now
+	if now.Sub(a.pruned) >= a.Window {
+		a.prune(now)
+	}
+}
+
+// Count returns the number of keys seen within Window, forgetting the others.
+func (a *ActiveSet) Count() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.prune(a.time())
+	return len(a.seen)
+}
+
+func (a *ActiveSet) prune(now time.Time) {
+	a.pruned = now
+	expired := now.Add(-a.Window)
+	for key, t := range a.seen {
+		if t.Before(expired) {
+			delete(a.seen, key)
+		}
+	}
+}
+
+func (a *ActiveSet) time() time.Time {
+	if a.now != nil {
+		return a.now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,245 @@
+// Package metrics implements a minimal set of metrics exposed in the
+// Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the default histogram buckets, in seconds, suited to DNS
+// latencies.
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// Metric is a metric that can be registered in a Registry.
+type Metric interface {
+	// write writes the metric in the text exposition format.
+	write(w io.Writer)
+}
+
+// Registry is a set of metrics served by its ServeHTTP method.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []Metric
+}
+
+// Register adds m to the registry.
+func (r *Registry) Register(m Metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// Write writes all the metrics of r to w in the text exposition format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	metrics := append([]Metric(nil), r.metrics...)
+	r.mu.Unlock()
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_ = r.Write(w)
+}
+
+// CounterVec is a set of counters partitioned by the values of Labels.
+type CounterVec struct {
+	Name   string
+	Help   string
+	Labels []string
+
+	mu     sync.Mutex
+	values map[string]*sample
+}
+
+type sample struct {
+	labels []string
+	value  float64
+}
+
+// Inc increments the counter for the label values by 1.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v to the counter for the label values.
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.values == nil {
+		c.values = map[string]*sample{}
+	}
+	s := c.values[key]
+	if s == nil {
+		s = &sample{labels: append([]string(nil), labelValues...)}
+		c.values[key] = s
+	}
+	s.value += v
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	writeHeader(w, c.Name, c.Help, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := c.values[key]
+		writeSample(w, c.Name, c.Labels, s.labels, "", "", s.value)
+	}
+}
+
+// HistogramVec is a set of histograms partitioned by the values of Labels.
+type HistogramVec struct {
+	Name   string
+	Help   string
+	Labels []string
+
+	// Buckets are the upper bounds of the buckets, in increasing order. If
+	// nil, DefaultBuckets is used.
+	Buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+type histogram struct {
+	labels []string
+	counts []uint64 // by bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// Observe adds v to the histogram for the label values.
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	buckets := h.buckets()
+	key := strings.Join(labelValues, "\x00")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.values == nil {
+		h.values = map[string]*histogram{}
+	}
+	hs := h.values[key]
+	if hs == nil {
+		hs = &histogram{
+			labels: append([]string(nil), labelValues...),
+			counts: make([]uint64, len(buckets)),
+		}
+		h.values[key] = hs
+	}
+	if i := sort.SearchFloat64s(buckets, v); i < len(buckets) {
+		hs.counts[i]++
+	}
+	hs.count++
+	hs.sum += v
+}
+
+func (h *HistogramVec) buckets() []float64 {
+	if h.Buckets == nil {
+		return DefaultBuckets
+	}
+	return h.Buckets
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	writeHeader(w, h.Name, h.Help, "histogram")
+	buckets := h.buckets()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hs := h.values[key]
+		var cumul uint64
+		for i, le := range buckets {
+			cumul += hs.counts[i]
+			writeSample(w, h.Name+"_bucket", h.Labels, hs.labels, "le", formatFloat(le), float64(cumul))
+		}
+		writeSample(w, h.Name+"_bucket", h.Labels, hs.labels, "le", "+Inf", float64(hs.count))
+		writeSample(w, h.Name+"_sum", h.Labels, hs.labels, "", "", hs.sum)
+		writeSample(w, h.Name+"_count", h.Labels, hs.labels, "", "", float64(hs.count))
+	}
+}
+
+// Func is a metric whose value is returned by Value when collected.
+type Func struct {
+	Name string
+	Help string
+
+	// Type is the type of metric: counter or gauge.
+	Type string
+
+	Value func() float64
+}
+
+func (f *Func) write(w io.Writer) {
+	writeHeader(w, f.Name, f.Help, f.Type)
+	writeSample(w, f.Name, nil, nil, "", "", f.Value())
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, helpEscaper.Replace(help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+// writeSample writes a sample with the labels names and values, and an extra
+// label if extraName is not empty.
+func writeSample(w io.Writer, name string, names, values []string, extraName, extraValue string, v float64) {
+	io.WriteString(w, name)
+	if len(names) > 0 || extraName != "" {
+		io.WriteString(w, "{")
+		sep := ""
+		for i, n := range names {
+			var lv string
+			if i < len(values) {
+				lv = values[i]
+			}
+			fmt.Fprintf(w, "%s%s=\"%s\"", sep, n, escapeLabel(lv))
+			sep = ","
+		}
+		if extraName != "" {
+			fmt.Fprintf(w, "%s%s=\"%s\"", sep, extraName, escapeLabel(extraValue))
+		}
+		io.WriteString(w, "}")
+	}
+	io.WriteString(w, " "+formatFloat(v)+"\n")
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestRegistry_Write(t *testing.T) {
+	queries := &CounterVec{Name: "queries_total", Help: "Queries.", Labels: []string{"type", "rcode"}}
+	queries.Inc("A", "NOERROR")
+	queries.Inc("A", "NOERROR")
+	queries.Inc("AAAA", `"odd"`)
+	latency := &HistogramVec{Name: "latency_seconds", Help: "Latency.", Labels: []string{"endpoint"}, Buckets: []float64{.01, .1}}
+	latency.Observe(.005, "a")
+	latency.Observe(.05, "a")
+	latency.Observe(1, "a")
+	r := &Registry{}
+	r.Register(queries)
+	r.Register(latency)
+	r.Register(&Func{Name: "clients", Help: "Clients\nactive.", Type: "gauge", Value: func() float64 { return 3 }})
+
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP queries_total Queries.
+# TYPE queries_total counter
+queries_total{type="A",rcode="NOERROR"} 2
+queries_total{type="AAAA",rcode="\"odd\""} 1
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{endpoint="a",le="0.01"} 1
+latency_seconds_bucket{endpoint="a",le="0.1"} 2
+latency_seconds_bucket{endpoint="a",le="+Inf"} 3
+latency_seconds_sum{endpoint="a"} 1.055
+latency_seconds_count{endpoint="a"} 3
+# HELP clients Clients\nactive.
+# TYPE clients gauge
+clients 3
+`
+	if got := buf.String(); got != want {
+		t.Errorf("Write() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestActiveSet(t *testing.T) {
+	a := &ActiveSet{Window: time.Minute}
+	a.Seen("10.0.0.1")
+	a.Seen("10.0.0.2")
+	a.Seen("10.0.0.1")
+	if got := a.Count(); got != 2 {
+		t.Errorf("Count() = %d, want 2", got)
+	}
+	a.seen["10.0.0.2"] = time.Now().Add(-2 * time.Minute)
+	if got := a.Count(); got != 1 {
+		t.Errorf("Count() = %d, want 1", got)
+	}
+}
+
+func TestActiveSet_Prune(t *testing.T) {
+	now := time.Now()
+	a := &ActiveSet{Window: time.Minute, now: func() time.Time { return now }}
+	for _, key := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		a.Seen(key)
+	}
+	// Seen forgets the expired keys without any call to Count.
+	now = now.Add(2 * time.Minute)
+	a.Seen("10.0.0.4")
+	if got := len(a.seen); got != 1 {
+		t.Errorf("len(seen) = %d, want 1", got)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net"
 	"time"
 
+	"github.com/nextdns/nextdns/filter"
 	"github.com/nextdns/nextdns/hosts"
 	"github.com/nextdns/nextdns/resolver"
 	"github.com/nextdns/nextdns/resolver/query"
@@ -23,9 +24,25 @@ type QueryInfo struct {
 	Duration          time.Duration
 	FromCache         bool
 	UpstreamTransport string
+	UpstreamEndpoint  string
+	UpstreamDuration  time.Duration
+	RCode             string
+	Blocked           bool
 	Error             error
 }
 
+// MessageInfo provides the DNS messages of a query handled by Proxy.
+type MessageInfo struct {
+	Protocol     string
+	PeerAddr     net.Addr
+	QueryTime    time.Time
+	Query        []byte
+	ResponseTime time.Time
+
+	// Response is nil if no response was sent.
+	Response []byte
+}
+
 // Proxy is a DNS53 to DNS over anything proxy.
 type Proxy struct {
 	// Addr specifies the TCP/UDP address to listen to, :53 if empty.
@@ -38,10 +55,31 @@ type Proxy struct {
 	// with NXDOMAIN.
 	BogusPriv bool
 
+	// LocalZone defines records answered authoritatively without calling the
+	// upstream resolver.
+	LocalZone *Zone
+
 	// UseHosts specifies that /etc/hosts needs to be checked before calling the
 	// upstream resolver.
 	UseHosts bool
 
+	// Hosts defines optional hosts files checked before calling the upstream
+	// resolver, after the local zone.
+	Hosts *hosts.Source
+
+	// Filter defines an optional local filter. Queries for blocked domains
+	// are answered as defined by the filter without calling the upstream
+	// resolver.
+	Filter *filter.Filter
+
+	// GetFilter, if set, is called to get the filter of the client of q, in
+	// place of Filter. It may return nil for no filtering.
+	GetFilter func(q query.Query) *filter.Filter
+
+	// SkipQueryValidation disables the check that received queries are well
+	// formed. Malformed queries are answered with FORMERR otherwise.
+	SkipQueryValidation bool
+
 	// Timeout defines the maximum allowed time allowed for a request before
 	// being cancelled.
 	Timeout time.Duration
@@ -49,6 +87,10 @@ type Proxy struct {
 	// QueryLog specifies an optional log function called for each received query.
 	QueryLog func(QueryInfo)
 
+	// MessageLog specifies an optional function called with the messages of
+	// each received query. The messages are only valid during the call.
+	MessageLog func(MessageInfo)
+
 	// InfoLog specifies an option log function called when some actions are
 	// performed.
 	InfoLog func(string)
@@ -56,6 +98,10 @@ type Proxy struct {
 	// ErrorLog specifies an optional log function for errors. If not set,
 	// errors are not reported.
 	ErrorLog func(error)
+
+	// DebugLog specifies an optional log function for events too frequent to
+	// be reported as errors, like malformed queries received from clients.
+	DebugLog func(string)
 }
 
 // ListenAndServe listens on UDP and TCP and serve DNS queries. If ctx is
@@ -142,12 +188,30 @@ func (p Proxy) ListenAndServe(ctx context.Context) error {
 }
 
 func (p Proxy) Resolve(ctx context.Context, q query.Query, buf []byte) (n int, i resolver.ResolveInfo, err error) {
+	if p.LocalZone != nil {
+		if n, i, err = p.LocalZone.resolve(q, buf); err != errNotInZone {
+			return
+		}
+	}
+	if p.Hosts != nil {
+		n, i, err = hostsResolve(q, buf, p.Hosts.LookupHost, p.Hosts.LookupAddr)
+		if err == nil {
+			return
+		}
+	}
 	if p.UseHosts {
-		n, i, err = hostsResolve(q, buf)
+		n, i, err = hostsResolve(q, buf, hosts.LookupHost, hosts.LookupAddr)
 		if err == nil {
 			return
 		}
 	}
+	f := p.Filter
+	if p.GetFilter != nil {
+		f = p.GetFilter(q)
+	}
+	if f != nil && f.Match(q.Name) {
+		return replyBlocked(q, buf, f.Response)
+	}
 	if p.BogusPriv && q.Type == query.TypePTR && isPrivateReverse(q.Name) {
 		return replyNXDomain(q, buf)
 	}
@@ -155,18 +219,39 @@ func (p Proxy) Resolve(ctx context.Context, q query.Query, buf []byte) (n int, i
 	return p.Upstream.Resolve(ctx, q, buf)
 }
 
+// validateQuery returns query.ErrInvalidQuery if payload is not a well formed
+// query, unless SkipQueryValidation is set.
+func (p Proxy) validateQuery(payload []byte) error {
+	if p.SkipQueryValidation {
+		return nil
+	}
+	return query.Validate(payload)
+}
+
 func (p Proxy) logQuery(q QueryInfo) {
 	if p.QueryLog != nil {
 		p.QueryLog(q)
 	}
 }
 
+func (p Proxy) logMessage(m MessageInfo) {
+	if p.MessageLog != nil {
+		p.MessageLog(m)
+	}
+}
+
 func (p Proxy) logInfof(format string, a ...interface{}) {
 	if p.InfoLog != nil {
 		p.InfoLog(fmt.Sprintf(format, a...))
 	}
 }
 
+func (p Proxy) logDebugf(format string, a ...interface{}) {
+	if p.DebugLog != nil {
+		p.DebugLog(fmt.Sprintf(format, a...))
+	}
+}
+
 func (p Proxy) logErr(err error) {
 	if err != nil && p.ErrorLog != nil {
 		p.ErrorLog(err)
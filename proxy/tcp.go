@@ -58,6 +58,17 @@ func (p Proxy) serveTCPConn(c net.Conn, bpool *sync.Pool) error {
 		if qsize <= 14 {
 			return fmt.Errorf("query too small: %d", qsize)
 		}
+		if err := p.validateQuery(buf[:qsize]); err != nil {
+			p.logDebugf("TCP query from %v: %v", c.RemoteAddr(), err)
+			if resp := formErr(buf[:qsize]); resp != nil {
+				if err := writeTCP(c, resp); err != nil {
+					bpool.Put(&buf)
+					return fmt.Errorf("TCP write: %v", err)
+				}
+			}
+			bpool.Put(&buf)
+			continue
+		}
 		start := time.Now()
 		go func() {
 			var err error
@@ -75,6 +86,15 @@ func (p Proxy) serveTCPConn(c net.Conn, bpool *sync.Pool) error {
 					stackBuf = stackBuf[:runtime.Stack(stackBuf, false)]
 					err = fmt.Errorf("panic: %v: %s", r, string(stackBuf))
 				}
+				rc := rcode(rbuf, rsize)
+				p.logMessage(MessageInfo{
+					Protocol:     "TCP",
+					PeerAddr:     c.RemoteAddr(),
+					QueryTime:    start,
+					Query:        buf[:qsize],
+					ResponseTime: time.Now(),
+					Response:     message(rbuf, rsize),
+				})
 				bpool.Put(&buf)
 				bpool.Put(&rbuf)
 				p.logQuery(QueryInfo{
@@ -87,6 +107,10 @@ func (p Proxy) serveTCPConn(c net.Conn, bpool *sync.Pool) error {
 					Duration:          time.Since(start),
 					FromCache:         ri.FromCache,
 					UpstreamTransport: ri.Transport,
+					UpstreamEndpoint:  ri.Endpoint,
+					UpstreamDuration:  ri.UpstreamDuration,
+					RCode:             rc,
+					Blocked:           ri.Blocked,
 					Error:             err,
 				})
 			}()
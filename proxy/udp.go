@@ -68,6 +68,14 @@ func (p Proxy) serveUDP(l net.PacketConn) error {
 			bpool.Put(&buf)
 			continue
 		}
+		if err := p.validateQuery(buf[:qsize]); err != nil {
+			p.logDebugf("UDP query from %v: %v", raddr, err)
+			if resp := formErr(buf[:qsize]); resp != nil {
+				_, _, _ = c.WriteMsgUDP(resp, oobWithSrc(lip), raddr)
+			}
+			bpool.Put(&buf)
+			continue
+		}
 		start := time.Now()
 		go func() {
 			var err error
@@ -84,6 +92,15 @@ func (p Proxy) serveUDP(l net.PacketConn) error {
 					stackBuf = stackBuf[:runtime.Stack(stackBuf, false)]
 					err = fmt.Errorf("panic: %v: %s", r, string(stackBuf))
 				}
+				rc := rcode(rbuf, rsize)
+				p.logMessage(MessageInfo{
+					Protocol:     "UDP",
+					PeerAddr:     raddr,
+					QueryTime:    start,
+					Query:        buf[:qsize],
+					ResponseTime: time.Now(),
+					Response:     message(rbuf, rsize),
+				})
 				bpool.Put(&buf)
 				bpool.Put(&rbuf)
 				p.logQuery(QueryInfo{
@@ -96,6 +113,10 @@ func (p Proxy) serveUDP(l net.PacketConn) error {
 					Duration:          time.Since(start),
 					FromCache:         ri.FromCache,
 					UpstreamTransport: ri.Transport,
+					UpstreamEndpoint:  ri.Endpoint,
+					UpstreamDuration:  ri.UpstreamDuration,
+					RCode:             rc,
+					Blocked:           ri.Blocked,
 					Error:             err,
 				})
 			}()
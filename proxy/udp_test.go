@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nextdns/nextdns/resolver"
+	"github.com/nextdns/nextdns/resolver/query"
+)
+
+// echoResolver answers queries with their payload and counts them.
+type echoResolver struct {
+	calls int32
+}
+
+func (r *echoResolver) Resolve(ctx context.Context, q query.Query, buf []byte) (int, resolver.ResolveInfo, error) {
+	atomic.AddInt32(&r.calls, 1)
+	return copy(buf, q.Payload), resolver.ResolveInfo{}, nil
+}
+
+func TestProxy_serveUDP_validation(t *testing.T) {
+	valid := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0,
+		7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 1, 0, 1}
+	garbage := append(append([]byte{}, valid...), 0xde, 0xad)
+	response := append([]byte{}, garbage...)
+	response[2] |= 0x80
+	// RFC7873 cookie only query: no question and an OPT record with a client
+	// cookie.
+	cookie := []byte{0x12, 0x34, 0x01, 0x00, 0, 0, 0, 0, 0, 0, 0, 1,
+		0, 0, 41, 0x10, 0, 0, 0, 0, 0, 0, 12, 0, 10, 0, 8, 1, 2, 3, 4, 5, 6, 7, 8}
+	formErr := []byte{0x12, 0x34, 0x81, 0x01, 0, 0, 0, 0, 0, 0, 0, 0}
+	tests := []struct {
+		name         string
+		skip         bool
+		payload      []byte
+		want         []byte // nil for no response
+		wantUpstream bool
+	}{
+		{"Valid", false, valid, valid, true},
+		{"CookieOnly", false, cookie, cookie, true},
+		{"TrailingGarbage", false, garbage, formErr, false},
+		{"Response", false, response, nil, false},
+		{"SkipValidation", true, garbage, garbage, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			up := &echoResolver{}
+			p := Proxy{Upstream: up, SkipQueryValidation: tt.skip}
+			go func() { _ = p.serveUDP(l) }()
+
+			c, err := net.Dial("udp", l.LocalAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if _, err := c.Write(tt.payload); err != nil {
+				t.Fatal(err)
+			}
+			_ = c.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+			buf := make([]byte, 512)
+			n, err := c.Read(buf)
+			if tt.want == nil {
+				if err == nil {
+					t.Errorf("got response %x, want none", buf[:n])
+				}
+			} else if err != nil {
+				t.Errorf("no response: %v", err)
+			} else if !bytes.Equal(buf[:n], tt.want) {
+				t.Errorf("response = %x, want %x", buf[:n], tt.want)
+			}
+			if calls := atomic.LoadInt32(&up.calls); (calls > 0) != tt.wantUpstream {
+				t.Errorf("upstream calls = %d", calls)
+			}
+		})
+	}
+}
@@ -6,7 +6,7 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/nextdns/nextdns/hosts"
+	"github.com/nextdns/nextdns/filter"
 	"github.com/nextdns/nextdns/internal/dnsmessage"
 	"github.com/nextdns/nextdns/resolver"
 	"github.com/nextdns/nextdns/resolver/query"
@@ -31,7 +31,56 @@ func replyNXDomain(q query.Query, buf []byte) (n int, i resolver.ResolveInfo, er
 	return len(buf), i, err
 }
 
-func hostsResolve(q query.Query, buf []byte) (n int, i resolver.ResolveInfo, err error) {
+// replyBlocked answers q, blocked by a local filter, with resp.
+func replyBlocked(q query.Query, buf []byte, resp filter.Response) (n int, i resolver.ResolveInfo, err error) {
+	i.Transport = "blocked"
+	i.Blocked = true
+	var p dnsmessage.Parser
+	h, err := p.Start(q.Payload)
+	if err != nil {
+		return 0, i, err
+	}
+	q1, err := p.Question()
+	if err != nil {
+		return 0, i, err
+	}
+	h.Response = true
+	h.RecursionAvailable = true
+	switch resp {
+	case filter.ResponseRefused:
+		h.RCode = dnsmessage.RCodeRefused
+	case filter.ResponseNull:
+		h.RCode = dnsmessage.RCodeSuccess
+	default:
+		h.RCode = dnsmessage.RCodeNameError
+	}
+	b := dnsmessage.NewBuilder(buf[:0], h)
+	_ = b.StartQuestions()
+	_ = b.Question(q1)
+	if resp == filter.ResponseNull {
+		_ = b.StartAnswers()
+		hdr := dnsmessage.ResourceHeader{
+			Name:  q1.Name,
+			Type:  q1.Type,
+			Class: q1.Class,
+		}
+		switch q.Type {
+		case query.TypeA:
+			err = b.AResource(hdr, dnsmessage.AResource{})
+		case query.TypeAAAA:
+			err = b.AAAAResource(hdr, dnsmessage.AAAAResource{})
+		}
+		if err != nil {
+			return 0, i, err
+		}
+	}
+	buf, err = b.Finish()
+	return len(buf), i, err
+}
+
+// hostsResolve answers A, AAAA and PTR queries using lookupHost and
+// lookupAddr, with the semantic of hosts.LookupHost and hosts.LookupAddr.
+func hostsResolve(q query.Query, buf []byte, lookupHost, lookupAddr func(string) []string) (n int, i resolver.ResolveInfo, err error) {
 	switch q.Type {
 	case query.TypeA, query.TypeAAAA, query.TypePTR:
 	default:
@@ -42,19 +91,19 @@ func hostsResolve(q query.Query, buf []byte) (n int, i resolver.ResolveInfo, err
 	var rrs []string
 	switch q.Type {
 	case query.TypeA:
-		for _, ip := range hosts.LookupHost(q.Name) {
+		for _, ip := range lookupHost(q.Name) {
 			if strings.IndexByte(ip, '.') != -1 {
 				rrs = append(rrs, ip)
 			}
 		}
 	case query.TypeAAAA:
-		for _, ip := range hosts.LookupHost(q.Name) {
+		for _, ip := range lookupHost(q.Name) {
 			if strings.IndexByte(ip, '.') == -1 {
 				rrs = append(rrs, ip)
 			}
 		}
 	case query.TypePTR:
-		for _, host := range hosts.LookupAddr(ptrIP(q.Name).String()) {
+		for _, host := range lookupAddr(ptrIP(q.Name).String()) {
 			if strings.HasSuffix(host, ".") {
 				rrs = append(rrs, host)
 			}
@@ -118,6 +167,55 @@ func hostsResolve(q query.Query, buf []byte) (n int, i resolver.ResolveInfo, err
 
 }
 
+// message returns the n bytes DNS message in buf, or nil if no message was
+// written.
+// formErr turns the header of the malformed query msg into a FORMERR response
+// without any record, and returns it. It returns nil if msg is a response,
+// which must not be answered.
+func formErr(msg []byte) []byte {
+	if len(msg) < 12 || msg[2]&0x80 != 0 {
+		return nil
+	}
+	msg[2] = 0x80 | msg[2]&0x79 // QR, keeping the opcode and RD
+	msg[3] = 1                  // FORMERR
+	for i := 4; i < 12; i++ {
+		msg[i] = 0 // no records
+	}
+	return msg[:12]
+}
+
+func message(buf []byte, n int) []byte {
+	if n <= 0 || n > len(buf) {
+		return nil
+	}
+	return buf[:n]
+}
+
+// rcode returns the name of the response code of the n bytes DNS message in
+// buf, or an empty string if no response was written.
+func rcode(buf []byte, n int) string {
+	msg := message(buf, n)
+	if len(msg) < 4 {
+		return ""
+	}
+	switch rc := dnsmessage.RCode(msg[3] & 0xf); rc {
+	case dnsmessage.RCodeSuccess:
+		return "NOERROR"
+	case dnsmessage.RCodeFormatError:
+		return "FORMERR"
+	case dnsmessage.RCodeServerFailure:
+		return "SERVFAIL"
+	case dnsmessage.RCodeNameError:
+		return "NXDOMAIN"
+	case dnsmessage.RCodeNotImplemented:
+		return "NOTIMP"
+	case dnsmessage.RCodeRefused:
+		return "REFUSED"
+	default:
+		return strconv.Itoa(int(rc))
+	}
+}
+
 func isPrivateReverse(qname string) bool {
 	if ip := ptrIP(qname); ip != nil {
 		if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
@@ -3,6 +3,10 @@ package proxy
 import (
 	"net"
 	"testing"
+
+	"github.com/nextdns/nextdns/filter"
+	"github.com/nextdns/nextdns/internal/dnsmessage"
+	"github.com/nextdns/nextdns/resolver/query"
 )
 
 func Test_ptrIP(t *testing.T) {
@@ -65,3 +69,65 @@ func Test_isPrivateReverse(t *testing.T) {
 		})
 	}
 }
+
+func Test_replyBlocked(t *testing.T) {
+	tests := []struct {
+		resp    filter.Response
+		qtype   query.Type
+		rcode   dnsmessage.RCode
+		answers int
+	}{
+		{filter.ResponseNXDomain, query.TypeA, dnsmessage.RCodeNameError, 0},
+		{filter.ResponseRefused, query.TypeA, dnsmessage.RCodeRefused, 0},
+		{filter.ResponseNull, query.TypeA, dnsmessage.RCodeSuccess, 1},
+		{filter.ResponseNull, query.TypeAAAA, dnsmessage.RCodeSuccess, 1},
+		{filter.ResponseNull, query.TypeTXT, dnsmessage.RCodeSuccess, 0},
+	}
+	for _, tt := range tests {
+		buf := make([]byte, 512)
+		n, _, err := replyBlocked(newZoneQuery(t, "ads.example.com.", tt.qtype), buf, tt.resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var p dnsmessage.Parser
+		h, err := p.Start(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = p.SkipAllQuestions()
+		answers, err := p.AllAnswers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.RCode != tt.rcode || len(answers) != tt.answers {
+			t.Errorf("replyBlocked(%v, %v) = %v with %d answers, want %v with %d answers",
+				tt.resp, tt.qtype, h.RCode, len(answers), tt.rcode, tt.answers)
+		}
+		for _, a := range answers {
+			switch b := a.Body.(type) {
+			case *dnsmessage.AResource:
+				if !net.IP(b.A[:]).Equal(net.IPv4zero) {
+					t.Errorf("A = %v, want 0.0.0.0", net.IP(b.A[:]))
+				}
+			case *dnsmessage.AAAAResource:
+				if !net.IP(b.AAAA[:]).Equal(net.IPv6unspecified) {
+					t.Errorf("AAAA = %v, want ::", net.IP(b.AAAA[:]))
+				}
+			}
+		}
+	}
+}
+
+func Test_rcode(t *testing.T) {
+	buf := make([]byte, 512)
+	n, _, err := replyNXDomain(newZoneQuery(t, "nx.example.com.", query.TypeA), buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rcode(buf, n); got != "NXDOMAIN" {
+		t.Errorf("rcode() = %v, want NXDOMAIN", got)
+	}
+	if got := rcode(buf, -1); got != "" {
+		t.Errorf("rcode(-1) = %v, want empty", got)
+	}
+}
@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/nextdns/nextdns/internal/dnsmessage"
+	"github.com/nextdns/nextdns/resolver"
+	"github.com/nextdns/nextdns/resolver/query"
+)
+
+// maxZoneCNAMEChain is the maximum number of local CNAME records followed to
+// answer a query.
+const maxZoneCNAMEChain = 8
+
+var errNotInZone = errors.New("not in zone")
+
+// Zone is a set of local records answered authoritatively by the proxy
+// without contacting the upstream. A PTR record is generated for the address
+// of each A and AAAA record, unless a PTR record is defined for it.
+//
+// Names without records are forwarded to the upstream, unless they belong to
+// a domain added with AddDomain.
+//
+// A Zone must not be modified once used by a Proxy.
+type Zone struct {
+	records map[zoneKey][]string
+	autoPTR map[string][]string
+	names   map[string]bool
+	parents map[string]bool // ancestors of names, existing without records
+	domains map[string]bool
+}
+
+type zoneKey struct {
+	name  string
+	qtype query.Type
+}
+
+// Add adds a record of type qtype for name. value is an IP address for A and
+// AAAA records, a host name for CNAME and PTR records, and free text for TXT
+// records.
+func (z *Zone) Add(name string, qtype query.Type, value string) error {
+	name = zoneName(name)
+	if _, err := dnsmessage.NewName(name); err != nil {
+		return fmt.Errorf("%s: invalid name: %v", name, err)
+	}
+	switch qtype {
+	case query.TypeA, query.TypeAAAA:
+		ip := net.ParseIP(value)
+		if ip == nil || (ip.To4() != nil) != (qtype == query.TypeA) {
+			return fmt.Errorf("%s: invalid %v address: %q", name, qtype, value)
+		}
+		value = ip.String()
+	case query.TypeCNAME, query.TypePTR:
+		value = zoneName(value)
+		if _, err := dnsmessage.NewName(value); err != nil {
+			return fmt.Errorf("%s: invalid %v target: %v", name, qtype, err)
+		}
+	case query.TypeTXT:
+		if len(value) > 255 {
+			return fmt.Errorf("%s: TXT value longer than 255 bytes", name)
+		}
+	default:
+		return fmt.Errorf("%s: unsupported record type: %v", name, qtype)
+	}
+	z.init()
+	key := zoneKey{name, qtype}
+	z.records[key] = append(z.records[key], value)
+	z.addName(name)
+	if qtype == query.TypeA || qtype == query.TypeAAAA {
+		arpa := reverseName(net.ParseIP(value))
+		z.autoPTR[arpa] = append(z.autoPTR[arpa], name)
+		z.addName(arpa)
+	}
+	return nil
+}
+
+// AddDomain makes the zone authoritative for domain and its subdomains. Names
+// of domain without records are answered with NXDOMAIN, and names without
+// records of the queried type with no answer, instead of being forwarded to
+// the upstream.
+func (z *Zone) AddDomain(domain string) error {
+	domain = zoneName(domain)
+	if _, err := dnsmessage.NewName(domain); err != nil || domain == "." {
+		return fmt.Errorf("%s: invalid domain", domain)
+	}
+	z.init()
+	z.domains[domain] = true
+	return nil
+}
+
+func (z *Zone) init() {
+	if z.records == nil {
+		z.records = map[zoneKey][]string{}
+		z.autoPTR = map[string][]string{}
+		z.names = map[string]bool{}
+		z.parents = map[string]bool{}
+		z.domains = map[string]bool{}
+	}
+}
+
+func (z *Zone) addName(name string) {
+	z.names[name] = true
+	for {
+		idx := strings.IndexByte(name, '.')
+		if idx == -1 || idx == len(name)-1 {
+			return
+		}
+		name = name[idx+1:]
+		z.parents[name] = true
+	}
+}
+
+// owns returns true if name belongs to a domain of the zone.
+func (z *Zone) owns(name string) bool {
+	for len(name) > 1 {
+		if z.domains[name] {
+			return true
+		}
+		idx := strings.IndexByte(name, '.')
+		name = name[idx+1:]
+	}
+	return false
+}
+
+// lookup returns the records of type qtype for name.
+func (z *Zone) lookup(name string, qtype query.Type) []string {
+	rrs := z.records[zoneKey{name, qtype}]
+	if len(rrs) == 0 && qtype == query.TypePTR {
+		rrs = z.autoPTR[name]
+	}
+	return rrs
+}
+
+// resolve answers q from the zone. errNotInZone is returned if the zone has
+// no record for the queried name and does not own it.
+func (z *Zone) resolve(q query.Query, buf []byte) (n int, i resolver.ResolveInfo, err error) {
+	if z == nil {
+		return 0, i, errNotInZone
+	}
+	name := zoneName(q.Name)
+	exists := z.names[name]
+	if !exists {
+		if !z.owns(name) {
+			return 0, i, errNotInZone
+		}
+		exists = z.parents[name] || z.domains[name]
+	}
+	var p dnsmessage.Parser
+	h, err := p.Start(q.Payload)
+	if err != nil {
+		return 0, i, err
+	}
+	q1, err := p.Question()
+	if err != nil {
+		return 0, i, err
+	}
+	h.Response = true
+	h.Authoritative = true
+	h.RecursionAvailable = true
+	h.RCode = dnsmessage.RCodeSuccess
+	if !exists {
+		h.RCode = dnsmessage.RCodeNameError
+	}
+	b := dnsmessage.NewBuilder(buf[:0], h)
+	b.EnableCompression()
+	_ = b.StartQuestions()
+	_ = b.Question(q1)
+	_ = b.StartAnswers()
+	owner := q1.Name
+	for hops := 0; ; hops++ {
+		rrs := z.lookup(name, q.Type)
+		rtype := q.Type
+		if len(rrs) == 0 && q.Type != query.TypeCNAME && hops < maxZoneCNAMEChain {
+			if rrs = z.lookup(name, query.TypeCNAME); len(rrs) > 0 {
+				rtype = query.TypeCNAME
+			}
+		}
+		hdr := dnsmessage.ResourceHeader{
+			Name:  owner,
+			Type:  dnsmessage.Type(rtype),
+			Class: q1.Class,
+		}
+		for _, rr := range rrs {
+			if err = addZoneRecord(&b, hdr, rr); err != nil {
+				return 0, i, err
+			}
+		}
+		if rtype != query.TypeCNAME || q.Type == query.TypeCNAME {
+			break
+		}
+		// Follow the CNAME if its target is in the zone.
+		name = rrs[0]
+		if !z.names[name] {
+			break
+		}
+		if owner, err = dnsmessage.NewName(name); err != nil {
+			return 0, i, err
+		}
+	}
+	buf, err = b.Finish()
+	return len(buf), i, err
+}
+
+// addZoneRecord adds the record of value rr with the header hdr to b.
+func addZoneRecord(b *dnsmessage.Builder, hdr dnsmessage.ResourceHeader, rr string) error {
+	switch query.Type(hdr.Type) {
+	case query.TypeA:
+		var a [4]byte
+		copy(a[:], net.ParseIP(rr).To4())
+		return b.AResource(hdr, dnsmessage.AResource{A: a})
+	case query.TypeAAAA:
+		var aaaa [16]byte
+		copy(aaaa[:], net.ParseIP(rr))
+		return b.AAAAResource(hdr, dnsmessage.AAAAResource{AAAA: aaaa})
+	case query.TypeCNAME:
+		target, err := dnsmessage.NewName(rr)
+		if err != nil {
+			return err
+		}
+		return b.CNAMEResource(hdr, dnsmessage.CNAMEResource{CNAME: target})
+	case query.TypePTR:
+		ptr, err := dnsmessage.NewName(rr)
+		if err != nil {
+			return err
+		}
+		return b.PTRResource(hdr, dnsmessage.PTRResource{PTR: ptr})
+	case query.TypeTXT:
+		return b.TXTResource(hdr, dnsmessage.TXTResource{TXT: []string{rr}})
+	}
+	return nil
+}
+
+// zoneName returns name lowercased and fully qualified.
+func zoneName(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+// reverseName returns the in-addr.arpa. or ip6.arpa. name of ip.
+func reverseName(ip net.IP) string {
+	const hexDigit = "0123456789abcdef"
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	buf := make([]byte, 0, len(ip)*4+len("ip6.arpa."))
+	for i := len(ip) - 1; i >= 0; i-- {
+		buf = append(buf, hexDigit[ip[i]&0xf], '.', hexDigit[ip[i]>>4], '.')
+	}
+	return string(append(buf, "ip6.arpa."...))
+}
@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nextdns/nextdns/internal/dnsmessage"
+	"github.com/nextdns/nextdns/resolver/query"
+)
+
+func newZoneQuery(t *testing.T, name string, qtype query.Type) query.Query {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 42, RecursionDesired: true})
+	_ = b.StartQuestions()
+	if err := b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  dnsmessage.Type(qtype),
+		Class: dnsmessage.ClassINET,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return query.Query{ID: 42, Class: query.ClassINET, Type: qtype, Name: name, Payload: payload}
+}
+
+// zoneAnswers returns the answers of msg as TYPE:VALUE strings.
+func zoneAnswers(t *testing.T, msg []byte) []string {
+	t.Helper()
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.Authoritative || h.ID != 42 {
+		t.Errorf("header = %+v, want authoritative with ID 42", h)
+	}
+	_ = p.SkipAllQuestions()
+	answers, err := p.AllAnswers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rrs := []string{}
+	for _, a := range answers {
+		var s string
+		switch b := a.Body.(type) {
+		case *dnsmessage.AResource:
+			s = "A:" + net.IP(b.A[:]).String()
+		case *dnsmessage.AAAAResource:
+			s = "AAAA:" + net.IP(b.AAAA[:]).String()
+		case *dnsmessage.CNAMEResource:
+			s = "CNAME:" + b.CNAME.String()
+		case *dnsmessage.PTRResource:
+			s = "PTR:" + b.PTR.String()
+		case *dnsmessage.TXTResource:
+			s = "TXT:" + b.TXT[0]
+		}
+		rrs = append(rrs, a.Header.Name.String()+"="+s)
+	}
+	return rrs
+}
+
+func TestZone_resolve(t *testing.T) {
+	z := &Zone{}
+	for _, r := range []struct {
+		name  string
+		qtype query.Type
+		value string
+	}{
+		{"nas.home", query.TypeA, "192.168.1.5"},
+		{"nas.home", query.TypeTXT, "hello"},
+		{"www.home", query.TypeCNAME, "NAS.home"},
+		{"cdn.home", query.TypeCNAME, "cdn.example.com"},
+		{"printer.home", query.TypeA, "192.168.1.6"},
+		{"6.1.168.192.in-addr.arpa", query.TypePTR, "lp.home"},
+	} {
+		if err := z.Add(r.name, r.qtype, r.value); err != nil {
+			t.Fatalf("Add(%s) err = %v", r.name, err)
+		}
+	}
+	tests := []struct {
+		name  string
+		qtype query.Type
+		want  []string
+	}{
+		{"nas.home.", query.TypeA, []string{"nas.home.=A:192.168.1.5"}},
+		{"NAS.Home.", query.TypeA, []string{"NAS.Home.=A:192.168.1.5"}},
+		{"nas.home.", query.TypeAAAA, []string{}},
+		{"nas.home.", query.TypeTXT, []string{"nas.home.=TXT:hello"}},
+		{"www.home.", query.TypeA, []string{"www.home.=CNAME:nas.home.", "nas.home.=A:192.168.1.5"}},
+		{"www.home.", query.TypeCNAME, []string{"www.home.=CNAME:nas.home."}},
+		{"cdn.home.", query.TypeA, []string{"cdn.home.=CNAME:cdn.example.com."}},
+		{"5.1.168.192.in-addr.arpa.", query.TypePTR, []string{"5.1.168.192.in-addr.arpa.=PTR:nas.home."}},
+		{"6.1.168.192.in-addr.arpa.", query.TypePTR, []string{"6.1.168.192.in-addr.arpa.=PTR:lp.home."}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+tt.qtype.String(), func(t *testing.T) {
+			buf := make([]byte, 512)
+			n, _, err := z.resolve(newZoneQuery(t, tt.name, tt.qtype), buf)
+			if err != nil {
+				t.Fatalf("resolve() err = %v", err)
+			}
+			if got := zoneAnswers(t, buf[:n]); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolve() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if _, _, err := z.resolve(newZoneQuery(t, "other.home.", query.TypeA), make([]byte, 512)); err != errNotInZone {
+		t.Errorf("resolve(other.home.) err = %v, want %v", err, errNotInZone)
+	}
+}
+
+func TestZone_resolveDomain(t *testing.T) {
+	z := &Zone{}
+	if err := z.Add("nas.lan.home", query.TypeA, "192.168.1.5"); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.AddDomain("home"); err != nil {
+		t.Fatal(err)
+	}
+	up := &echoResolver{}
+	p := Proxy{LocalZone: z, Upstream: up}
+	tests := []struct {
+		name  string
+		qtype query.Type
+		rcode dnsmessage.RCode
+		want  []string
+	}{
+		{"nas.lan.home.", query.TypeA, dnsmessage.RCodeSuccess, []string{"nas.lan.home.=A:192.168.1.5"}},
+		{"nas.lan.home.", query.TypeAAAA, dnsmessage.RCodeSuccess, []string{}},
+		{"other.home.", query.TypeA, dnsmessage.RCodeNameError, []string{}},
+		{"sub.nas.lan.home.", query.TypeA, dnsmessage.RCodeNameError, []string{}},
+		{"lan.home.", query.TypeA, dnsmessage.RCodeSuccess, []string{}},
+		{"home.", query.TypeA, dnsmessage.RCodeSuccess, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+tt.qtype.String(), func(t *testing.T) {
+			buf := make([]byte, 512)
+			n, _, err := p.Resolve(context.Background(), newZoneQuery(t, tt.name, tt.qtype), buf)
+			if err != nil {
+				t.Fatalf("Resolve() err = %v", err)
+			}
+			var parser dnsmessage.Parser
+			if h, err := parser.Start(buf[:n]); err != nil || h.RCode != tt.rcode {
+				t.Errorf("Resolve() rcode = %v (err %v), want %v", h.RCode, err, tt.rcode)
+			}
+			if got := zoneAnswers(t, buf[:n]); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Resolve() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if calls := atomic.LoadInt32(&up.calls); calls != 0 {
+		t.Errorf("upstream calls = %d, want 0", calls)
+	}
+	// Names out of the domains are still forwarded.
+	if _, _, err := z.resolve(newZoneQuery(t, "nas.lan.", query.TypeA), make([]byte, 512)); err != errNotInZone {
+		t.Errorf("resolve(nas.lan.) err = %v, want %v", err, errNotInZone)
+	}
+}
+
+func TestZone_Add(t *testing.T) {
+	z := &Zone{}
+	for _, r := range []struct {
+		qtype query.Type
+		value string
+	}{
+		{query.TypeA, "::1"},
+		{query.TypeAAAA, "1.2.3.4"},
+		{query.TypeA, "nas"},
+		{query.TypeMX, "mx.home"},
+	} {
+		if err := z.Add("test.home", r.qtype, r.value); err == nil {
+			t.Errorf("Add(%v, %q) err = nil", r.qtype, r.value)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nextdns/nextdns/config"
+	"github.com/nextdns/nextdns/host"
+	"github.com/nextdns/nextdns/proxy"
+	"github.com/nextdns/nextdns/querylog"
+)
+
+// setupQueryLog logs all the queries of p to the query log file and remote
+// sink defined by c.
+func setupQueryLog(p *proxySvc, c *config.Config) error {
+	var loggers []querylog.Logger
+	if c.QueryLogFile != "" {
+		l, err := newQueryLogFile(c, func(err error) {
+			p.log.Errorf("Query log: %v", err)
+		})
+		if err != nil {
+			return err
+		}
+		loggers = append(loggers, l)
+	}
+	if c.QueryLogRemote != "" {
+		l, err := newQueryLogRemote(c.QueryLogRemote)
+		if err != nil {
+			return err
+		}
+		loggers = append(loggers, l)
+	}
+	if len(loggers) == 0 {
+		return nil
+	}
+
+	var mu sync.Mutex
+	failing := make([]bool, len(loggers))
+	queryLog := p.QueryLog
+	p.QueryLog = func(q proxy.QueryInfo) {
+		if queryLog != nil {
+			queryLog(q)
+		}
+		e := querylog.Entry{
+			Time:      time.Now().Add(-q.Duration), // time the query was received
+			Client:    q.PeerIP.String(),
+			Protocol:  q.Protocol,
+			Name:      q.Name,
+			Type:      q.Type,
+			RCode:     q.RCode,
+			Duration:  q.Duration,
+			Endpoint:  q.UpstreamEndpoint,
+			Transport: q.UpstreamTransport,
+			Cached:    q.FromCache,
+			Blocked:   q.Blocked,
+		}
+		if q.Error != nil {
+			e.Error = q.Error.Error()
+		}
+		for i, l := range loggers {
+			err := l.Log(e)
+			// Only log the first error of a series to not flood the log.
+			mu.Lock()
+			report := err != nil && !failing[i]
+			failing[i] = err != nil
+			mu.Unlock()
+			if report {
+				p.log.Errorf("Query log: %v", err)
+			}
+		}
+	}
+	p.OnStopped = append(p.OnStopped, func() {
+		for _, l := range loggers {
+			if c, ok := l.(io.Closer); ok {
+				_ = c.Close()
+			}
+			if d, ok := l.(interface{ Dropped() uint64 }); ok && d.Dropped() > 0 {
+				p.log.Warningf("Query log: %d entries dropped", d.Dropped())
+			}
+		}
+	})
+	return nil
+}
+
+// newQueryLogFile returns a logger writing JSON lines to the query log file
+// defined by c. Errors occurring in the background are reported to errorLog.
+func newQueryLogFile(c *config.Config, errorLog func(error)) (*querylog.JSONLogger, error) {
+	maxSize, err := config.ParseBytes(c.QueryLogMaxSize)
+	if err != nil {
+		return nil, fmt.Errorf("%s: cannot parse query log max size: %v", c.QueryLogMaxSize, err)
+	}
+	maxBackups, err := strconv.Atoi(c.QueryLogMaxBackups)
+	if err != nil {
+		return nil, fmt.Errorf("%s: cannot parse query log max backups: %v", c.QueryLogMaxBackups, err)
+	}
+	return &querylog.JSONLogger{W: &querylog.RotatingFile{
+		Filename:   c.QueryLogFile,
+		MaxSize:    int64(maxSize),
+		MaxAge:     c.QueryLogRotate,
+		MaxBackups: maxBackups,
+		Compress:   c.QueryLogCompress,
+		ErrorLog:   errorLog,
+	}}, nil
+}
+
+// newQueryLogRemote returns a logger sending entries to the remote sink
+// defined by rawURL:
+//
+//   - syslog+udp://HOST:PORT, syslog+tcp://HOST:PORT or syslog+tls://HOST:PORT
+//   - fluentd://HOST:PORT[/TAG]
+func newQueryLogRemote(rawURL string) (querylog.Logger, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%s: cannot parse query log remote: %v", rawURL, err)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("%s: missing query log remote port", rawURL)
+	}
+	switch u.Scheme {
+	case "syslog+udp", "syslog+tcp", "syslog+tls":
+		hostname, _ := host.Name()
+		network := strings.TrimPrefix(u.Scheme, "syslog+")
+		return querylog.NewSyslogLogger(network, u.Host, nil, hostname, "nextdns")
+	case "fluentd":
+		return querylog.NewFluentdLogger(u.Host, strings.Trim(u.Path, "/")), nil
+	}
+	return nil, fmt.Errorf("%s: unsupported query log remote", rawURL)
+}
@@ -0,0 +1,116 @@
+package querylog
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// DefaultFluentdTag is the default tag of the entries sent to Fluentd.
+const DefaultFluentdTag = "nextdns.query"
+
+// FluentdLogger sends entries to a Fluentd server, or any server supporting
+// its forward protocol like fluent-bit, using the message mode.
+type FluentdLogger struct {
+	rc  remoteConn
+	tag string
+}
+
+// NewFluentdLogger returns a FluentdLogger sending to the forward input at the
+// TCP address addr with tag. If tag is empty, DefaultFluentdTag is used.
+func NewFluentdLogger(addr, tag string) *FluentdLogger {
+	if tag == "" {
+		tag = DefaultFluentdTag
+	}
+	return &FluentdLogger{
+		rc:  remoteConn{network: "tcp", addr: addr},
+		tag: tag,
+	}
+}
+
+// Log implements the Logger interface.
+func (l *FluentdLogger) Log(e Entry) error {
+	return l.rc.send(l.encode(e))
+}
+
+// encode returns the [tag, time, record] forward protocol message of e
+// encoded with MessagePack.
+func (l *FluentdLogger) encode(e Entry) []byte {
+	b := make([]byte, 0, 256)
+	b = append(b, 0x93) // fixarray of 3 elements
+	b = appendMsgpackString(b, l.tag)
+	b = appendMsgpackUint(b, uint64(e.Time.Unix()))
+	record := []struct {
+		key   string
+		value interface{}
+	}{
+		{"timestamp", e.Time.Format("2006-01-02T15:04:05.000000Z07:00")},
+		{"client", e.Client},
+		{"protocol", e.Protocol},
+		{"qname", e.Name},
+		{"qtype", e.Type},
+		{"rcode", e.RCode},
+		{"duration_ms", float64(e.Duration) / 1e6},
+		{"endpoint", e.Endpoint},
+		{"transport", e.Transport},
+		{"cached", e.Cached},
+		{"blocked", e.Blocked},
+		{"error", e.Error},
+	}
+	b = append(b, 0x80|byte(len(record))) // fixmap
+	for _, f := range record {
+		b = appendMsgpackString(b, f.key)
+		switch v := f.value.(type) {
+		case string:
+			b = appendMsgpackString(b, v)
+		case float64:
+			b = append(b, 0xcb)
+			b = appendUint64(b, math.Float64bits(v))
+		case bool:
+			if v {
+				b = append(b, 0xc3)
+			} else {
+				b = append(b, 0xc2)
+			}
+		}
+	}
+	return b
+}
+
+// Dropped returns the number of entries dropped because the Fluentd server
+// could not keep up.
+func (l *FluentdLogger) Dropped() uint64 {
+	return l.rc.droppedEntries()
+}
+
+// Close writes the queued entries and closes the connection to the Fluentd
+// server.
+func (l *FluentdLogger) Close() error {
+	return l.rc.close()
+}
+
+func appendMsgpackString(b []byte, s string) []byte {
+	switch l := len(s); {
+	case l < 32:
+		b = append(b, 0xa0|byte(l))
+	case l < 1<<8:
+		b = append(b, 0xd9, byte(l))
+	case l < 1<<16:
+		b = append(b, 0xda, byte(l>>8), byte(l))
+	default:
+		b = append(b, 0xdb, byte(l>>24), byte(l>>16), byte(l>>8), byte(l))
+	}
+	return append(b, s...)
+}
+
+func appendMsgpackUint(b []byte, v uint64) []byte {
+	if v < 128 {
+		return append(b, byte(v)) // positive fixint
+	}
+	return appendUint64(append(b, 0xcf), v)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
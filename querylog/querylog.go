@@ -0,0 +1,60 @@
+// Package querylog implements structured DNS query logs.
+package querylog
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Entry is a logged DNS query.
+type Entry struct {
+	Time      time.Time     `json:"timestamp"`
+	Client    string        `json:"client"`
+	Protocol  string        `json:"protocol"`
+	Name      string        `json:"qname"`
+	Type      string        `json:"qtype"`
+	RCode     string        `json:"rcode,omitempty"`
+	Duration  time.Duration `json:"-"`
+	Endpoint  string        `json:"endpoint,omitempty"`
+	Transport string        `json:"transport,omitempty"`
+	Cached    bool          `json:"cached"`
+	Blocked   bool          `json:"blocked"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// MarshalJSON implements the json.Marshaler interface, the duration being
+// expressed in milliseconds.
+func (e Entry) MarshalJSON() ([]byte, error) {
+	type entry Entry
+	return json.Marshal(struct {
+		entry
+		Duration float64 `json:"duration_ms"`
+	}{entry(e), float64(e.Duration) / float64(time.Millisecond)})
+}
+
+// Logger logs query entries. Implementations must be safe for concurrent use.
+type Logger interface {
+	Log(e Entry) error
+}
+
+// JSONLogger writes entries to W as JSON lines.
+type JSONLogger struct {
+	W io.Writer
+
+	mu sync.Mutex
+}
+
+// Log implements the Logger interface.
+func (l *JSONLogger) Log(e Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.W.Write(b)
+	return err
+}
@@ -0,0 +1,32 @@
+package querylog
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := &JSONLogger{W: &buf}
+	err := l.Log(Entry{
+		Time:      time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Client:    "192.168.1.10",
+		Protocol:  "UDP",
+		Name:      "example.com.",
+		Type:      "A",
+		RCode:     "NOERROR",
+		Duration:  1500 * time.Microsecond,
+		Endpoint:  "https://dns.nextdns.io#45.90.28.0",
+		Transport: "HTTP/2.0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"timestamp":"2020-01-02T03:04:05Z","client":"192.168.1.10","protocol":"UDP",` +
+		`"qname":"example.com.","qtype":"A","rcode":"NOERROR","endpoint":"https://dns.nextdns.io#45.90.28.0",` +
+		`"transport":"HTTP/2.0","cached":false,"blocked":false,"duration_ms":1.5}` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("Log() wrote\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,157 @@
+package querylog
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// remoteWriteTimeout is the timeout of each write to a remote sink.
+	remoteWriteTimeout = time.Second
+
+	// remoteRedialDelay is the delay during which entries are dropped after
+	// a remote sink failed, before reconnecting.
+	remoteRedialDelay = 5 * time.Second
+
+	// remoteQueueSize is the number of entries waiting to be written to a
+	// remote sink, above which new entries are dropped.
+	remoteQueueSize = 1024
+)
+
+var (
+	errRemoteDown      = errors.New("remote log sink unavailable")
+	errRemoteQueueFull = errors.New("remote log queue full, entry dropped")
+)
+
+// remoteConn is a connection to a remote log sink, established on first use
+// and re-established after an error. Entries are queued and written by a
+// single goroutine so a slow sink never blocks the queries.
+type remoteConn struct {
+	dropped uint64 // first for 64-bit alignment of atomic operations
+
+	network   string // udp, tcp or tls
+	addr      string
+	tlsConfig *tls.Config
+
+	startOnce sync.Once
+	closeOnce sync.Once
+	queue     chan []byte
+	stop      chan struct{}
+	done      chan struct{}
+
+	mu       sync.Mutex
+	c        net.Conn
+	failedAt time.Time
+
+	errMu sync.Mutex
+	err   error // error of the last write
+}
+
+// send queues b to be written to the connection. It returns the error of
+// the last write, if any, or errRemoteQueueFull if b was dropped.
+func (r *remoteConn) send(b []byte) error {
+	r.startOnce.Do(r.start)
+	select {
+	case r.queue <- b:
+	default:
+		atomic.AddUint64(&r.dropped, 1)
+		return errRemoteQueueFull
+	}
+	r.errMu.Lock()
+	defer r.errMu.Unlock()
+	return r.err
+}
+
+// droppedEntries returns the number of entries dropped because the queue
+// was full.
+func (r *remoteConn) droppedEntries() uint64 {
+	return atomic.LoadUint64(&r.dropped)
+}
+
+func (r *remoteConn) start() {
+	r.queue = make(chan []byte, remoteQueueSize)
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	go r.run()
+}
+
+// run writes the queued entries until stop is closed, then writes the ones
+// still in the queue.
+func (r *remoteConn) run() {
+	defer close(r.done)
+	for {
+		select {
+		case b := <-r.queue:
+			r.writeEntry(b)
+		case <-r.stop:
+			for {
+				select {
+				case b := <-r.queue:
+					r.writeEntry(b)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (r *remoteConn) writeEntry(b []byte) {
+	err := r.write(b)
+	r.errMu.Lock()
+	r.err = err
+	r.errMu.Unlock()
+}
+
+// write writes b to the connection, dialing it if needed.
+func (r *remoteConn) write(b []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.c == nil {
+		if time.Since(r.failedAt) < remoteRedialDelay {
+			return errRemoteDown
+		}
+		if err := r.dial(); err != nil {
+			r.failedAt = time.Now()
+			return err
+		}
+	}
+	_ = r.c.SetWriteDeadline(time.Now().Add(remoteWriteTimeout))
+	if _, err := r.c.Write(b); err != nil {
+		r.c.Close()
+		r.c = nil
+		r.failedAt = time.Now()
+		return err
+	}
+	return nil
+}
+
+func (r *remoteConn) dial() (err error) {
+	d := &net.Dialer{Timeout: remoteWriteTimeout}
+	if r.network == "tls" {
+		r.c, err = tls.DialWithDialer(d, "tcp", r.addr, r.tlsConfig)
+		return err
+	}
+	r.c, err = d.Dial(r.network, r.addr)
+	return err
+}
+
+// close stops the writer, once the queued entries are written, and closes
+// the connection.
+func (r *remoteConn) close() error {
+	r.startOnce.Do(r.start)
+	r.closeOnce.Do(func() { close(r.stop) })
+	<-r.done
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.c == nil {
+		return nil
+	}
+	err := r.c.Close()
+	r.c = nil
+	return err
+}
@@ -0,0 +1,150 @@
+package querylog
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testEntry = Entry{
+	Time:     time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	Client:   "192.168.1.10",
+	Protocol: "UDP",
+	Name:     "example.com.",
+	Type:     "A",
+	RCode:    "NOERROR",
+}
+
+func TestSyslogLogger_UDP(t *testing.T) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	l, err := NewSyslogLogger("udp", c.LocalAddr().String(), nil, "router", "nextdns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := l.Log(testEntry); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := c.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := "<30>1 2020-01-02T03:04:05.000000Z router nextdns " + l.procID + " query - {"
+	if got := string(buf[:n]); !strings.HasPrefix(got, prefix) || !strings.Contains(got, `"qname":"example.com."`) {
+		t.Errorf("message = %q, want prefix %q", got, prefix)
+	}
+}
+
+func TestSyslogLogger_TCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	msgs := make(chan string, 2)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		r := bufio.NewReader(c)
+		for {
+			length, err := r.ReadString(' ')
+			if err != nil {
+				return
+			}
+			n, _ := strconv.Atoi(strings.TrimSpace(length))
+			msg := make([]byte, n)
+			if _, err := io.ReadFull(r, msg); err != nil {
+				return
+			}
+			msgs <- string(msg)
+		}
+	}()
+	l, err := NewSyslogLogger("tcp", ln.Addr().String(), nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for i := 0; i < 2; i++ {
+		if err := l.Log(testEntry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-msgs:
+			if !strings.HasPrefix(msg, "<30>1 2020-01-02T03:04:05.000000Z - - ") || !strings.HasSuffix(msg, "}") {
+				t.Errorf("message = %q", msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+}
+
+func TestRemoteConn_QueueFull(t *testing.T) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	r := &remoteConn{network: "udp", addr: c.LocalAddr().String()}
+	// Block the writer on the connection lock so the queue fills up.
+	r.mu.Lock()
+	sent := 0
+	for ; sent <= remoteQueueSize+1; sent++ {
+		if err := r.send([]byte("entry")); err == errRemoteQueueFull {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sent < remoteQueueSize || sent > remoteQueueSize+1 {
+		t.Errorf("queued %d entries, want %d", sent, remoteQueueSize)
+	}
+	if err := r.send([]byte("entry")); err != errRemoteQueueFull {
+		t.Errorf("send() = %v, want %v", err, errRemoteQueueFull)
+	}
+	if got := r.droppedEntries(); got != 2 {
+		t.Errorf("dropped = %d, want 2", got)
+	}
+	r.mu.Unlock()
+	if err := r.close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.queue) != 0 {
+		t.Errorf("%d entries left in the queue after close", len(r.queue))
+	}
+}
+
+func TestFluentdLogger_encode(t *testing.T) {
+	b := NewFluentdLogger("127.0.0.1:24224", "").encode(testEntry)
+	var want bytes.Buffer
+	want.WriteByte(0x93)
+	want.Write(appendMsgpackString(nil, DefaultFluentdTag))
+	want.Write(appendMsgpackUint(nil, uint64(testEntry.Time.Unix())))
+	want.WriteByte(0x8c)
+	want.Write(appendMsgpackString(nil, "timestamp"))
+	if !bytes.HasPrefix(b, want.Bytes()) {
+		t.Errorf("encode() = %x, want prefix %x", b, want.Bytes())
+	}
+	if !bytes.Contains(b, append(appendMsgpackString(nil, "qname"), appendMsgpackString(nil, "example.com.")...)) {
+		t.Errorf("encode() = %x, missing qname", b)
+	}
+	if !bytes.HasSuffix(b, append(appendMsgpackString(nil, "error"), appendMsgpackString(nil, "")...)) {
+		t.Errorf("encode() = %x, want error last", b)
+	}
+}
@@ -0,0 +1,232 @@
+package querylog
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is the format of the time added to the name of rotated
+// files. It sorts lexically.
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// RotatingFile is an io.WriteCloser writing to Filename, rotated when it
+// reaches MaxSize or was opened more than MaxAge ago. Rotated files are
+// renamed with their rotation time, like queries-2006-01-02T15-04-05.000.log.
+type RotatingFile struct {
+	// Filename is the path of the file. Its directory must exist.
+	Filename string
+
+	// MaxSize is the size in bytes at which the file is rotated. If 0, the
+	// file is not rotated on size.
+	MaxSize int64
+
+	// MaxAge is the duration after which the file is rotated. If 0, the file
+	// is not rotated on time.
+	MaxAge time.Duration
+
+	// MaxBackups is the number of rotated files to keep, the oldest being
+	// removed. If 0, all rotated files are kept.
+	MaxBackups int
+
+	// Compress specifies that rotated files are compressed with gzip. The
+	// compression runs in the background so writes are not blocked.
+	Compress bool
+
+	// ErrorLog specifies an optional log function for errors occurring while
+	// compressing or removing rotated files in the background.
+	ErrorLog func(error)
+
+	mu       sync.Mutex
+	f        *os.File
+	size     int64
+	opened   time.Time
+	now      func() time.Time
+	compress func(name string) error // compressFile if nil
+
+	bgMu sync.Mutex // serializes background compressions
+	bg   sync.WaitGroup
+}
+
+// Write implements the io.Writer interface, rotating the file before p is
+// written if needed.
+func (r *RotatingFile) Write(p []byte) (n int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		if err = r.open(); err != nil {
+			return 0, err
+		}
+	}
+	if r.size > 0 && ((r.MaxSize > 0 && r.size+int64(len(p)) > r.MaxSize) ||
+		(r.MaxAge > 0 && r.timeNow().Sub(r.opened) >= r.MaxAge)) {
+		if err = r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err = r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Rotate rotates the file.
+func (r *RotatingFile) Rotate() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rotate()
+}
+
+// Close implements the io.Closer interface. It waits for the background
+// compressions to complete.
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	var err error
+	if r.f != nil {
+		err = r.f.Close()
+		r.f = nil
+	}
+	r.mu.Unlock()
+	r.bg.Wait()
+	return err
+}
+
+func (r *RotatingFile) timeNow() time.Time {
+	if r.now != nil {
+		return r.now()
+	}
+	return time.Now()
+}
+
+// open opens the file for append, creating it if needed.
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.Filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = st.Size()
+	r.opened = r.timeNow()
+	return nil
+}
+
+// rotate renames the current file with its rotation time and opens a new
+// file. The backup is then compressed in the background if needed, and the
+// extra backups removed.
+func (r *RotatingFile) rotate() error {
+	if r.f != nil {
+		if err := r.f.Close(); err != nil {
+			return err
+		}
+		r.f = nil
+	}
+	prefix, ext := r.backupPrefix()
+	backup := prefix + r.timeNow().Format(backupTimeFormat) + ext
+	err := os.Rename(r.Filename, backup)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil && r.Compress {
+		r.bg.Add(1)
+		go r.compressBackup(backup)
+	} else if err := r.removeBackups(); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+// compressBackup compresses backup and removes the extra backups, reporting
+// errors to ErrorLog.
+func (r *RotatingFile) compressBackup(backup string) {
+	defer r.bg.Done()
+	r.bgMu.Lock()
+	defer r.bgMu.Unlock()
+	compress := r.compress
+	if compress == nil {
+		compress = compressFile
+	}
+	if err := compress(backup); err != nil {
+		r.logErr(err)
+	}
+	if err := r.removeBackups(); err != nil {
+		r.logErr(err)
+	}
+}
+
+func (r *RotatingFile) logErr(err error) {
+	if r.ErrorLog != nil {
+		r.ErrorLog(err)
+	}
+}
+
+// backupPrefix returns the prefix and extension of the backup files.
+func (r *RotatingFile) backupPrefix() (prefix, ext string) {
+	ext = filepath.Ext(r.Filename)
+	return strings.TrimSuffix(r.Filename, ext) + "-", ext
+}
+
+// removeBackups removes the oldest backups in excess of MaxBackups.
+func (r *RotatingFile) removeBackups() error {
+	if r.MaxBackups <= 0 {
+		return nil
+	}
+	prefix, ext := r.backupPrefix()
+	dir, base := filepath.Split(prefix)
+	entries, err := ioutil.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		return err
+	}
+	var backups []string
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, base) &&
+			(strings.HasSuffix(name, ext) || strings.HasSuffix(name, ext+".gz")) {
+			backups = append(backups, filepath.Join(dir, name))
+		}
+	}
+	sort.Strings(backups)
+	for len(backups) > r.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// compressFile replaces name with its gzip compressed version, name.gz.
+func compressFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		src.Close()
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err = io.Copy(zw, src); err == nil {
+		err = zw.Close()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	// Close src before removing it, required on Windows.
+	src.Close()
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	return os.Remove(name)
+}
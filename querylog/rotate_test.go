@@ -0,0 +1,145 @@
+package querylog
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "querylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	r := &RotatingFile{
+		Filename:   filepath.Join(dir, "queries.log"),
+		MaxSize:    10,
+		MaxAge:     time.Hour,
+		MaxBackups: 2,
+		Compress:   true,
+		now:        func() time.Time { return now },
+	}
+	defer r.Close()
+	write := func(s string) {
+		t.Helper()
+		if _, err := r.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(time.Second)
+	}
+	write("12345")
+	write("67890") // fits in MaxSize
+	write("a")     // rotated on size
+	now = now.Add(time.Hour)
+	write("b") // rotated on time
+	write("c")
+	write("0123456789") // rotated, the oldest backup is removed
+	// Wait for the background compressions.
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	names := func() []string {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		sort.Strings(names)
+		return names
+	}
+	want := []string{
+		"queries-2020-01-02T04-04-08.000.log.gz",
+		"queries-2020-01-02T04-04-10.000.log.gz",
+		"queries.log",
+	}
+	got := names()
+	if len(got) != len(want) {
+		t.Fatalf("files = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("files = %v, want %v", got, want)
+		}
+	}
+	f, err := os.Open(filepath.Join(dir, want[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(zr); string(b) != "bc" {
+		t.Errorf("backup content = %q, want %q", b, "bc")
+	}
+	if b, _ := ioutil.ReadFile(r.Filename); string(b) != "0123456789" {
+		t.Errorf("file content = %q, want %q", b, "0123456789")
+	}
+}
+
+func TestRotatingFile_BackgroundCompress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "querylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	compressing := make(chan string, 1)
+	release := make(chan struct{})
+	r := &RotatingFile{
+		Filename: filepath.Join(dir, "queries.log"),
+		MaxSize:  10,
+		Compress: true,
+		compress: func(name string) error {
+			compressing <- name
+			<-release
+			return compressFile(name)
+		},
+	}
+	if _, err := r.Write([]byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	written := make(chan error, 1)
+	go func() {
+		// Rotates the file, then writes while the backup is compressed.
+		_, err := r.Write([]byte("a"))
+		if err == nil {
+			_, err = r.Write([]byte("b"))
+		}
+		written <- err
+	}()
+	var backup string
+	select {
+	case backup = <-compressing:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for compression")
+	}
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write blocked by the compression")
+	}
+	close(release)
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(backup + ".gz"); err != nil {
+		t.Errorf("backup not compressed: %v", err)
+	}
+	if b, _ := ioutil.ReadFile(r.Filename); string(b) != "ab" {
+		t.Errorf("file content = %q, want %q", b, "ab")
+	}
+}
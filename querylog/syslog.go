@@ -0,0 +1,83 @@
+package querylog
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// syslogPriority is the priority of the messages: daemon facility with the
+// informational severity.
+const syslogPriority = 3*8 + 6
+
+// SyslogLogger sends entries as JSON to a remote syslog server using the
+// RFC5424 format. Over TCP and TLS, messages are framed with their length as
+// defined by RFC6587 and RFC5425.
+type SyslogLogger struct {
+	rc       remoteConn
+	hostname string
+	appName  string
+	procID   string
+}
+
+// NewSyslogLogger returns a SyslogLogger sending to addr over network: udp,
+// tcp or tls. tlsConfig is only used with tls and can be nil. hostname and
+// appName identify the sender in the messages.
+func NewSyslogLogger(network, addr string, tlsConfig *tls.Config, hostname, appName string) (*SyslogLogger, error) {
+	switch network {
+	case "udp", "tcp", "tls":
+	default:
+		return nil, fmt.Errorf("%s: unsupported syslog network", network)
+	}
+	if hostname == "" {
+		hostname = "-"
+	}
+	if appName == "" {
+		appName = "-"
+	}
+	return &SyslogLogger{
+		rc:       remoteConn{network: network, addr: addr, tlsConfig: tlsConfig},
+		hostname: hostname,
+		appName:  appName,
+		procID:   strconv.Itoa(os.Getpid()),
+	}, nil
+}
+
+// Log implements the Logger interface.
+func (l *SyslogLogger) Log(e Entry) error {
+	msg, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b := l.format(e, msg)
+	if l.rc.network != "udp" {
+		b = append([]byte(strconv.Itoa(len(b))+" "), b...)
+	}
+	return l.rc.send(b)
+}
+
+// format returns the RFC5424 message for e with msg as content.
+func (l *SyslogLogger) format(e Entry, msg []byte) []byte {
+	b := make([]byte, 0, 128+len(msg))
+	b = append(b, fmt.Sprintf("<%d>1 %s %s %s %s query - ",
+		syslogPriority,
+		e.Time.Format("2006-01-02T15:04:05.000000Z07:00"),
+		l.hostname,
+		l.appName,
+		l.procID)...)
+	return append(b, msg...)
+}
+
+// Dropped returns the number of entries dropped because the syslog server
+// could not keep up.
+func (l *SyslogLogger) Dropped() uint64 {
+	return l.rc.droppedEntries()
+}
+
+// Close writes the queued entries and closes the connection to the syslog
+// server.
+func (l *SyslogLogger) Close() error {
+	return l.rc.close()
+}
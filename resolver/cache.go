@@ -6,11 +6,71 @@ import (
 	"github.com/nextdns/nextdns/resolver/query"
 )
 
+// CacheStats is a snapshot of the cache counters of a DNS resolver.
+type CacheStats struct {
+	// Hits is the number of queries answered from a fresh cache entry.
+	Hits uint64
+
+	// Misses is the number of queries looked up in the cache and sent to the
+	// upstream. PTR queries, which are never cached, are not counted.
+	Misses uint64
+
+	// Stale is the number of queries answered from an expired cache entry
+	// because the upstream failed.
+	Stale uint64
+}
+
 type cacheKey struct {
 	ctx    string
 	qclass query.Class
 	qtype  query.Type
 	qname  string
+	ecs    string // client subnet the response is valid for, if any
+}
+
+// ecsScopeKey is the ecs value of the key storing the ECS scope prefix length
+// last returned for a question.
+const ecsScopeKey = "scope"
+
+// lookupCacheKey returns the key to lookup the response to q in c. If q
+// carries an EDNS Client Subnet option, the key is bound to the client subnet
+// masked to the scope prefix length last returned for this question, so
+// clients in the same scope share the entry.
+func lookupCacheKey(c Cacher, ctx string, q query.Query) cacheKey {
+	key := cacheKey{ctx, q.Class, q.Type, q.Name, ""}
+	ecs, ok := clientSubnet(q.Payload)
+	if !ok {
+		return key
+	}
+	prefix := ecs.source
+	key.ecs = ecsScopeKey
+	if v, found := c.Get(key); found {
+		if scope, ok := v.(uint8); ok && scope < prefix {
+			prefix = scope
+		}
+	}
+	key.ecs = ecs.String(prefix)
+	return key
+}
+
+// storeCacheKey returns the key to store resp, the response to q, in c. If q
+// carries an EDNS Client Subnet option, the key is bound to the client subnet
+// masked to the scope prefix length of the response, and this scope is
+// recorded for the next lookups.
+func storeCacheKey(c Cacher, ctx string, q query.Query, resp []byte) cacheKey {
+	key := cacheKey{ctx, q.Class, q.Type, q.Name, ""}
+	ecs, ok := clientSubnet(q.Payload)
+	if !ok {
+		return key
+	}
+	prefix := ecs.source
+	if recs, ok := clientSubnet(resp); ok && recs.scope < prefix {
+		prefix = recs.scope
+	}
+	key.ecs = ecsScopeKey
+	c.Add(key, prefix)
+	key.ecs = ecs.String(prefix)
+	return key
 }
 
 type cacheValue struct {
@@ -45,6 +105,40 @@ func (v cacheValue) AdjustedResponse(buf []byte, id uint16, maxAge, maxTTL uint3
 	return n, minTTL
 }
 
+// isNegative returns true if msg is a negative response as defined by RFC2308:
+// a name error (NXDOMAIN) or a response without answer (NODATA).
+func isNegative(msg []byte) bool {
+	if len(msg) < 12 {
+		return false
+	}
+	rcode := msg[3] & 0xf
+	return rcode == 3 || (rcode == 0 && unpackUint16(msg[6:]) == 0)
+}
+
+// cacheMaxAge returns the maximum age of the cached response msg: maxAge, or
+// negMaxAge if lower and msg is a negative response. Zero values mean no
+// limit.
+func cacheMaxAge(msg []byte, maxAge, negMaxAge uint32) uint32 {
+	if negMaxAge > 0 && (maxAge == 0 || negMaxAge < maxAge) && isNegative(msg) {
+		return negMaxAge
+	}
+	return maxAge
+}
+
+// usableStale returns true if v, expired, can be returned when the upstream
+// fails: its records expired at most maxStale seconds ago. If maxStale is 0,
+// any expired entry is usable.
+func (v cacheValue) usableStale(maxStale uint32, now time.Time) bool {
+	if maxStale == 0 {
+		return true
+	}
+	msg := make([]byte, len(v.msg))
+	copy(msg, v.msg)
+	ttl := updateTTL(msg, 0, 0, 0)
+	age := uint32(now.Sub(v.time) / time.Second)
+	return age <= ttl+maxStale
+}
+
 func updateTTL(msg []byte, age uint32, maxAge, maxTTL uint32) (minTTL uint32) {
 	if len(msg) < 12 {
 		return 0
@@ -123,6 +217,20 @@ func updateTTL(msg []byte, age uint32, maxAge, maxTTL uint32) (minTTL uint32) {
 			// Invalid RR
 			return 0
 		}
+
+		// RFC2308, section 5: the TTL of a negative response is the minimum
+		// of the authority SOA record TTL and its MINIMUM field.
+		if query.Type(qtype) == query.TypeSOA && i >= answers && i < additionalsIdx && rdlen >= 22 {
+			negTTL := unpackUint32(msg[off-4:])
+			if age > negTTL {
+				negTTL = 0
+			} else {
+				negTTL -= age
+			}
+			if minTTL > negTTL {
+				minTTL = negTTL
+			}
+		}
 	}
 	if ^minTTL == 0 {
 		minTTL = 0
@@ -138,6 +246,11 @@ func unpackUint32(b []byte) uint32 {
 	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
 }
 
+func packUint16(b []byte, n uint16) {
+	b[0] = byte(n >> 8)
+	b[1] = byte(n)
+}
+
 func packUint32(b []byte, n uint32) {
 	b[0] = byte(n >> 24)
 	b[1] = byte(n >> 16)
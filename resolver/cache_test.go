@@ -1,9 +1,14 @@
 package resolver
 
 import (
+	"context"
+	"net/http"
 	"reflect"
 	"testing"
 	"time"
+
+	"github.com/nextdns/nextdns/resolver/endpoint"
+	"github.com/nextdns/nextdns/resolver/query"
 )
 
 func Test_cacheValue_AdjustedResponse(t *testing.T) {
@@ -110,3 +115,179 @@ func Test_cacheValue_AdjustedResponse(t *testing.T) {
 		})
 	}
 }
+
+type mapCache map[interface{}]interface{}
+
+func (c mapCache) Add(key, value interface{}) {
+	c[key] = value
+}
+
+func (c mapCache) Get(key interface{}) (value interface{}, ok bool) {
+	value, ok = c[key]
+	return
+}
+
+// ecsMessage returns testQuery with an ECS option for the IPv4 subnet
+// a.b.c.0/source and the given scope.
+func ecsMessage(a, b, c, source, scope byte) []byte {
+	msg := append([]byte{}, testQuery...)
+	msg[11] = 1 // Additionals
+	return append(msg,
+		0x00,       // Label <root>
+		0x00, 0x29, // Type OPT
+		0x04, 0xd0, // UDP payload size
+		0x00,       // Extended RCODE
+		0x00,       // EDNS Version
+		0x00, 0x00, // Flags
+		0x00, 0x0b, // Data len 11
+		0x00, 0x08, // Option code ECS
+		0x00, 0x07, // Option len 7
+		0x00, 0x01, // Family IPv4
+		source,  // Source prefix length
+		scope,   // Scope prefix length
+		a, b, c, // Address
+	)
+}
+
+func Test_cacheKey_ECS(t *testing.T) {
+	c := mapCache{}
+	q := func(msg []byte) query.Query {
+		return query.Query{Class: query.ClassINET, Type: query.TypeA, Name: "test.com.", Payload: msg}
+	}
+	if got := lookupCacheKey(c, "", q(testQuery)); got.ecs != "" {
+		t.Errorf("lookupCacheKey() without ECS = %q, want empty", got.ecs)
+	}
+
+	qry := q(ecsMessage(10, 1, 2, 24, 0))
+	if got, want := lookupCacheKey(c, "", qry).ecs, "1:0a0102/24"; got != want {
+		t.Errorf("lookupCacheKey() before store = %q, want %q", got, want)
+	}
+	stored := storeCacheKey(c, "", qry, ecsMessage(10, 1, 2, 24, 16))
+	if got, want := stored.ecs, "1:0a01/16"; got != want {
+		t.Errorf("storeCacheKey() = %q, want %q", got, want)
+	}
+	if got := lookupCacheKey(c, "", q(ecsMessage(10, 1, 3, 24, 0))); got != stored {
+		t.Errorf("lookupCacheKey() same scope = %+v, want %+v", got, stored)
+	}
+	if got := lookupCacheKey(c, "", q(ecsMessage(10, 2, 3, 24, 0))); got == stored {
+		t.Errorf("lookupCacheKey() other scope = %+v, want a different key", got)
+	}
+}
+
+func TestDNS_CacheStats(t *testing.T) {
+	expired := append([]byte{}, testResponse...)
+	copy(expired[32:36], []byte{0, 0, 0, 0}) // TTL 0
+	rt := &fakeTransport{
+		responses: []fakeResponse{
+			{status: http.StatusOK, contentType: "application/dns-message", body: testResponse},
+			{status: http.StatusOK, contentType: "application/dns-message", body: expired},
+		},
+	}
+	ok := fakeResponse{status: http.StatusOK, contentType: "application/dns-message", body: testResponse}
+	e := &endpoint.DOHEndpoint{
+		Hostname:         "doh.test",
+		TransportWrapper: func(http.RoundTripper) http.RoundTripper { return rt },
+	}
+	r := &DNS{
+		DOH: DOH{Cache: mapCache{}},
+		Manager: &endpoint.Manager{
+			Providers: []endpoint.Provider{endpoint.StaticProvider{e}},
+			EndpointTester: func(endpoint.Endpoint) endpoint.Tester {
+				return func(ctx context.Context, testDomain string) error { return nil }
+			},
+		},
+	}
+	buf := make([]byte, 512)
+	resolve := func(qtype query.Type, name string) {
+		q := query.Query{Class: query.ClassINET, Type: qtype, Name: name, Payload: testQuery}
+		_, _, _ = r.Resolve(context.Background(), q, buf)
+	}
+	resolve(query.TypeA, "test.com.")    // miss
+	resolve(query.TypeA, "test.com.")    // hit
+	resolve(query.TypeA, "expired.com.") // miss, stored with a TTL of 0
+	resolve(query.TypeA, "expired.com.") // stale: no more upstream responses
+	if got, want := r.CacheStats(), (CacheStats{Hits: 1, Misses: 2, Stale: 1}); got != want {
+		t.Errorf("CacheStats() = %+v, want %+v", got, want)
+	}
+
+	// Queries not looked up in the cache are not counted as misses.
+	rt.responses = append(rt.responses, ok, ok)
+	resolve(query.TypePTR, "1.0.0.127.in-addr.arpa.")
+	r.DOH.Cache = nil
+	resolve(query.TypeA, "other.com.")
+	if got, want := r.CacheStats(), (CacheStats{Hits: 1, Misses: 2, Stale: 1}); got != want {
+		t.Errorf("CacheStats() without cache lookup = %+v, want %+v", got, want)
+	}
+	if len(rt.responses) != 0 {
+		t.Errorf("%d upstream responses left, want 0", len(rt.responses))
+	}
+}
+
+func Test_cacheValue_usableStale(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		age      time.Duration
+		maxStale uint32
+		want     bool
+	}{
+		{"NoLimit", 48 * time.Hour, 0, true},
+		{"WithinWindow", 3600*time.Second + 30*time.Second, 60, true},
+		{"OutsideWindow", 3600*time.Second + 90*time.Second, 60, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := cacheValue{time: now.Add(-tt.age), msg: testResponse}
+			if got := v.usableStale(tt.maxStale, now); got != tt.want {
+				t.Errorf("cacheValue.usableStale() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_negativeResponse(t *testing.T) {
+	nxdomain := []byte{
+		0x00, 0x7b, // ID
+		0x81, 0x83, // Flags, RCODE NXDOMAIN
+		0x00, 0x01, // Questions
+		0x00, 0x00, // Answers
+		0x00, 0x01, // Authorities
+		0x00, 0x00, // Additionals
+		// Questions
+		0x04, 0x74, 0x65, 0x73, 0x74, 0x03, 0x63, 0x6f, 0x6d, 0x00, // Label test.com.
+		0x00, 0x01, // Type A
+		0x00, 0x01, // Class IN
+		// Authorities
+		0xc0, 0x0c, // Label pointer test.com.
+		0x00, 0x06, // Type SOA
+		0x00, 0x01, // Class IN
+		0x00, 0x00, 0x0e, 0x10, // TTL 3600
+		0x00, 0x16, // Data len 22
+		0x00,                   // MNAME <root>
+		0x00,                   // RNAME <root>
+		0x00, 0x00, 0x00, 0x01, // SERIAL
+		0x00, 0x00, 0x0e, 0x10, // REFRESH
+		0x00, 0x00, 0x0e, 0x10, // RETRY
+		0x00, 0x00, 0x0e, 0x10, // EXPIRE
+		0x00, 0x00, 0x01, 0x2c, // MINIMUM 300
+	}
+	if !isNegative(nxdomain) {
+		t.Errorf("isNegative(NXDOMAIN) = false")
+	}
+	if isNegative(testResponse) {
+		t.Errorf("isNegative(NOERROR) = true")
+	}
+	now := time.Now()
+	v := cacheValue{time: now.Add(-10 * time.Second), msg: nxdomain}
+	buf := make([]byte, 512)
+	// The SOA MINIMUM bounds the TTL of the negative response.
+	if _, minTTL := v.AdjustedResponse(buf, 0, 0, 0, now); minTTL != 300-10 {
+		t.Errorf("AdjustedResponse() minTTL = %d, want %d", minTTL, 300-10)
+	}
+	if got := cacheMaxAge(nxdomain, 600, 5); got != 5 {
+		t.Errorf("cacheMaxAge(NXDOMAIN) = %d, want 5", got)
+	}
+	if got := cacheMaxAge(testResponse, 600, 5); got != 600 {
+		t.Errorf("cacheMaxAge(NOERROR) = %d, want 600", got)
+	}
+}
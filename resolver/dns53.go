@@ -2,7 +2,10 @@ package resolver
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"time"
 
@@ -21,11 +24,29 @@ type DNS53 struct {
 	// before being considered stale regardless of the records TTL.
 	CacheMaxAge uint32
 
+	// CacheMaxStale defines the maximum time in second after its expiration a
+	// cached entry can still be returned when the upstream fails. If zero,
+	// expired entries are returned regardless of their age.
+	CacheMaxStale uint32
+
+	// CacheNegativeMaxAge defines the maximum age in second allowed for a
+	// cached negative response (NXDOMAIN or NODATA) before being considered
+	// stale. If zero, CacheMaxAge applies.
+	CacheNegativeMaxAge uint32
+
+	// NoNegativeCache disables the caching of negative responses.
+	NoNegativeCache bool
+
 	// MaxTTL defines the maximum TTL value that will be handed out to clients.
 	// The specified maximum TTL will be given to clients instead of the true
 	// TTL value if it is lower. The true TTL value is however kept in the cache
 	// to evaluate cache entries freshness.
 	MaxTTL uint32
+
+	// UDPPayloadSize defines the UDP payload size advertised in the OPT record
+	// of outgoing queries. Queries without an OPT record are sent as is. If
+	// zero, DefaultUDPPayloadSize is used.
+	UDPPayloadSize uint16
 }
 
 var defaultDialer = &net.Dialer{}
@@ -37,51 +58,100 @@ func (r DNS53) resolve(ctx context.Context, q query.Query, buf []byte, addr stri
 	// RFC1035, section 7.4: The results of an inverse query should not be cached
 	if q.Type != query.TypePTR && r.Cache != nil {
 		now = time.Now()
-		if v, found := r.Cache.Get(cacheKey{"", q.Class, q.Type, q.Name}); found {
+		i.cacheLookup = true
+		if v, found := r.Cache.Get(lookupCacheKey(r.Cache, "", q)); found && !bypassCache(ctx) {
 			if v, ok := v.(*cacheValue); ok {
 				var minTTL uint32
-				n, minTTL = v.AdjustedResponse(buf, q.ID, r.CacheMaxAge, r.MaxTTL, now)
+				n, minTTL = v.AdjustedResponse(buf, q.ID, cacheMaxAge(v.msg, r.CacheMaxAge, r.CacheNegativeMaxAge), r.MaxTTL, now)
 				i.FromCache = true
 				if minTTL > 0 {
+					i.CacheTTL = minTTL
 					return n, i, nil
 				}
+				if !v.usableStale(r.CacheMaxStale, now) {
+					n, i.FromCache = -1, false
+				}
 			}
 		}
 	}
+	payload := q.Payload
+	size := r.UDPPayloadSize
+	if size == 0 {
+		size = DefaultUDPPayloadSize
+	}
+	if p, err := setUDPPayloadSize(payload, size); err == nil {
+		// p is a copy, so payload is not aliased with buf for the TCP retry.
+		payload = p
+	}
 	d := r.Dialer
 	if d == nil {
 		d = defaultDialer
 	}
-	c, err := d.DialContext(ctx, "udp", addr)
+	nn, err := exchange(ctx, d, "udp", addr, payload, buf)
 	if err != nil {
-		return n, i, fmt.Errorf("dial: %v", err)
+		return n, i, err
 	}
-	defer c.Close()
-	if t, ok := ctx.Deadline(); ok {
-		_ = c.SetDeadline(t)
-		defer func() {
-			_ = c.SetDeadline(time.Time{})
-		}()
-	}
-	_, err = c.Write(q.Payload)
-	if err != nil {
-		return n, i, fmt.Errorf("write: %v", err)
-	}
-	n, err = c.Read(buf)
-	if err != nil {
-		return n, i, fmt.Errorf("read: %v", err)
+	n = nn
+	if n >= 3 && buf[2]&0x2 != 0 {
+		// RFC1035, section 4.2.1: retry over TCP when the response is
+		// truncated.
+		i.Truncated = true
+		i.Transport = "TCP"
+		if n, err = exchange(ctx, d, "tcp", addr, payload, buf); err != nil {
+			return -1, i, err
+		}
 	}
 	i.FromCache = false
-	if r.Cache != nil {
+	if r.Cache != nil && !(r.NoNegativeCache && isNegative(buf[:n])) {
 		v := &cacheValue{
 			time: now,
 			msg:  make([]byte, n),
 		}
 		copy(v.msg, buf[:n])
-		r.Cache.Add(cacheKey{"", q.Class, q.Type, q.Name}, v)
+		r.Cache.Add(storeCacheKey(r.Cache, "", q, v.msg), v)
 	}
 	if r.MaxTTL > 0 {
 		updateTTL(buf[:n], 0, 0, r.MaxTTL)
 	}
 	return n, i, nil
 }
+
+// exchange sends payload to addr using network and reads the response into buf.
+// If network is tcp, messages are framed with their length as defined by
+// RFC1035, section 4.2.2.
+func exchange(ctx context.Context, d *net.Dialer, network, addr string, payload, buf []byte) (n int, err error) {
+	c, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return -1, fmt.Errorf("dial: %v", err)
+	}
+	defer c.Close()
+	if t, ok := ctx.Deadline(); ok {
+		_ = c.SetDeadline(t)
+	}
+	if network == "udp" {
+		if _, err = c.Write(payload); err != nil {
+			return -1, fmt.Errorf("write: %v", err)
+		}
+		if n, err = c.Read(buf); err != nil {
+			return -1, fmt.Errorf("read: %v", err)
+		}
+		return n, nil
+	}
+	msg := make([]byte, 2+len(payload))
+	binary.BigEndian.PutUint16(msg, uint16(len(payload)))
+	copy(msg[2:], payload)
+	if _, err = c.Write(msg); err != nil {
+		return -1, fmt.Errorf("write: %v", err)
+	}
+	var length uint16
+	if err = binary.Read(c, binary.BigEndian, &length); err != nil {
+		return -1, fmt.Errorf("read: %v", err)
+	}
+	if int(length) > len(buf) {
+		return -1, errors.New("read: response too large")
+	}
+	if n, err = io.ReadFull(c, buf[:length]); err != nil {
+		return -1, fmt.Errorf("read: %v", err)
+	}
+	return n, nil
+}
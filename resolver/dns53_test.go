@@ -0,0 +1,80 @@
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nextdns/nextdns/resolver/query"
+)
+
+// startTruncatingServer starts a DNS server answering truncated responses over
+// UDP and full responses over TCP on the same address.
+func startTruncatingServer(t *testing.T, resp []byte) (addr string, stop func()) {
+	t.Helper()
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ul, err := net.ListenPacket("udp", tl.Addr().String())
+	if err != nil {
+		tl.Close()
+		t.Skipf("cannot listen UDP on %s: %v", tl.Addr(), err)
+	}
+	truncated := append([]byte{}, resp[:12]...)
+	truncated[2] |= 0x2 // TC
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			_, raddr, err := ul.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = ul.WriteTo(truncated, raddr)
+		}
+	}()
+	go func() {
+		for {
+			c, err := tl.Accept()
+			if err != nil {
+				return
+			}
+			var length uint16
+			if err := binary.Read(c, binary.BigEndian, &length); err == nil {
+				_, _ = io.CopyN(ioutil.Discard, c, int64(length))
+				_ = binary.Write(c, binary.BigEndian, uint16(len(resp)))
+				_, _ = c.Write(resp)
+			}
+			c.Close()
+		}
+	}()
+	return tl.Addr().String(), func() {
+		tl.Close()
+		ul.Close()
+	}
+}
+
+func TestDNS53_resolve_Truncated(t *testing.T) {
+	addr, stop := startTruncatingServer(t, testResponse)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	q := query.Query{Class: query.ClassINET, Type: query.TypeA, Name: "test.com.", Payload: testQuery}
+	buf := make([]byte, 4096)
+	n, i, err := DNS53{}.resolve(ctx, q, buf, addr)
+	if err != nil {
+		t.Fatalf("resolve() err = %v", err)
+	}
+	if !reflect.DeepEqual(buf[:n], testResponse) {
+		t.Errorf("resolve()\ngot:\n%#v\nwant:\n%#v", buf[:n], testResponse)
+	}
+	if !i.Truncated || i.Transport != "TCP" {
+		t.Errorf("resolve() info = %+v, want truncated over TCP", i)
+	}
+}
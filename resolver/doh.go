@@ -3,15 +3,102 @@ package resolver
 import (
 	"bytes"
 	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/nextdns/nextdns/internal/dnsmessage"
+	"github.com/nextdns/nextdns/resolver/endpoint"
 	"github.com/nextdns/nextdns/resolver/query"
 )
 
+// ErrEmptyResponse is returned when a DoH server replies with a successful
+// status but no DNS message in the body, again after a retry. It is only
+// returned with DOH RetryEmptyResponse set.
+var ErrEmptyResponse = errors.New("empty response")
+
+// ErrTruncatedResponse is returned with the response when a DoH response has
+// the TC bit set. DoH carries messages of any size, so a response is never
+// legitimately truncated: either the server or an intermediary misbehaves, or
+// the response did not fit the provided buffer. The truncated message must not
+// be treated as a complete answer.
+var ErrTruncatedResponse = errors.New("truncated response")
+
+// ErrResponseMismatch is returned when VerifyResponse is set and a response
+// does not match its query.
+var ErrResponseMismatch = errors.New("response does not match query")
+
+// StatusError is returned when a DoH server replies with a non 200 status.
+type StatusError = endpoint.StatusError
+
+// RateLimitedError is returned when a DoH server replies with a 429 status, or
+// a 503 status with a Retry-After header. RetryAfter is the delay requested by
+// the server, or zero if unknown.
+type RateLimitedError struct {
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("rate limited: error code: %d, retry after %v", e.StatusCode, e.RetryAfter)
+	}
+	return fmt.Sprintf("rate limited: error code: %d", e.StatusCode)
+}
+
+func (e *RateLimitedError) Unwrap() error {
+	return &StatusError{StatusCode: e.StatusCode}
+}
+
+// parseRetryAfter parses the value of a Retry-After header, either a number of
+// seconds or an HTTP date. It returns zero if v is invalid or in the past.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// TLSAuthError is returned when the certificate of a DoH server cannot be
+// verified. Err is the underlying x509 error.
+type TLSAuthError struct {
+	Err error
+}
+
+func (e *TLSAuthError) Error() string {
+	return "tls authentication failed: " + e.Err.Error()
+}
+
+func (e *TLSAuthError) Unwrap() error {
+	return e.Err
+}
+
+// isTLSAuthError returns true if err is caused by a certificate verification
+// failure.
+func isTLSAuthError(err error) bool {
+	var uae x509.UnknownAuthorityError
+	var cie x509.CertificateInvalidError
+	var he x509.HostnameError
+	return errors.As(err, &uae) || errors.As(err, &cie) || errors.As(err, &he)
+}
+
 type ClientInfo struct {
 	ID    string
 	IP    string
@@ -36,12 +123,31 @@ type DOH struct {
 	// before being considered stale regardless of the records TTL.
 	CacheMaxAge uint32
 
+	// CacheMaxStale defines the maximum time in second after its expiration a
+	// cached entry can still be returned when the upstream fails. If zero,
+	// expired entries are returned regardless of their age.
+	CacheMaxStale uint32
+
+	// CacheNegativeMaxAge defines the maximum age in second allowed for a
+	// cached negative response (NXDOMAIN or NODATA) before being considered
+	// stale. If zero, CacheMaxAge applies.
+	CacheNegativeMaxAge uint32
+
+	// NoNegativeCache disables the caching of negative responses.
+	NoNegativeCache bool
+
 	// MaxTTL defines the maximum TTL value that will be handed out to clients.
 	// The specified maximum TTL will be given to clients instead of the true
 	// TTL value if it is lower. The true TTL value is however kept in the cache
 	// to evaluate cache entries freshness.
 	MaxTTL uint32
 
+	// Method is the HTTP method used to send queries: "POST" (the default)
+	// or "GET". With GET, the query is sent base64url encoded in the dns
+	// parameter of the URL as defined by RFC8484, which lets HTTP caches store
+	// responses.
+	Method string
+
 	// ExtraHeaders specifies headers to be added to all DoH requests.
 	ExtraHeaders http.Header
 
@@ -49,6 +155,52 @@ type DOH struct {
 	// embed with the request.
 	ClientInfo func(query.Query) ClientInfo
 
+	// RetryEmptyResponse specifies that a response with a 200 status and an
+	// empty body is retried once before ErrEmptyResponse is returned. Some
+	// misbehaving gateways are known to send such responses. The idle
+	// connections of the round tripper are closed before the retry, so it is
+	// sent on a new connection. If false, an empty response is returned as is,
+	// with no error.
+	RetryEmptyResponse bool
+
+	// RetryRateLimited specifies that a query rate limited by the server with
+	// a Retry-After header is retried once after the requested delay, if the
+	// context deadline allows it. Otherwise a RateLimitedError is returned.
+	RetryRateLimited bool
+
+	// TrustBodyOnError specifies that the body of a response with a non 200
+	// status is used if it has the application/dns-message content type and
+	// is a valid DNS message. Such responses are never cached.
+	TrustBodyOnError bool
+
+	// PaddingBlockSize, if not zero, pads queries with the EDNS0 padding
+	// option to a multiple of this number of bytes so their size leaks less
+	// information. DefaultPaddingBlockSize is the recommended value.
+	PaddingBlockSize int
+
+	// VerifyResponse specifies that responses are checked to have the ID and
+	// question of their query. ErrResponseMismatch is returned otherwise.
+	VerifyResponse bool
+
+	// CoalesceQueries specifies that concurrent identical queries from the
+	// same client share a single upstream request. The request is bound to
+	// the context of the first query.
+	CoalesceQueries bool
+
+	// MaxQPS, if not zero, limits the requests sent to the server to this
+	// number per second, so bursts are smoothed below the rate at which the
+	// server throttles clients. Requests over the rate wait for a slot, or fail
+	// with ErrRateLimitExceeded if none is available before their deadline.
+	// Cached responses are not limited.
+	MaxQPS int
+
+	// MaxQPSBurst is the number of requests that can be sent at once over
+	// MaxQPS. If zero, MaxQPS is used.
+	MaxQPSBurst int
+
+	inflight inflight
+	limiter  rateLimiter
+
 	mu           sync.RWMutex
 	lastModified map[string]time.Time // per URL last conf last modified
 }
@@ -66,30 +218,140 @@ func (r *DOH) resolve(ctx context.Context, q query.Query, buf []byte, rt http.Ro
 	if url == "" {
 		url = "https://0.0.0.0"
 	}
+	if r.PaddingBlockSize > 0 {
+		p, err := padMessage(q.Payload, r.PaddingBlockSize)
+		if err != nil {
+			return -1, i, err
+		}
+		q.Payload = p
+	}
 	var now time.Time
 	n = -1
 	// RFC1035, section 7.4: The results of an inverse query should not be cached
 	if q.Type != query.TypePTR && r.Cache != nil {
 		now = time.Now()
-		if v, found := r.Cache.Get(cacheKey{url, q.Class, q.Type, q.Name}); found {
+		i.cacheLookup = true
+		if v, found := r.Cache.Get(lookupCacheKey(r.Cache, url, q)); found && !bypassCache(ctx) {
 			if v, ok := v.(*cacheValue); ok {
 				var minTTL uint32
-				n, minTTL = v.AdjustedResponse(buf, q.ID, r.CacheMaxAge, r.MaxTTL, now)
+				n, minTTL = v.AdjustedResponse(buf, q.ID, cacheMaxAge(v.msg, r.CacheMaxAge, r.CacheNegativeMaxAge), r.MaxTTL, now)
 				i.Transport = v.trans
 				i.FromCache = true
 				// Use cached entry if TTL is in the future and isn't older than
 				// the configuration last change.
 				if minTTL > 0 && r.lastMod(url).Before(v.time) {
+					i.CacheTTL = minTTL
 					return n, i, nil
 				}
+				if minTTL == 0 && !v.usableStale(r.CacheMaxStale, now) {
+					n, i.Transport, i.FromCache = -1, "", false
+				}
 			}
 		}
 	}
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(q.Payload))
+	fetch := func(buf []byte) (int, ResolveInfo, error) {
+		return r.fetch(ctx, url, q, ci, buf, rt, now)
+	}
+	var n2 int
+	var i2 ResolveInfo
+	if r.CoalesceQueries && len(q.Payload) > 2 {
+		key := inflightKey{url: url, ci: ci, msg: string(q.Payload[2:])}
+		n2, i2, err = r.inflight.do(ctx, key, buf, q.ID, fetch)
+	} else {
+		n2, i2, err = fetch(buf)
+	}
+	if n2 < 0 {
+		// Keep the stale cached response, if any.
+		return n, i, err
+	}
+	i2.cacheLookup = i.cacheLookup
+	return n2, i2, err
+}
+
+// fetch sends q to url and reads the response into buf. The response is
+// cached if valid. If the request fails, n is -1.
+func (r *DOH) fetch(ctx context.Context, url string, q query.Query, ci ClientInfo, buf []byte, rt http.RoundTripper, now time.Time) (n int, i ResolveInfo, err error) {
+	n = -1
+	if r.MaxQPS > 0 {
+		if err = r.limiter.wait(ctx, r.MaxQPS, r.MaxQPSBurst); err != nil {
+			return n, i, err
+		}
+	}
+	res, err := r.roundTrip(ctx, url, q.Payload, ci, rt)
+	var rle *RateLimitedError
+	if err != nil && r.RetryRateLimited && errors.As(err, &rle) && sleepContext(ctx, rle.RetryAfter) {
+		res, err = r.roundTrip(endpoint.WithRetry(ctx), url, q.Payload, ci, rt)
+	}
 	if err != nil {
 		return n, i, err
 	}
-	req.Header.Set("Content-Type", "application/dns-message")
+	var truncated bool
+	n, truncated, err = readDNSResponse(res.Body, buf)
+	if n == 0 && err == nil && r.RetryEmptyResponse {
+		res.Body.Close()
+		// Do not retry on the connection that may be the cause.
+		if c, ok := rt.(interface{ CloseIdleConnections() }); ok {
+			c.CloseIdleConnections()
+		}
+		if res, err = r.roundTrip(endpoint.WithRetry(ctx), url, q.Payload, ci, rt); err != nil {
+			return n, i, err
+		}
+		n, truncated, err = readDNSResponse(res.Body, buf)
+		if n == 0 && err == nil {
+			err = ErrEmptyResponse
+		}
+	}
+	defer res.Body.Close()
+	if r.VerifyResponse && n > 0 && err == nil && !matchResponse(q.Payload, buf[:n]) {
+		n, err = -1, ErrResponseMismatch
+	}
+	if res.StatusCode != http.StatusOK && err == nil && !isValidDNSMessage(buf[:n]) {
+		n, err = -1, &StatusError{StatusCode: res.StatusCode}
+	}
+	i.Transport = res.Proto
+	i.Truncated = n >= 3 && buf[2]&0x2 != 0
+	if i.Truncated && err == nil {
+		err = ErrTruncatedResponse
+	}
+	if n > 0 && !truncated && err == nil && res.StatusCode == http.StatusOK && r.Cache != nil && !(r.NoNegativeCache && isNegative(buf[:n])) {
+		v := &cacheValue{
+			time:  now,
+			msg:   make([]byte, n),
+			trans: res.Proto,
+		}
+		copy(v.msg, buf[:n])
+		r.Cache.Add(storeCacheKey(r.Cache, url, q, v.msg), v)
+		r.updateLastMod(url, res.Header.Get("X-Conf-Last-Modified"))
+	}
+	if r.MaxTTL > 0 && n > 0 {
+		updateTTL(buf[:n], 0, 0, r.MaxTTL)
+	}
+	return n, i, err
+}
+
+// roundTrip sends payload to url using rt and returns the response if its
+// status is 200, or if TrustBodyOnError is set and the response body is a DNS
+// message.
+func (r *DOH) roundTrip(ctx context.Context, url string, payload []byte, ci ClientInfo, rt http.RoundTripper) (*http.Response, error) {
+	var req *http.Request
+	var err error
+	if r.Method == "GET" {
+		sep := "?"
+		if strings.Contains(url, "?") {
+			sep = "&"
+		}
+		url += sep + "dns=" + base64.RawURLEncoding.EncodeToString(payload)
+		req, err = http.NewRequestWithContext(ctx, "GET", url, nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(payload))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if req.Method == "POST" {
+		req.Header.Set("Content-Type", "application/dns-message")
+	}
+	req.Header.Set("Accept", "application/dns-message")
 	req.Header.Set("X-Conf-Last-Modified", "true")
 	for name, values := range r.ExtraHeaders {
 		req.Header[name] = values
@@ -111,30 +373,44 @@ func (r *DOH) resolve(ctx context.Context, q query.Query, buf []byte, rt http.Ro
 	}
 	res, err := rt.RoundTrip(req)
 	if err != nil {
-		return n, i, err
-	}
-	defer res.Body.Close()
-	if res.StatusCode != http.StatusOK {
-		return n, i, fmt.Errorf("error code: %d", res.StatusCode)
+		if isTLSAuthError(err) {
+			err = &TLSAuthError{Err: err}
+		}
+		return nil, err
 	}
-	var truncated bool
-	n, truncated, err = readDNSResponse(res.Body, buf)
-	i.Transport = res.Proto
-	i.FromCache = false
-	if n > 0 && !truncated && err == nil && r.Cache != nil {
-		v := &cacheValue{
-			time:  now,
-			msg:   make([]byte, n),
-			trans: res.Proto,
+	if res.StatusCode == http.StatusTooManyRequests ||
+		(res.StatusCode == http.StatusServiceUnavailable && res.Header.Get("Retry-After") != "") {
+		res.Body.Close()
+		return nil, &RateLimitedError{
+			StatusCode: res.StatusCode,
+			RetryAfter: parseRetryAfter(res.Header.Get("Retry-After"), time.Now()),
 		}
-		copy(v.msg, buf[:n])
-		r.Cache.Add(cacheKey{url, q.Class, q.Type, q.Name}, v)
-		r.updateLastMod(url, res.Header.Get("X-Conf-Last-Modified"))
 	}
-	if r.MaxTTL > 0 && n > 0 {
-		updateTTL(buf[:n], 0, 0, r.MaxTTL)
+	if res.StatusCode != http.StatusOK &&
+		!(r.TrustBodyOnError && res.Header.Get("Content-Type") == "application/dns-message") {
+		res.Body.Close()
+		return nil, &StatusError{StatusCode: res.StatusCode}
+	}
+	return res, nil
+}
+
+// sleepContext waits for d and returns true, or returns false without waiting
+// if d is zero or ctx would expire before.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return false
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < d {
+		return false
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
 	}
-	return n, i, err
 }
 
 // lastMod returns the last modification time of the configuration pointed by
@@ -170,22 +446,103 @@ func (r *DOH) updateLastMod(url, lastMod string) {
 	r.mu.Unlock()
 }
 
+func isValidDNSMessage(msg []byte) bool {
+	var m dnsmessage.Message
+	return m.Unpack(msg) == nil
+}
+
+// matchResponse returns true if resp has the same ID and question as the query
+// payload. Question names are compared case insensitively, as some resolvers
+// randomize their case.
+func matchResponse(payload, resp []byte) bool {
+	if len(payload) < 12 || len(resp) < 12 {
+		return false
+	}
+	if payload[0] != resp[0] || payload[1] != resp[1] || // ID
+		payload[4] != resp[4] || payload[5] != resp[5] { // QDCOUNT
+		return false
+	}
+	if unpackUint16(payload[4:]) == 0 {
+		return true
+	}
+	l := skipName(payload[12:])
+	if l == 0 || 12+l+4 > len(payload) || 12+l+4 > len(resp) {
+		return false
+	}
+	for i := 12; i < 12+l+4; i++ {
+		a, b := payload[i], resp[i]
+		if 'A' <= a && a <= 'Z' {
+			a += 'a' - 'A'
+		}
+		if 'A' <= b && b <= 'Z' {
+			b += 'a' - 'A'
+		}
+		if a != b {
+			return false
+		}
+	}
+	return true
+}
+
+// readDNSResponse reads the DNS response from r into buf. If the response does
+// not fit in buf, it is truncated to the size of buf and marked as truncated
+// with the TC bit.
 func readDNSResponse(r io.Reader, buf []byte) (n int, truncated bool, err error) {
-	for {
-		nn, err := r.Read(buf[n:])
-		n += nn
-		if err != nil {
-			if err == io.EOF {
-				break
+	n, err = io.ReadFull(r, buf)
+	switch err {
+	case nil:
+		// buf is full, check if the response is larger.
+		var b [1]byte
+		if nn, _ := io.ReadFull(r, b[:]); nn == 0 {
+			return n, false, nil
+		}
+		buf[2] |= 0x2 // mark response as truncated
+		return n, true, nil
+	case io.EOF, io.ErrUnexpectedEOF:
+		return n, false, nil
+	default:
+		return 0, false, err
+	}
+}
+
+// sensitiveHeaders are the ExtraHeaders whose values are redacted from
+// diagnostics.
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "X-Api-Key"}
+
+// Diagnostics returns a JSON document with the diagnostics of e, as returned
+// by endpoint.DOHEndpoint.Diagnostics, and the ExtraHeaders sent with the
+// queries. The values of the headers holding credentials are redacted.
+func (r *DOH) Diagnostics(e *endpoint.DOHEndpoint) ([]byte, error) {
+	b, err := e.Diagnostics()
+	if err != nil {
+		return nil, err
+	}
+	d := struct {
+		Endpoint json.RawMessage `json:"endpoint"`
+		Headers  http.Header     `json:"headers,omitempty"`
+	}{
+		Endpoint: b,
+	}
+	if len(r.ExtraHeaders) > 0 {
+		d.Headers = http.Header{}
+		for name, values := range r.ExtraHeaders {
+			values = append([]string(nil), values...)
+			if isSensitiveHeader(name) {
+				for i := range values {
+					values[i] = "REDACTED"
+				}
 			}
-			return 0, false, err
+			d.Headers[name] = values
 		}
-		if n >= len(buf) {
-			buf[2] |= 0x2 // mark response as truncated
-			truncated = true
-			n = len(buf)
-			break
+	}
+	return json.Marshal(d)
+}
+
+func isSensitiveHeader(name string) bool {
+	for _, h := range sensitiveHeaders {
+		if strings.EqualFold(h, name) {
+			return true
 		}
 	}
-	return n, truncated, nil
+	return false
 }
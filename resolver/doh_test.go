@@ -0,0 +1,534 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nextdns/nextdns/resolver/endpoint"
+	"github.com/nextdns/nextdns/resolver/query"
+)
+
+type fakeResponse struct {
+	status      int
+	contentType string
+	header      http.Header
+	body        []byte
+}
+
+type fakeTransport struct {
+	responses  []fakeResponse
+	reqs       []*http.Request
+	idleClosed int
+}
+
+func (t *fakeTransport) CloseIdleConnections() {
+	t.idleClosed++
+}
+
+func (t *fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.reqs = append(t.reqs, req)
+	if len(t.responses) == 0 {
+		return nil, errors.New("no more responses")
+	}
+	r := t.responses[0]
+	t.responses = t.responses[1:]
+	h := http.Header{"Content-Type": []string{r.contentType}}
+	for name, values := range r.header {
+		h[name] = values
+	}
+	return &http.Response{
+		StatusCode: r.status,
+		Body:       ioutil.NopCloser(bytes.NewReader(r.body)),
+		Header:     h,
+	}, nil
+}
+
+var testResponse = []byte{
+	0x00, 0x7b, // ID
+	0x81, 0x80, // Flags
+	0x00, 0x01, // Questions
+	0x00, 0x01, // Answers
+	0x00, 0x00, // Authorities
+	0x00, 0x00, // Additionals
+	// Questions
+	0x04, 0x74, 0x65, 0x73, 0x74, 0x03, 0x63, 0x6f, 0x6d, 0x00, // Label test.com.
+	0x00, 0x01, // Type A
+	0x00, 0x01, // Class IN
+	// Answers
+	0xc0, 0x0c, // Label pointer test.com.
+	0x00, 0x01, // Type A
+	0x00, 0x01, // Class IN
+	0x00, 0x00, 0x0e, 0x10, // TTL 3600
+	0x00, 0x04, // Data len 4
+	0x45, 0xac, 0xc8, 0xeb, // 69.172.200.235
+}
+
+func TestDOH_resolve_EmptyResponse(t *testing.T) {
+	tests := []struct {
+		name      string
+		retry     bool
+		wantN     int
+		wantErr   error
+		wantTries int
+		second    []byte
+	}{
+		// The default is unchanged: the empty response is returned as is.
+		{"NoRetry", false, 0, nil, 1, testResponse},
+		{"Retry", true, len(testResponse), nil, 2, testResponse},
+		{"RetryEmpty", true, 0, ErrEmptyResponse, 2, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := &fakeTransport{
+				responses: []fakeResponse{
+					{status: http.StatusOK},
+					{status: http.StatusOK, body: tt.second},
+				},
+			}
+			r := &DOH{URL: "https://doh.test", RetryEmptyResponse: tt.retry}
+			q := query.Query{Class: query.ClassINET, Type: query.TypeA, Name: "test.com."}
+			buf := make([]byte, 512)
+			n, _, err := r.resolve(context.Background(), q, buf, rt)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("resolve() err = %v, want %v", err, tt.wantErr)
+			}
+			if n != tt.wantN {
+				t.Errorf("resolve() n = %d, want %d", n, tt.wantN)
+			}
+			if got := len(rt.reqs); got != tt.wantTries {
+				t.Errorf("resolve() requests = %d, want %d", got, tt.wantTries)
+			}
+			// The retry is sent on a new connection.
+			if got, want := rt.idleClosed, tt.wantTries-1; got != want {
+				t.Errorf("resolve() idle closes = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestDOH_resolve_TrustBodyOnError(t *testing.T) {
+	tests := []struct {
+		name        string
+		trust       bool
+		contentType string
+		body        []byte
+		wantErr     bool
+	}{
+		{"Untrusted", false, "application/dns-message", testResponse, true},
+		{"Trusted", true, "application/dns-message", testResponse, false},
+		{"TrustedWrongType", true, "text/html", testResponse, true},
+		{"TrustedInvalidBody", true, "application/dns-message", testResponse[:20], true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := &fakeTransport{
+				responses: []fakeResponse{
+					{status: http.StatusNonAuthoritativeInfo, contentType: tt.contentType, body: tt.body},
+				},
+			}
+			r := &DOH{URL: "https://doh.test", TrustBodyOnError: tt.trust}
+			q := query.Query{Class: query.ClassINET, Type: query.TypeA, Name: "test.com."}
+			buf := make([]byte, 512)
+			n, _, err := r.resolve(context.Background(), q, buf, rt)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("resolve() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && n != len(testResponse) {
+				t.Errorf("resolve() n = %d, want %d", n, len(testResponse))
+			}
+		})
+	}
+}
+
+func TestDOH_resolve_TrustBodyOnErrorStale(t *testing.T) {
+	expired := append([]byte{}, testResponse...)
+	copy(expired[32:36], []byte{0, 0, 0, 0}) // TTL 0
+	rt := &fakeTransport{
+		responses: []fakeResponse{
+			{status: http.StatusOK, contentType: "application/dns-message", body: expired},
+			{status: http.StatusBadGateway, contentType: "application/dns-message", body: testResponse[:20]},
+		},
+	}
+	r := &DOH{URL: "https://doh.test", TrustBodyOnError: true, Cache: mapCache{}}
+	q := query.Query{Class: query.ClassINET, Type: query.TypeA, Name: "test.com.", Payload: testQuery}
+	buf := make([]byte, 512)
+	if _, _, err := r.resolve(context.Background(), q, buf, rt); err != nil {
+		t.Fatalf("resolve() err = %v", err)
+	}
+	// The invalid body is discarded for the stale cached response.
+	n, i, err := r.resolve(context.Background(), q, buf, rt)
+	var se *StatusError
+	if !errors.As(err, &se) || se.StatusCode != http.StatusBadGateway {
+		t.Errorf("resolve() err = %v, want a %d StatusError", err, http.StatusBadGateway)
+	}
+	if n != len(expired) || !i.FromCache {
+		t.Errorf("resolve() n = %d, FromCache = %v, want the stale response", n, i.FromCache)
+	}
+}
+
+func TestDOH_resolve_ChunkedResponse(t *testing.T) {
+	resp := make([]byte, 4096)
+	copy(resp, testResponse)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/dns-message")
+		for off := 0; off < len(resp); off += 512 {
+			_, _ = w.Write(resp[off : off+512])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer srv.Close()
+
+	r := &DOH{URL: srv.URL}
+	q := query.Query{Class: query.ClassINET, Type: query.TypeA, Name: "test.com."}
+	for _, size := range []int{4096, 65535} {
+		buf := make([]byte, size)
+		n, i, err := r.resolve(context.Background(), q, buf, srv.Client().Transport)
+		if err != nil {
+			t.Fatalf("resolve() err = %v", err)
+		}
+		if n != len(resp) || !bytes.Equal(buf[:n], resp) {
+			t.Errorf("resolve() with %d bytes buffer returned %d bytes, want %d", size, n, len(resp))
+		}
+		if i.Truncated {
+			t.Errorf("resolve() with %d bytes buffer reported a truncated response", size)
+		}
+	}
+
+	buf := make([]byte, 1024)
+	n, i, err := r.resolve(context.Background(), q, buf, srv.Client().Transport)
+	if err != ErrTruncatedResponse {
+		t.Fatalf("resolve() err = %v, want %v", err, ErrTruncatedResponse)
+	}
+	if n != len(buf) || !i.Truncated {
+		t.Errorf("resolve() with small buffer = %d bytes, truncated %v, want %d bytes truncated", n, i.Truncated, len(buf))
+	}
+}
+
+func TestDOH_resolve_GET(t *testing.T) {
+	rt := &fakeTransport{
+		responses: []fakeResponse{
+			{status: http.StatusOK, body: testResponse},
+		},
+	}
+	r := &DOH{URL: "https://doh.test/abcdef", Method: "GET"}
+	q := query.Query{Class: query.ClassINET, Type: query.TypeA, Name: "test.com.", Payload: testQuery}
+	buf := make([]byte, 512)
+	if _, _, err := r.resolve(context.Background(), q, buf, rt); err != nil {
+		t.Fatalf("resolve() err = %v", err)
+	}
+	req := rt.reqs[0]
+	if req.Method != "GET" || req.Body != nil {
+		t.Errorf("request method = %s, body = %v, want GET without body", req.Method, req.Body)
+	}
+	if got, want := req.URL.Path, "/abcdef"; got != want {
+		t.Errorf("request path = %s, want %s", got, want)
+	}
+	if got, want := req.Header.Get("Accept"), "application/dns-message"; got != want {
+		t.Errorf("request Accept = %q, want %q", got, want)
+	}
+	if strings.HasSuffix(req.URL.RawQuery, "=") {
+		t.Errorf("request query %q is padded", req.URL.RawQuery)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+	if err != nil {
+		t.Fatalf("dns parameter: %v", err)
+	}
+	if !bytes.Equal(payload, testQuery) {
+		t.Errorf("dns parameter decodes to\n%#v\nwant:\n%#v", payload, testQuery)
+	}
+}
+
+func TestDOH_resolve_Errors(t *testing.T) {
+	q := query.Query{Class: query.ClassINET, Type: query.TypeA, Name: "test.com.", Payload: testQuery}
+	buf := make([]byte, 512)
+
+	rt := &fakeTransport{
+		responses: []fakeResponse{
+			{status: http.StatusServiceUnavailable},
+		},
+	}
+	_, _, err := (&DOH{URL: "https://doh.test"}).resolve(context.Background(), q, buf, rt)
+	var se *StatusError
+	if !errors.As(err, &se) || se.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("resolve() err = %v, want StatusError 503", err)
+	}
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	tr := &http.Transport{}
+	defer tr.CloseIdleConnections()
+	_, _, err = (&DOH{URL: srv.URL}).resolve(context.Background(), q, buf, tr)
+	var te *TLSAuthError
+	if !errors.As(err, &te) {
+		t.Errorf("resolve() err = %v, want TLSAuthError", err)
+	}
+	var uae x509.UnknownAuthorityError
+	if !errors.As(err, &uae) {
+		t.Errorf("resolve() err = %v, want x509.UnknownAuthorityError", err)
+	}
+}
+
+func TestDOH_resolve_RateLimited(t *testing.T) {
+	retryAfter := http.Header{"Retry-After": []string{"1"}}
+	q := query.Query{Class: query.ClassINET, Type: query.TypeA, Name: "test.com.", Payload: testQuery}
+	buf := make([]byte, 512)
+
+	rt := &fakeTransport{
+		responses: []fakeResponse{
+			{status: http.StatusTooManyRequests, header: retryAfter},
+		},
+	}
+	_, _, err := (&DOH{URL: "https://doh.test"}).resolve(context.Background(), q, buf, rt)
+	var rle *RateLimitedError
+	if !errors.As(err, &rle) || rle.RetryAfter != time.Second {
+		t.Fatalf("resolve() err = %v, want RateLimitedError with 1s delay", err)
+	}
+	var se *StatusError
+	if !errors.As(err, &se) || se.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("resolve() err = %v, want StatusError 429", err)
+	}
+
+	rt = &fakeTransport{
+		responses: []fakeResponse{
+			{status: http.StatusTooManyRequests, header: retryAfter},
+			{status: http.StatusOK, body: testResponse},
+		},
+	}
+	start := time.Now()
+	n, _, err := (&DOH{URL: "https://doh.test", RetryRateLimited: true}).resolve(context.Background(), q, buf, rt)
+	if err != nil {
+		t.Fatalf("resolve() err = %v", err)
+	}
+	if n != len(testResponse) {
+		t.Errorf("resolve() n = %d, want %d", n, len(testResponse))
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("resolve() retried after %v, want at least 1s", elapsed)
+	}
+}
+
+func Test_parseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		v    string
+		want time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"-1", 0},
+		{"Mon, 01 Jun 2020 12:00:30 GMT", 30 * time.Second},
+		{"Mon, 01 Jun 2020 11:00:00 GMT", 0},
+		{"soon", 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.v, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestDOH_resolve_TruncatedResponse(t *testing.T) {
+	resp := append([]byte{}, testResponse...)
+	resp[2] |= 0x2 // TC
+	rt := &fakeTransport{
+		responses: []fakeResponse{
+			{status: http.StatusOK, body: resp},
+		},
+	}
+	cache := mapCache{}
+	r := &DOH{URL: "https://doh.test", Cache: cache}
+	q := query.Query{Class: query.ClassINET, Type: query.TypeA, Name: "test.com.", Payload: testQuery}
+	buf := make([]byte, 512)
+	n, i, err := r.resolve(context.Background(), q, buf, rt)
+	if err != ErrTruncatedResponse {
+		t.Errorf("resolve() err = %v, want %v", err, ErrTruncatedResponse)
+	}
+	if n != len(resp) || !i.Truncated {
+		t.Errorf("resolve() n = %d, truncated = %v, want %d, true", n, i.Truncated, len(resp))
+	}
+	if len(cache) != 0 {
+		t.Errorf("truncated response was cached")
+	}
+}
+
+func TestDOH_resolve_VerifyResponse(t *testing.T) {
+	payload := append([]byte{}, testQuery...)
+	payload[0], payload[1] = testResponse[0], testResponse[1]
+	wrongID := append([]byte{}, testResponse...)
+	wrongID[1]++
+	wrongName := append([]byte{}, testResponse...)
+	wrongName[13] = 'b' // best.com.
+	mixedCase := append([]byte{}, testResponse...)
+	mixedCase[13] = 'T' // Test.com.
+	tests := []struct {
+		name    string
+		resp    []byte
+		wantErr error
+	}{
+		{"Match", testResponse, nil},
+		{"MixedCase", mixedCase, nil},
+		{"WrongID", wrongID, ErrResponseMismatch},
+		{"WrongName", wrongName, ErrResponseMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := &fakeTransport{
+				responses: []fakeResponse{
+					{status: http.StatusOK, body: tt.resp},
+				},
+			}
+			r := &DOH{URL: "https://doh.test", VerifyResponse: true}
+			q := query.Query{Class: query.ClassINET, Type: query.TypeA, Name: "test.com.", Payload: payload}
+			buf := make([]byte, 512)
+			if _, _, err := r.resolve(context.Background(), q, buf, rt); err != tt.wantErr {
+				t.Errorf("resolve() err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDOH_resolve_VerifyResponseStale(t *testing.T) {
+	payload := append([]byte{}, testQuery...)
+	payload[0], payload[1] = testResponse[0], testResponse[1]
+	expired := append([]byte{}, testResponse...)
+	copy(expired[32:36], []byte{0, 0, 0, 0}) // TTL 0
+	wrongID := append([]byte{}, testResponse...)
+	wrongID[1]++
+	rt := &fakeTransport{
+		responses: []fakeResponse{
+			{status: http.StatusOK, body: expired},
+			{status: http.StatusOK, body: wrongID},
+		},
+	}
+	r := &DOH{URL: "https://doh.test", VerifyResponse: true, Cache: mapCache{}}
+	q := query.Query{Class: query.ClassINET, Type: query.TypeA, Name: "test.com.", Payload: payload}
+	buf := make([]byte, 512)
+	if _, _, err := r.resolve(context.Background(), q, buf, rt); err != nil {
+		t.Fatalf("resolve() err = %v", err)
+	}
+	// The mismatched response is discarded for the stale cached one.
+	n, i, err := r.resolve(context.Background(), q, buf, rt)
+	if err != ErrResponseMismatch {
+		t.Errorf("resolve() err = %v, want %v", err, ErrResponseMismatch)
+	}
+	if n != len(expired) || !i.FromCache {
+		t.Errorf("resolve() n = %d, FromCache = %v, want the stale response", n, i.FromCache)
+	}
+}
+
+// slowTransport answers testResponse with the query ID after a delay and
+// counts requests.
+type slowTransport struct {
+	delay time.Duration
+	reqs  int32
+}
+
+func (t *slowTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&t.reqs, 1)
+	resp := append([]byte{}, testResponse...)
+	if _, err := io.ReadFull(req.Body, resp[:2]); err != nil {
+		return nil, err
+	}
+	time.Sleep(t.delay)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewReader(resp)),
+		Header:     http.Header{"Content-Type": []string{"application/dns-message"}},
+	}, nil
+}
+
+func TestDOH_resolve_CoalesceQueries(t *testing.T) {
+	rt := &slowTransport{delay: 200 * time.Millisecond}
+	r := &DOH{URL: "https://doh.test", CoalesceQueries: true}
+	var wg sync.WaitGroup
+	for j := 0; j < 50; j++ {
+		wg.Add(1)
+		go func(id uint16) {
+			defer wg.Done()
+			payload := append([]byte{}, testQuery...)
+			packUint16(payload, id)
+			q := query.Query{ID: id, Class: query.ClassINET, Type: query.TypeA, Name: "test.com.", Payload: payload}
+			buf := make([]byte, 512)
+			n, _, err := r.resolve(context.Background(), q, buf, rt)
+			if err != nil {
+				t.Errorf("resolve() err = %v", err)
+				return
+			}
+			if n != len(testResponse) {
+				t.Errorf("resolve() n = %d, want %d", n, len(testResponse))
+				return
+			}
+			if got := unpackUint16(buf); got != id {
+				t.Errorf("resolve() response ID = %d, want %d", got, id)
+			}
+		}(uint16(j))
+	}
+	wg.Wait()
+	if got := atomic.LoadInt32(&rt.reqs); got != 1 {
+		t.Errorf("%d upstream requests, want 1", got)
+	}
+
+	// A later query is sent again.
+	q := query.Query{Class: query.ClassINET, Type: query.TypeA, Name: "test.com.", Payload: testQuery}
+	if _, _, err := r.resolve(context.Background(), q, make([]byte, 512), rt); err != nil {
+		t.Fatalf("resolve() err = %v", err)
+	}
+	if got := atomic.LoadInt32(&rt.reqs); got != 2 {
+		t.Errorf("%d upstream requests, want 2", got)
+	}
+}
+
+func TestDOH_Diagnostics(t *testing.T) {
+	r := DOH{ExtraHeaders: http.Header{
+		"User-Agent":    []string{"nextdns-cli/1.0"},
+		"Authorization": []string{"Bearer secret"},
+		"cookie":        []string{"a=secret", "b=secret"},
+	}}
+	b, err := r.Diagnostics(&endpoint.DOHEndpoint{Hostname: "doh.test", Path: "/abcdef"})
+	if err != nil {
+		t.Fatalf("Diagnostics() err = %v", err)
+	}
+	if bytes.Contains(b, []byte("secret")) {
+		t.Errorf("Diagnostics() leaks a sensitive header: %s", b)
+	}
+	var d struct {
+		Endpoint struct {
+			Hostname string `json:"hostname"`
+			Stats    struct {
+				Requests *uint64 `json:"requests"`
+			} `json:"stats"`
+		} `json:"endpoint"`
+		Headers http.Header `json:"headers"`
+	}
+	if err := json.Unmarshal(b, &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Endpoint.Hostname != "doh.test" || d.Endpoint.Stats.Requests == nil {
+		t.Errorf("Diagnostics() endpoint = %+v, want doh.test with stats", d.Endpoint)
+	}
+	want := http.Header{
+		"User-Agent":    []string{"nextdns-cli/1.0"},
+		"Authorization": []string{"REDACTED"},
+		"cookie":        []string{"REDACTED", "REDACTED"},
+	}
+	if !reflect.DeepEqual(d.Headers, want) {
+		t.Errorf("Diagnostics() headers = %v, want %v", d.Headers, want)
+	}
+	if got := r.ExtraHeaders.Get("Authorization"); got != "Bearer secret" {
+		t.Errorf("ExtraHeaders modified: %q", got)
+	}
+}
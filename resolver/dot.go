@@ -0,0 +1,95 @@
+package resolver
+
+import (
+	"context"
+	"time"
+
+	"github.com/nextdns/nextdns/resolver/endpoint"
+	"github.com/nextdns/nextdns/resolver/query"
+)
+
+// DOT is a DNS-over-TLS implementation of the Resolver interface.
+type DOT struct {
+	// Cache defines the cache storage implementation for DNS response cache. If
+	// nil, caching is disabled.
+	Cache Cacher
+
+	// CacheMaxAge defines the maximum age in second allowed for a cached entry
+	// before being considered stale regardless of the records TTL.
+	CacheMaxAge uint32
+
+	// CacheMaxStale defines the maximum time in second after its expiration a
+	// cached entry can still be returned when the upstream fails. If zero,
+	// expired entries are returned regardless of their age.
+	CacheMaxStale uint32
+
+	// CacheNegativeMaxAge defines the maximum age in second allowed for a
+	// cached negative response (NXDOMAIN or NODATA) before being considered
+	// stale. If zero, CacheMaxAge applies.
+	CacheNegativeMaxAge uint32
+
+	// NoNegativeCache disables the caching of negative responses.
+	NoNegativeCache bool
+
+	// MaxTTL defines the maximum TTL value that will be handed out to clients.
+	// The specified maximum TTL will be given to clients instead of the true
+	// TTL value if it is lower. The true TTL value is however kept in the cache
+	// to evaluate cache entries freshness.
+	MaxTTL uint32
+
+	// PaddingBlockSize, if not zero, pads queries with the EDNS0 padding
+	// option to a multiple of this number of bytes so their size leaks less
+	// information. DefaultPaddingBlockSize is the recommended value.
+	PaddingBlockSize int
+}
+
+func (r DOT) resolve(ctx context.Context, q query.Query, buf []byte, e *endpoint.DOTEndpoint) (n int, i ResolveInfo, err error) {
+	i.Transport = "DOT"
+	var now time.Time
+	n = -1
+	// RFC1035, section 7.4: The results of an inverse query should not be cached
+	if q.Type != query.TypePTR && r.Cache != nil {
+		now = time.Now()
+		i.cacheLookup = true
+		if v, found := r.Cache.Get(lookupCacheKey(r.Cache, "", q)); found && !bypassCache(ctx) {
+			if v, ok := v.(*cacheValue); ok {
+				var minTTL uint32
+				n, minTTL = v.AdjustedResponse(buf, q.ID, cacheMaxAge(v.msg, r.CacheMaxAge, r.CacheNegativeMaxAge), r.MaxTTL, now)
+				i.FromCache = true
+				if minTTL > 0 {
+					i.CacheTTL = minTTL
+					return n, i, nil
+				}
+				if !v.usableStale(r.CacheMaxStale, now) {
+					n, i.FromCache = -1, false
+				}
+			}
+		}
+	}
+	payload := make([]byte, len(q.Payload))
+	// Copied as buf may be aliased with q.Payload.
+	copy(payload, q.Payload)
+	if r.PaddingBlockSize > 0 {
+		if payload, err = padMessage(payload, r.PaddingBlockSize); err != nil {
+			return n, i, err
+		}
+	}
+	nn, err := e.Exchange(ctx, payload, buf)
+	if err != nil {
+		return n, i, err
+	}
+	n = nn
+	i.FromCache = false
+	if r.Cache != nil && !(r.NoNegativeCache && isNegative(buf[:n])) {
+		v := &cacheValue{
+			time: now,
+			msg:  make([]byte, n),
+		}
+		copy(v.msg, buf[:n])
+		r.Cache.Add(storeCacheKey(r.Cache, "", q, v.msg), v)
+	}
+	if r.MaxTTL > 0 {
+		updateTTL(buf[:n], 0, 0, r.MaxTTL)
+	}
+	return n, i, nil
+}
@@ -0,0 +1,102 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nextdns/nextdns/resolver/endpoint"
+	"github.com/nextdns/nextdns/resolver/query"
+)
+
+// startDOTServer starts a DoT server answering resp, with the query ID, to
+// any query. The received queries are sent to queries.
+func startDOTServer(t *testing.T, resp []byte, queries chan<- []byte) (e *endpoint.DOTEndpoint, stop func()) {
+	t.Helper()
+	s := httptest.NewUnstartedServer(nil)
+	s.StartTLS()
+	cert := s.TLS.Certificates[0]
+	roots := x509.NewCertPool()
+	roots.AddCert(s.Certificate())
+	s.Close()
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				for {
+					var length uint16
+					if err := binary.Read(c, binary.BigEndian, &length); err != nil {
+						return
+					}
+					msg := make([]byte, length)
+					if _, err := io.ReadFull(c, msg); err != nil {
+						return
+					}
+					queries <- msg
+					r := append([]byte{}, resp...)
+					copy(r, msg[:2]) // query ID
+					_ = binary.Write(c, binary.BigEndian, uint16(len(r)))
+					if _, err := c.Write(r); err != nil {
+						return
+					}
+				}
+			}(c)
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	e = &endpoint.DOTEndpoint{
+		Hostname:  "example.com",
+		Port:      port,
+		Bootstrap: []string{"127.0.0.1"},
+		TLSConfig: &tls.Config{RootCAs: roots},
+	}
+	return e, func() { l.Close() }
+}
+
+func TestDOT_resolve(t *testing.T) {
+	queries := make(chan []byte, 2)
+	e, stop := startDOTServer(t, testResponse, queries)
+	defer stop()
+	defer e.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	r := DOT{Cache: mapCache{}, PaddingBlockSize: DefaultPaddingBlockSize}
+	for i, wantFromCache := range []bool{false, true} {
+		q := query.Query{Class: query.ClassINET, Type: query.TypeA, Name: "test.com.", Payload: testQuery}
+		buf := make([]byte, 512)
+		n, info, err := r.resolve(ctx, q, buf, e)
+		if err != nil {
+			t.Fatalf("#%d: resolve() err = %v", i, err)
+		}
+		if n != len(testResponse) || info.FromCache != wantFromCache {
+			t.Errorf("#%d: resolve() n = %d, info = %+v", i, n, info)
+		}
+	}
+	select {
+	case msg := <-queries:
+		if len(msg)%DefaultPaddingBlockSize != 0 {
+			t.Errorf("query of %d bytes is not padded", len(msg))
+		}
+	default:
+		t.Errorf("no query received")
+	}
+	if len(queries) != 0 {
+		t.Errorf("cached response not used")
+	}
+}
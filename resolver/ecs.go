@@ -0,0 +1,86 @@
+package resolver
+
+import (
+	"net"
+
+	"github.com/nextdns/nextdns/resolver/query"
+)
+
+// ECSMode defines how the EDNS Client Subnet option of queries is handled.
+type ECSMode int
+
+const (
+	// ECSPassthrough forwards the EDNS Client Subnet option of queries
+	// untouched.
+	ECSPassthrough ECSMode = iota
+
+	// ECSStrip removes the EDNS Client Subnet option from queries.
+	ECSStrip
+
+	// ECSOverride replaces the EDNS Client Subnet option of queries with
+	// ECSSubnet, adding it to queries without one.
+	ECSOverride
+
+	// ECSClient replaces the EDNS Client Subnet option of queries with the IP
+	// of the client truncated to ECSPrefixIPv4 or ECSPrefixIPv6 bits. The
+	// option is stripped for clients on private or loopback networks.
+	ECSClient
+)
+
+const (
+	// DefaultECSPrefixIPv4 is the default value for DNS ECSPrefixIPv4, as
+	// recommended by RFC7871.
+	DefaultECSPrefixIPv4 = 24
+
+	// DefaultECSPrefixIPv6 is the default value for DNS ECSPrefixIPv6, as
+	// recommended by RFC7871.
+	DefaultECSPrefixIPv6 = 56
+)
+
+// rewriteECS returns the payload of q with its EDNS Client Subnet option
+// rewritten as defined by ECSMode.
+func (r *DNS) rewriteECS(q query.Query) ([]byte, error) {
+	var subnet *net.IPNet
+	switch r.ECSMode {
+	case ECSPassthrough:
+		return q.Payload, nil
+	case ECSOverride:
+		subnet = r.ECSSubnet
+	case ECSClient:
+		subnet = r.clientSubnet(q.PeerIP)
+	}
+	return setClientSubnet(q.Payload, subnet)
+}
+
+// clientSubnet returns the subnet of ip sent with ECSClient, or nil if ip is
+// not a public address.
+func (r *DNS) clientSubnet(ip net.IP) *net.IPNet {
+	if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() || isPrivateIP(ip) {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		bits := r.ECSPrefixIPv4
+		if bits == 0 {
+			bits = DefaultECSPrefixIPv4
+		}
+		mask := net.CIDRMask(bits, 32)
+		return &net.IPNet{IP: ip4.Mask(mask), Mask: mask}
+	}
+	bits := r.ECSPrefixIPv6
+	if bits == 0 {
+		bits = DefaultECSPrefixIPv6
+	}
+	mask := net.CIDRMask(bits, 128)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// isPrivateIP returns true if ip is in a private range as defined by RFC1918
+// for IPv4 or RFC4193 for IPv6.
+func isPrivateIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4[0] == 10 ||
+			(ip4[0] == 172 && ip4[1]&0xf0 == 16) ||
+			(ip4[0] == 192 && ip4[1] == 168)
+	}
+	return len(ip) == net.IPv6len && ip[0]&0xfe == 0xfc
+}
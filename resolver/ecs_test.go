@@ -0,0 +1,67 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nextdns/nextdns/resolver/endpoint"
+	"github.com/nextdns/nextdns/resolver/query"
+)
+
+func TestDNS_clientSubnet(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"203.0.113.42", "203.0.113.0/24"},
+		{"2001:db8:1234:5678::1", "2001:db8:1234:5600::/56"},
+		{"192.168.1.10", ""},
+		{"10.0.0.1", ""},
+		{"127.0.0.1", ""},
+		{"fd00::1", ""},
+		{"fe80::1", ""},
+	}
+	r := &DNS{ECSMode: ECSClient}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			got := r.clientSubnet(net.ParseIP(tt.ip))
+			if (got == nil && tt.want != "") || (got != nil && got.String() != tt.want) {
+				t.Errorf("clientSubnet(%s) = %v, want %q", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDNS_Resolve_ECSStrip(t *testing.T) {
+	// DoT is used to check that the policy is not limited to DoH.
+	queries := make(chan []byte, 1)
+	e, stop := startDOTServer(t, testResponse, queries)
+	defer stop()
+	defer e.Close()
+	r := &DNS{
+		ECSMode: ECSStrip,
+		Manager: &endpoint.Manager{
+			Providers: []endpoint.Provider{endpoint.StaticProvider{e}},
+			EndpointTester: func(endpoint.Endpoint) endpoint.Tester {
+				return func(ctx context.Context, testDomain string) error { return nil }
+			},
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	q := query.Query{Class: query.ClassINET, Type: query.TypeA, Name: "test.com.", Payload: ecsMessage(203, 0, 113, 24, 0)}
+	buf := make([]byte, 512)
+	if _, _, err := r.Resolve(ctx, q, buf); err != nil {
+		t.Fatalf("Resolve() err = %v", err)
+	}
+	select {
+	case msg := <-queries:
+		if o, ok := clientSubnet(msg); ok {
+			t.Errorf("query sent with client subnet %v", o.String(o.source))
+		}
+	default:
+		t.Errorf("no query received")
+	}
+}
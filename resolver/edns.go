@@ -0,0 +1,274 @@
+package resolver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/nextdns/nextdns/resolver/query"
+)
+
+// DefaultUDPPayloadSize is the default UDP payload size advertised in the OPT
+// record of DNS53 queries. 1232 is the value recommended by the DNS flag day
+// 2020: it fits the IPv6 minimum MTU (1280) minus the IPv6 and UDP headers, so
+// responses are not fragmented on common networks.
+const DefaultUDPPayloadSize = 1232
+
+// DefaultPaddingBlockSize is the block size queries are padded to, as
+// recommended by RFC8467.
+const DefaultPaddingBlockSize = 128
+
+const (
+	// edns0Subnet is the EDNS0 option code of EDNS Client Subnet.
+	edns0Subnet = 0x8
+
+	// edns0Padding is the EDNS0 option code of padding.
+	edns0Padding = 0xc
+)
+
+var errInvalidMessage = errors.New("invalid DNS message")
+
+// locateOPT returns the offset of the TYPE field of the OPT record found in
+// the additional section of msg, or -1 if msg has no OPT record.
+func locateOPT(msg []byte) (off int, err error) {
+	if len(msg) < 12 {
+		return -1, errInvalidMessage
+	}
+	questions := unpackUint16(msg[4:])
+	answers := unpackUint16(msg[6:])
+	authorities := unpackUint16(msg[8:])
+	additionals := unpackUint16(msg[10:])
+	off = 12
+	for i := questions; i > 0; i-- {
+		l := skipName(msg[off:])
+		if l == 0 {
+			return -1, errInvalidMessage
+		}
+		off += l + 4 // qtype(uint16) + qclass(uint16)
+		if off > len(msg) {
+			return -1, errInvalidMessage
+		}
+	}
+	rrCount := int(answers) + int(authorities) + int(additionals)
+	additionalsIdx := int(answers) + int(authorities)
+	for i := 0; i < rrCount; i++ {
+		if off >= len(msg) {
+			return -1, errInvalidMessage
+		}
+		l := skipName(msg[off:])
+		if l == 0 {
+			return -1, errInvalidMessage
+		}
+		off += l
+		if off+10 > len(msg) {
+			return -1, errInvalidMessage
+		}
+		if i >= additionalsIdx && query.Type(unpackUint16(msg[off:])) == query.TypeOPT {
+			return off, nil
+		}
+		off += 10 + int(unpackUint16(msg[off+8:]))
+		if off > len(msg) {
+			return -1, errInvalidMessage
+		}
+	}
+	return -1, nil
+}
+
+// setUDPPayloadSize returns a copy of msg with the UDP payload size of its OPT
+// record set to size. No OPT record is added to msg if it has none, as a
+// client not using EDNS does not expect one in the response.
+func setUDPPayloadSize(msg []byte, size uint16) ([]byte, error) {
+	off, err := locateOPT(msg)
+	if err != nil {
+		return nil, err
+	}
+	m := make([]byte, len(msg))
+	copy(m, msg)
+	if off >= 0 {
+		packUint16(m[off+2:], size)
+	}
+	return m, nil
+}
+
+// hasOPT returns true if msg has an OPT record.
+func hasOPT(msg []byte) bool {
+	off, err := locateOPT(msg)
+	return err == nil && off >= 0
+}
+
+// stripOPT removes the OPT record of msg in place and returns the new length
+// of msg. RFC6891, section 7: a response must not carry an OPT record if the
+// query had none, which happens when an option was added to the query sent
+// upstream.
+func stripOPT(msg []byte) int {
+	off, err := locateOPT(msg)
+	if err != nil || off < 1 {
+		return len(msg)
+	}
+	start := off - 1 // root label of the OPT record
+	end := off + 10 + int(unpackUint16(msg[off+8:]))
+	if end > len(msg) {
+		return len(msg)
+	}
+	n := copy(msg[start:], msg[end:])
+	packUint16(msg[10:], unpackUint16(msg[10:])-1)
+	return start + n
+}
+
+// setClientSubnet returns a copy of msg with its EDNS Client Subnet option
+// removed, or replaced by subnet if not nil. If msg has no OPT record, one is
+// added only if subnet is not nil.
+func setClientSubnet(msg []byte, subnet *net.IPNet) ([]byte, error) {
+	var ecs []byte
+	if subnet != nil {
+		ecs = packClientSubnet(subnet)
+	}
+	return rewriteOPT(msg, edns0Subnet, ecs)
+}
+
+// padMessage returns a copy of msg padded to a multiple of block bytes with
+// the EDNS0 padding option as defined by RFC7830. An existing padding option
+// is replaced, and no padding is added if msg is already aligned. An OPT
+// record is added if msg has none; DNS.Resolve strips it from the response.
+func padMessage(msg []byte, block int) ([]byte, error) {
+	m, err := rewriteOPT(msg, edns0Padding, nil)
+	if err != nil {
+		return nil, err
+	}
+	if block <= 0 || len(m)%block == 0 {
+		return m, nil
+	}
+	l := len(m) + 4 // option code and length
+	if off, _ := locateOPT(m); off < 0 {
+		l += 11 // OPT record
+	}
+	pad := (block - l%block) % block
+	opt := make([]byte, 4+pad)
+	packUint16(opt, edns0Padding)
+	packUint16(opt[2:], uint16(pad))
+	return rewriteOPT(m, edns0Padding, opt)
+}
+
+// rewriteOPT returns a copy of msg with the EDNS0 options of type code
+// removed from its OPT record, and opt, a complete option, appended if not
+// nil. If msg has no OPT record, one is added only if opt is not nil.
+func rewriteOPT(msg []byte, code uint16, opt []byte) ([]byte, error) {
+	off, err := locateOPT(msg)
+	if err != nil {
+		return nil, err
+	}
+	if off < 0 {
+		m := make([]byte, len(msg), len(msg)+11+len(opt))
+		copy(m, msg)
+		if opt == nil {
+			return m, nil
+		}
+		m = append(m,
+			0x00,       // Label <root>
+			0x00, 0x29, // Type OPT
+			byte(DefaultUDPPayloadSize>>8), byte(DefaultUDPPayloadSize&0xff), // UDP payload size
+			0x00,       // Extended RCODE
+			0x00,       // EDNS Version
+			0x00, 0x00, // Flags
+			byte(len(opt)>>8), byte(len(opt)), // Data len
+		)
+		m = append(m, opt...)
+		packUint16(m[10:], unpackUint16(m[10:])+1)
+		return m, nil
+	}
+	start := off + 10
+	end := start + int(unpackUint16(msg[off+8:]))
+	if end > len(msg) {
+		return nil, errInvalidMessage
+	}
+	m := make([]byte, start, len(msg)+len(opt))
+	copy(m, msg[:start])
+	for o := start; o < end; {
+		if o+4 > end {
+			return nil, errInvalidMessage
+		}
+		l := int(unpackUint16(msg[o+2:]))
+		if o+4+l > end {
+			return nil, errInvalidMessage
+		}
+		if unpackUint16(msg[o:]) != code {
+			m = append(m, msg[o:o+4+l]...)
+		}
+		o += 4 + l
+	}
+	m = append(m, opt...)
+	packUint16(m[off+8:], uint16(len(m)-start))
+	m = append(m, msg[end:]...)
+	return m, nil
+}
+
+// packClientSubnet returns the EDNS Client Subnet option for subnet, code and
+// length included.
+func packClientSubnet(subnet *net.IPNet) []byte {
+	family := uint16(1)
+	ip := subnet.IP.Mask(subnet.Mask)
+	ones, bits := subnet.Mask.Size()
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		if bits == 128 {
+			ones -= 96
+		}
+	} else {
+		family = 2
+	}
+	addr := ip[:(ones+7)/8]
+	b := make([]byte, 8, 8+len(addr))
+	packUint16(b, edns0Subnet)
+	packUint16(b[2:], uint16(4+len(addr)))
+	packUint16(b[4:], family)
+	b[6] = byte(ones) // source prefix length
+	b[7] = 0          // scope prefix length
+	return append(b, addr...)
+}
+
+// ecsOption is an EDNS Client Subnet option as defined by RFC7871.
+type ecsOption struct {
+	family uint16
+	source uint8
+	scope  uint8
+	addr   []byte
+}
+
+// String returns the client subnet of o masked to prefix bits.
+func (o ecsOption) String(prefix uint8) string {
+	addr := make([]byte, (int(prefix)+7)/8)
+	copy(addr, o.addr)
+	if len(addr) > 0 && prefix%8 != 0 {
+		addr[len(addr)-1] &= ^byte(0xff >> (prefix % 8))
+	}
+	return fmt.Sprintf("%d:%x/%d", o.family, addr, prefix)
+}
+
+// clientSubnet returns the EDNS Client Subnet option of msg, if any.
+func clientSubnet(msg []byte) (o ecsOption, ok bool) {
+	off, err := locateOPT(msg)
+	if err != nil || off < 0 {
+		return o, false
+	}
+	end := off + 10 + int(unpackUint16(msg[off+8:]))
+	if end > len(msg) {
+		return o, false
+	}
+	for off += 10; off+4 <= end; {
+		code := unpackUint16(msg[off:])
+		l := int(unpackUint16(msg[off+2:]))
+		off += 4
+		if off+l > end {
+			return o, false
+		}
+		if code == edns0Subnet && l >= 4 {
+			o.family = unpackUint16(msg[off:])
+			o.source = msg[off+2]
+			o.scope = msg[off+3]
+			o.addr = msg[off+4 : off+l]
+			return o, true
+		}
+		off += l
+	}
+	return o, false
+}
@@ -0,0 +1,252 @@
+package resolver
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+var (
+	testQuery = []byte{
+		0xa6, 0xed, // ID
+		0x01, 0x00, // Flags
+		0x00, 0x01, // Questions
+		0x00, 0x00, // Answers
+		0x00, 0x00, // Authorities
+		0x00, 0x00, // Additionals
+		// Questions
+		0x04, 0x74, 0x65, 0x73, 0x74, 0x03, 0x63, 0x6f, 0x6d, 0x00, // Label test.com.
+		0x00, 0x01, // Type A
+		0x00, 0x01, // Class IN
+	}
+	testQueryOPT = []byte{
+		0xa6, 0xed, // ID
+		0x01, 0x00, // Flags
+		0x00, 0x01, // Questions
+		0x00, 0x00, // Answers
+		0x00, 0x00, // Authorities
+		0x00, 0x01, // Additionals
+		// Questions
+		0x04, 0x74, 0x65, 0x73, 0x74, 0x03, 0x63, 0x6f, 0x6d, 0x00, // Label test.com.
+		0x00, 0x01, // Type A
+		0x00, 0x01, // Class IN
+		// Additionals
+		0x00,       // Label <root>
+		0x00, 0x29, // Type OPT
+		0x10, 0x00, // UDP payload size 4096
+		0x00,       // Extended RCODE
+		0x00,       // EDNS Version
+		0x00, 0x00, // Flags
+		0x00, 0x00, // Data len
+	}
+)
+
+func Test_setUDPPayloadSize(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  []byte
+		want []byte
+	}{
+		{
+			"No OPT",
+			testQuery,
+			testQuery,
+		},
+		{
+			"Update OPT",
+			testQueryOPT,
+			[]byte{
+				0xa6, 0xed, // ID
+				0x01, 0x00, // Flags
+				0x00, 0x01, // Questions
+				0x00, 0x00, // Answers
+				0x00, 0x00, // Authorities
+				0x00, 0x01, // Additionals
+				// Questions
+				0x04, 0x74, 0x65, 0x73, 0x74, 0x03, 0x63, 0x6f, 0x6d, 0x00, // Label test.com.
+				0x00, 0x01, // Type A
+				0x00, 0x01, // Class IN
+				// Additionals
+				0x00,       // Label <root>
+				0x00, 0x29, // Type OPT
+				0x04, 0xd0, // UDP payload size 1232
+				0x00,       // Extended RCODE
+				0x00,       // EDNS Version
+				0x00, 0x00, // Flags
+				0x00, 0x00, // Data len
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orig := append([]byte{}, tt.msg...)
+			got, err := setUDPPayloadSize(tt.msg, DefaultUDPPayloadSize)
+			if err != nil {
+				t.Fatalf("setUDPPayloadSize() err = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("setUDPPayloadSize()\ngot:\n%#v\nwant:\n%#v", got, tt.want)
+			}
+			if !reflect.DeepEqual(tt.msg, orig) {
+				t.Errorf("setUDPPayloadSize() modified its input")
+			}
+		})
+	}
+}
+
+func Test_stripOPT(t *testing.T) {
+	msg := append([]byte{}, testQueryOPT...)
+	if n := stripOPT(msg); !reflect.DeepEqual(msg[:n], testQuery) {
+		t.Errorf("stripOPT()\ngot:\n%#v\nwant:\n%#v", msg[:n], testQuery)
+	}
+	msg = append([]byte{}, testQuery...)
+	if n := stripOPT(msg); !reflect.DeepEqual(msg[:n], testQuery) {
+		t.Errorf("stripOPT() modified a message without OPT")
+	}
+}
+
+func Test_setClientSubnet(t *testing.T) {
+	testQueryECS := []byte{
+		0xa6, 0xed, // ID
+		0x01, 0x00, // Flags
+		0x00, 0x01, // Questions
+		0x00, 0x00, // Answers
+		0x00, 0x00, // Authorities
+		0x00, 0x01, // Additionals
+		// Questions
+		0x04, 0x74, 0x65, 0x73, 0x74, 0x03, 0x63, 0x6f, 0x6d, 0x00, // Label test.com.
+		0x00, 0x01, // Type A
+		0x00, 0x01, // Class IN
+		// Additionals
+		0x00,       // Label <root>
+		0x00, 0x29, // Type OPT
+		0x10, 0x00, // UDP payload size 4096
+		0x00,       // Extended RCODE
+		0x00,       // EDNS Version
+		0x00, 0x00, // Flags
+		0x00, 0x0b, // Data len
+		0x00, 0x08, // Option ECS
+		0x00, 0x07, // Option len
+		0x00, 0x01, // Family IPv4
+		0x18,             // Source prefix 24
+		0x00,             // Scope prefix 0
+		0x01, 0x02, 0x03, // 1.2.3.0
+	}
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/8")
+	tests := []struct {
+		name   string
+		msg    []byte
+		subnet *net.IPNet
+		want   []byte
+	}{
+		{"Strip", testQueryECS, nil, testQueryOPT},
+		{"StripNoOPT", testQuery, nil, testQuery},
+		{
+			"Override",
+			testQueryECS,
+			subnet,
+			[]byte{
+				0xa6, 0xed, // ID
+				0x01, 0x00, // Flags
+				0x00, 0x01, // Questions
+				0x00, 0x00, // Answers
+				0x00, 0x00, // Authorities
+				0x00, 0x01, // Additionals
+				// Questions
+				0x04, 0x74, 0x65, 0x73, 0x74, 0x03, 0x63, 0x6f, 0x6d, 0x00, // Label test.com.
+				0x00, 0x01, // Type A
+				0x00, 0x01, // Class IN
+				// Additionals
+				0x00,       // Label <root>
+				0x00, 0x29, // Type OPT
+				0x10, 0x00, // UDP payload size 4096
+				0x00,       // Extended RCODE
+				0x00,       // EDNS Version
+				0x00, 0x00, // Flags
+				0x00, 0x09, // Data len
+				0x00, 0x08, // Option ECS
+				0x00, 0x05, // Option len
+				0x00, 0x01, // Family IPv4
+				0x08, // Source prefix 8
+				0x00, // Scope prefix 0
+				0x0a, // 10.0.0.0
+			},
+		},
+		{
+			"OverrideNoOPT",
+			testQuery,
+			subnet,
+			[]byte{
+				0xa6, 0xed, // ID
+				0x01, 0x00, // Flags
+				0x00, 0x01, // Questions
+				0x00, 0x00, // Answers
+				0x00, 0x00, // Authorities
+				0x00, 0x01, // Additionals
+				// Questions
+				0x04, 0x74, 0x65, 0x73, 0x74, 0x03, 0x63, 0x6f, 0x6d, 0x00, // Label test.com.
+				0x00, 0x01, // Type A
+				0x00, 0x01, // Class IN
+				// Additionals
+				0x00,       // Label <root>
+				0x00, 0x29, // Type OPT
+				0x04, 0xd0, // UDP payload size 1232
+				0x00,       // Extended RCODE
+				0x00,       // EDNS Version
+				0x00, 0x00, // Flags
+				0x00, 0x09, // Data len
+				0x00, 0x08, // Option ECS
+				0x00, 0x05, // Option len
+				0x00, 0x01, // Family IPv4
+				0x08, // Source prefix 8
+				0x00, // Scope prefix 0
+				0x0a, // 10.0.0.0
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orig := append([]byte{}, tt.msg...)
+			got, err := setClientSubnet(tt.msg, tt.subnet)
+			if err != nil {
+				t.Fatalf("setClientSubnet() err = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("setClientSubnet()\ngot:\n%#v\nwant:\n%#v", got, tt.want)
+			}
+			if !reflect.DeepEqual(tt.msg, orig) {
+				t.Errorf("setClientSubnet() modified its input")
+			}
+		})
+	}
+}
+
+func Test_padMessage(t *testing.T) {
+	for _, msg := range [][]byte{testQuery, testQueryOPT} {
+		for _, block := range []int{16, DefaultPaddingBlockSize} {
+			got, err := padMessage(msg, block)
+			if err != nil {
+				t.Fatalf("padMessage() err = %v", err)
+			}
+			if len(got)%block != 0 {
+				t.Errorf("padMessage(%d bytes, %d) = %d bytes, not aligned", len(msg), block, len(got))
+			}
+			// Padding again must not change anything.
+			again, err := padMessage(got, block)
+			if err != nil {
+				t.Fatalf("padMessage() err = %v", err)
+			}
+			if !reflect.DeepEqual(again, got) {
+				t.Errorf("padMessage() of a padded message changed it")
+			}
+			if _, err := locateOPT(got); err != nil {
+				t.Errorf("padMessage() returned an invalid message: %v", err)
+			}
+		}
+	}
+	// An aligned message without padding is left as is.
+	aligned := append([]byte{}, testQueryOPT...)
+	if got, _ := padMessage(aligned, len(aligned)); !reflect.DeepEqual(got, aligned) {
+		t.Errorf("padMessage() padded an aligned message")
+	}
+}
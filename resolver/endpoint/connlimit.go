@@ -0,0 +1,143 @@
+package endpoint
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrMaxConns is returned when a new connection would exceed the limit set
+// with SetMaxConns and no idle connection could be closed to make room.
+var ErrMaxConns = errors.New("too many open connections")
+
+// conns tracks the DoH and DoT connections opened by all the endpoints.
+var conns = &connLimiter{}
+
+// SetMaxConns sets the maximum number of DoH and DoT connections open at once
+// by all the endpoints, so many endpoints cannot exhaust the file descriptors
+// of constrained systems. When the limit is reached, the idle connections of
+// the least recently used endpoints are closed to make room for a new one. If
+// n is zero, the default, connections are not limited.
+func SetMaxConns(n int) {
+	conns.mu.Lock()
+	conns.max = n
+	conns.mu.Unlock()
+}
+
+// MaxConns returns the limit set with SetMaxConns.
+func MaxConns() int {
+	conns.mu.Lock()
+	defer conns.mu.Unlock()
+	return conns.max
+}
+
+// OpenConns returns the number of DoH and DoT connections currently open by
+// all the endpoints.
+func OpenConns() int {
+	conns.mu.Lock()
+	defer conns.mu.Unlock()
+	return conns.open
+}
+
+// idleCloser is an endpoint able to close its idle connections.
+type idleCloser interface {
+	CloseIdleConnections()
+}
+
+type connLimiter struct {
+	mu       sync.Mutex
+	max      int
+	open     int
+	lastUsed map[idleCloser]time.Time
+}
+
+// touch records that owner is used, for LRU eviction.
+func (l *connLimiter) touch(owner idleCloser) {
+	l.mu.Lock()
+	l.touchLocked(owner)
+	l.mu.Unlock()
+}
+
+func (l *connLimiter) touchLocked(owner idleCloser) {
+	if l.lastUsed == nil {
+		l.lastUsed = map[idleCloser]time.Time{}
+	}
+	l.lastUsed[owner] = time.Now()
+}
+
+// forget stops tracking owner until it is used again.
+func (l *connLimiter) forget(owner idleCloser) {
+	l.mu.Lock()
+	delete(l.lastUsed, owner)
+	l.mu.Unlock()
+}
+
+// acquire reserves a connection slot for owner. When the limit is reached,
+// the idle connections of the other owners are closed, least recently used
+// first, then those of owner, until a slot is freed. ErrMaxConns is returned
+// if none is. A reserved slot must be returned with release.
+func (l *connLimiter) acquire(owner idleCloser) error {
+	l.mu.Lock()
+	l.touchLocked(owner)
+	if l.tryAcquireLocked() {
+		l.mu.Unlock()
+		return nil
+	}
+	owners := make([]idleCloser, 0, len(l.lastUsed))
+	for o := range l.lastUsed {
+		if o != owner {
+			owners = append(owners, o)
+		}
+	}
+	sort.Slice(owners, func(i, j int) bool {
+		return l.lastUsed[owners[i]].Before(l.lastUsed[owners[j]])
+	})
+	owners = append(owners, owner)
+	l.mu.Unlock()
+
+	for _, o := range owners {
+		// Closing connections calls release, so the lock must not be held.
+		o.CloseIdleConnections()
+		l.mu.Lock()
+		ok := l.tryAcquireLocked()
+		l.mu.Unlock()
+		if ok {
+			return nil
+		}
+	}
+	return ErrMaxConns
+}
+
+func (l *connLimiter) tryAcquireLocked() bool {
+	if l.max > 0 && l.open >= l.max {
+		return false
+	}
+	l.open++
+	return true
+}
+
+// release returns a slot reserved with acquire.
+func (l *connLimiter) release() {
+	l.mu.Lock()
+	l.open--
+	l.mu.Unlock()
+}
+
+// track returns c releasing its slot once closed.
+func (l *connLimiter) track(c net.Conn) net.Conn {
+	return &limitedConn{Conn: c, l: l}
+}
+
+// limitedConn is a net.Conn releasing its connLimiter slot on Close.
+type limitedConn struct {
+	net.Conn
+	l    *connLimiter
+	once sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.l.release)
+	return c.Conn.Close()
+}
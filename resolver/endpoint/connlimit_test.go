@@ -0,0 +1,47 @@
+package endpoint
+
+import (
+	"testing"
+)
+
+// fakeOwner holds idle connection slots of a connLimiter.
+type fakeOwner struct {
+	l      *connLimiter
+	idle   int
+	closed int
+}
+
+func (o *fakeOwner) CloseIdleConnections() {
+	for ; o.idle > 0; o.idle-- {
+		o.closed++
+		o.l.release()
+	}
+}
+
+func TestConnLimiter_acquire(t *testing.T) {
+	l := &connLimiter{max: 2}
+	o1, o2, o3 := &fakeOwner{l: l}, &fakeOwner{l: l}, &fakeOwner{l: l}
+	for _, o := range []*fakeOwner{o1, o2} {
+		if err := l.acquire(o); err != nil {
+			t.Fatalf("acquire() = %v", err)
+		}
+		o.idle++
+	}
+	o2.idle-- // in use
+
+	// The idle connection of the least recently used owner is closed.
+	if err := l.acquire(o3); err != nil {
+		t.Fatalf("acquire() = %v", err)
+	}
+	if o1.closed != 1 || o2.closed != 0 {
+		t.Errorf("closed = %d, %d, want 1, 0", o1.closed, o2.closed)
+	}
+
+	// No idle connection is left to close.
+	if err := l.acquire(o1); err != ErrMaxConns {
+		t.Errorf("acquire() = %v, want %v", err, ErrMaxConns)
+	}
+	if l.open != 2 {
+		t.Errorf("open = %d, want 2", l.open)
+	}
+}
@@ -2,16 +2,164 @@ package endpoint
 
 import (
 	"context"
+	"errors"
 	"net"
+	"sync"
+	"time"
 )
 
+// ErrNoUsableBootstrap is returned when all the bootstrap IPs of an endpoint
+// are IPv6 and the host has no IPv6 connectivity.
+var ErrNoUsableBootstrap = errors.New("no usable bootstrap IP")
+
+// ipv6RouteTTL is the duration the result of hasIPv6Route is cached, so
+// routing changes are picked up without probing on every dial.
+const ipv6RouteTTL = 30 * time.Second
+
+var ipv6Route struct {
+	mu     sync.Mutex
+	ok     bool
+	expire time.Time
+}
+
+// hasIPv6Route reports whether the host has a route to reach IPv6 internet.
+// The result of probeIPv6Route is cached for ipv6RouteTTL.
+var hasIPv6Route = func() bool {
+	ipv6Route.mu.Lock()
+	defer ipv6Route.mu.Unlock()
+	if now := time.Now(); now.After(ipv6Route.expire) {
+		ipv6Route.ok = probeIPv6Route()
+		ipv6Route.expire = now.Add(ipv6RouteTTL)
+	}
+	return ipv6Route.ok
+}
+
+// probeIPv6Route connects a UDP socket to an IPv6 address. It does not send
+// any packet but fails immediately if no route exists.
+var probeIPv6Route = func() bool {
+	c, err := net.Dial("udp6", "[2a07:a8c0::]:53")
+	if err != nil {
+		return false
+	}
+	c.Close()
+	return true
+}
+
+// AddressFamily defines which Bootstrap IPs are used, and in which order.
+type AddressFamily int
+
+const (
+	// AddressFamilyAuto uses all Bootstrap IPs in their original order.
+	AddressFamilyAuto AddressFamily = iota
+
+	// AddressFamilyPreferIPv4 uses IPv4 Bootstrap IPs first.
+	AddressFamilyPreferIPv4
+
+	// AddressFamilyPreferIPv6 uses IPv6 Bootstrap IPs first.
+	AddressFamilyPreferIPv6
+
+	// AddressFamilyIPv4Only only uses IPv4 Bootstrap IPs.
+	AddressFamilyIPv4Only
+
+	// AddressFamilyIPv6Only only uses IPv6 Bootstrap IPs.
+	AddressFamilyIPv6Only
+)
+
+// filter returns ips reordered or filtered according to f. The relative order
+// of IPs of the same family is preserved.
+func (f AddressFamily) filter(ips []string) []string {
+	if f == AddressFamilyAuto {
+		return ips
+	}
+	var v4, v6 []string
+	for _, ip := range ips {
+		if isIPv6(ip) {
+			v6 = append(v6, ip)
+		} else {
+			v4 = append(v4, ip)
+		}
+	}
+	switch f {
+	case AddressFamilyPreferIPv4:
+		return append(v4, v6...)
+	case AddressFamilyPreferIPv6:
+		return append(v6, v4...)
+	case AddressFamilyIPv4Only:
+		return v4
+	case AddressFamilyIPv6Only:
+		return v6
+	}
+	return ips
+}
+
+// isIPv6 returns true if ip is an IPv6 address. IPv4-mapped IPv6 addresses are
+// considered IPv4.
+func isIPv6(ip string) bool {
+	i := net.ParseIP(ip)
+	return i != nil && i.To4() == nil
+}
+
+// allIPv6 returns true if all addrs are IPv6 host:port addresses.
+func allIPv6(addrs []string) bool {
+	if len(addrs) == 0 {
+		return false
+	}
+	for _, addr := range addrs {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return false
+		}
+		if !isIPv6(host) {
+			return false
+		}
+	}
+	return true
+}
+
 type parallelDialer struct {
 	net.Dialer
+
+	// Stagger is the delay to wait before dialing the next address while the
+	// previous attempts are still pending. An address is also dialed as soon
+	// as the previous attempt failed. If zero, all addresses are dialed at
+	// once.
+	Stagger time.Duration
+
+	// DialFunc, if set, is used to establish connections in place of the
+	// embedded net.Dialer. The net.Dialer Timeout still applies.
+	DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// OnDialError, if set, is called by DialParallel with each failed
+	// connection attempt.
+	OnDialError func(addr string, err error)
+
+	// OnFailover, if set, is called by DialParallel when the returned
+	// connection is not to the first address.
+	OnFailover func()
 }
 
+// dial connects to addr using DialFunc if set, or the embedded net.Dialer.
+func (d *parallelDialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.DialFunc != nil {
+		if d.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+			defer cancel()
+		}
+		return d.DialFunc(ctx, network, addr)
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+// DialParallel dials addrs in parallel and returns the first established
+// connection, closing the others.
 func (d *parallelDialer) DialParallel(ctx context.Context, network string, addrs []string) (net.Conn, error) {
 	if len(addrs) == 1 {
-		return d.DialContext(ctx, network, addrs[0])
+		c, err := d.dial(ctx, network, addrs[0])
+		if err != nil && d.OnDialError != nil {
+			d.OnDialError(addrs[0], err)
+		}
+		return c, err
 	}
 	returned := make(chan struct{})
 	defer close(returned)
@@ -19,13 +167,14 @@ func (d *parallelDialer) DialParallel(ctx context.Context, network string, addrs
 	type dialResult struct {
 		net.Conn
 		error
+		addr string
 	}
 	results := make(chan dialResult)
 
 	racer := func(addr string) {
-		c, err := d.DialContext(ctx, network, addr)
+		c, err := d.dial(ctx, network, addr)
 		select {
-		case results <- dialResult{Conn: c, error: err}:
+		case results <- dialResult{Conn: c, error: err, addr: addr}:
 		case <-returned:
 			if c != nil {
 				c.Close()
@@ -33,17 +182,63 @@ func (d *parallelDialer) DialParallel(ctx context.Context, network string, addrs
 		}
 	}
 
-	for _, addr := range addrs {
-		go racer(addr)
+	next, pending := 0, 0
+	var stagger <-chan time.Time
+	launch := func() {
+		go racer(addrs[next])
+		next++
+		pending++
+		stagger = nil
+		if next < len(addrs) && d.Stagger > 0 {
+			stagger = time.After(d.Stagger)
+		}
+	}
+	launch()
+	for d.Stagger <= 0 && next < len(addrs) {
+		launch()
 	}
 
 	var err error
-	for range addrs {
-		res := <-results
-		if res.error == nil {
-			return res.Conn, nil
+	for {
+		select {
+		case res := <-results:
+			pending--
+			if res.error == nil {
+				if res.addr != addrs[0] && d.OnFailover != nil {
+					d.OnFailover()
+				}
+				return res.Conn, nil
+			}
+			err = res.error
+			if d.OnDialError != nil {
+				d.OnDialError(res.addr, err)
+			}
+			if next < len(addrs) {
+				launch()
+			} else if pending == 0 {
+				return nil, err
+			}
+		case <-stagger:
+			launch()
 		}
-		err = res.error
 	}
-	return nil, err
+}
+
+// countingConn is a net.Conn reporting the number of bytes read and written
+// to add.
+type countingConn struct {
+	net.Conn
+	add func(sent, received int)
+}
+
+func (c countingConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	c.add(0, n)
+	return n, err
+}
+
+func (c countingConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	c.add(n, 0)
+	return n, err
 }
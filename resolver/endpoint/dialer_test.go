@@ -0,0 +1,226 @@
+package endpoint
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParallelDialer_DialParallel_Refused(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	// Get an address refusing connections.
+	rl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := rl.Addr().String()
+	rl.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	d := &parallelDialer{}
+	c, err := d.DialParallel(ctx, "tcp", []string{refused, l.Addr().String()})
+	if err != nil {
+		t.Fatalf("DialParallel() err = %v", err)
+	}
+	defer c.Close()
+	if got, want := c.RemoteAddr().String(), l.Addr().String(); got != want {
+		t.Errorf("DialParallel() connected to %s, want %s", got, want)
+	}
+}
+
+func TestParallelDialer_DialParallel_Stagger(t *testing.T) {
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		addrs = append(addrs, l.Addr().String())
+	}
+	hanging := addrs[0]
+	release := make(chan struct{})
+	defer close(release)
+	d := &parallelDialer{Stagger: 50 * time.Millisecond}
+	d.Control = func(network, address string, c syscall.RawConn) error {
+		if address == hanging {
+			<-release
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	start := time.Now()
+	c, err := d.DialParallel(ctx, "tcp", addrs)
+	if err != nil {
+		t.Fatalf("DialParallel() err = %v", err)
+	}
+	defer c.Close()
+	if got, want := c.RemoteAddr().String(), addrs[1]; got != want {
+		t.Errorf("DialParallel() connected to %s, want %s", got, want)
+	}
+	if elapsed := time.Since(start); elapsed < d.Stagger {
+		t.Errorf("DialParallel() connected after %v, before the %v stagger", elapsed, d.Stagger)
+	}
+
+	// With a long stagger, a responsive first address wins.
+	d = &parallelDialer{Stagger: time.Hour}
+	c2, err := d.DialParallel(ctx, "tcp", addrs)
+	if err != nil {
+		t.Fatalf("DialParallel() err = %v", err)
+	}
+	defer c2.Close()
+	if got, want := c2.RemoteAddr().String(), addrs[0]; got != want {
+		t.Errorf("DialParallel() connected to %s, want %s", got, want)
+	}
+}
+
+func TestParallelDialer_DialParallel_Deadline(t *testing.T) {
+	start := time.Now()
+	deadline := start.Add(300 * time.Millisecond)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	var mu sync.Mutex
+	dials := map[string]time.Time{} // dial start per address
+	d := &parallelDialer{Stagger: 50 * time.Millisecond}
+	d.Control = func(network, address string, c syscall.RawConn) error {
+		mu.Lock()
+		dials[address] = time.Now()
+		mu.Unlock()
+		<-ctx.Done() // both IPs are too slow to answer
+		return ctx.Err()
+	}
+	c, err := d.DialParallel(ctx, "tcp", []string{"192.0.2.1:443", "192.0.2.2:443"})
+	if err == nil {
+		c.Close()
+		t.Fatal("DialParallel() err = nil")
+	}
+	// All the attempts share the caller deadline: the total time is bounded
+	// by it, not by the number of IPs.
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("DialParallel() took %v, want about 300ms", elapsed)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(dials) != 2 {
+		t.Fatalf("dialed %v, want both addresses", dials)
+	}
+	for addr, d := range dials {
+		if d.After(deadline) {
+			t.Errorf("dial %s started after the deadline", addr)
+		}
+	}
+}
+
+func TestTransport_NoUsableBootstrap(t *testing.T) {
+	defer func(orig func() bool) { hasIPv6Route = orig }(hasIPv6Route)
+	hasIPv6Route = func() bool { return false }
+
+	tr := newTransport(&DOHEndpoint{Hostname: "a", Bootstrap: []string{"2a07:a8c0::", "2a07:a8c1::"}})
+	dial := tr.RoundTripper.(*http.Transport).DialContext
+	if _, err := dial(context.Background(), "tcp", "a:443"); err != ErrNoUsableBootstrap {
+		t.Errorf("DialContext() err = %v, want %v", err, ErrNoUsableBootstrap)
+	}
+}
+
+func Test_hasIPv6Route(t *testing.T) {
+	defer func(orig func() bool) { probeIPv6Route = orig }(probeIPv6Route)
+	probes := 0
+	probeIPv6Route = func() bool {
+		probes++
+		return true
+	}
+	ipv6Route.expire = time.Time{}
+	for i := 0; i < 3; i++ {
+		if !hasIPv6Route() {
+			t.Errorf("hasIPv6Route() = false, want true")
+		}
+	}
+	if probes != 1 {
+		t.Errorf("probed %d times, want 1", probes)
+	}
+
+	// The route is probed again once the result expired.
+	ipv6Route.expire = time.Now().Add(-time.Second)
+	hasIPv6Route()
+	if probes != 2 {
+		t.Errorf("probed %d times, want 2", probes)
+	}
+}
+
+func Test_allIPv6(t *testing.T) {
+	tests := []struct {
+		addrs []string
+		want  bool
+	}{
+		{nil, false},
+		{[]string{"[2a07:a8c0::]:443"}, true},
+		{[]string{"[2a07:a8c0::]:443", "45.90.28.0:443"}, false},
+		{[]string{"[::ffff:45.90.28.0]:443"}, false},
+	}
+	for _, tt := range tests {
+		if got := allIPv6(tt.addrs); got != tt.want {
+			t.Errorf("allIPv6(%v) = %v, want %v", tt.addrs, got, tt.want)
+		}
+	}
+}
+
+func TestAddressFamily_filter(t *testing.T) {
+	ips := []string{"45.90.28.0", "2a07:a8c0::", "45.90.30.0", "::ffff:45.90.28.1", "2a07:a8c1::"}
+	tests := []struct {
+		f    AddressFamily
+		want []string
+	}{
+		{AddressFamilyAuto, ips},
+		{AddressFamilyPreferIPv4, []string{"45.90.28.0", "45.90.30.0", "::ffff:45.90.28.1", "2a07:a8c0::", "2a07:a8c1::"}},
+		{AddressFamilyPreferIPv6, []string{"2a07:a8c0::", "2a07:a8c1::", "45.90.28.0", "45.90.30.0", "::ffff:45.90.28.1"}},
+		{AddressFamilyIPv4Only, []string{"45.90.28.0", "45.90.30.0", "::ffff:45.90.28.1"}},
+		{AddressFamilyIPv6Only, []string{"2a07:a8c0::", "2a07:a8c1::"}},
+	}
+	for _, tt := range tests {
+		if got := tt.f.filter(ips); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("AddressFamily(%d).filter() = %v, want %v", tt.f, got, tt.want)
+		}
+	}
+}
+
+func TestTransport_AddressFamily(t *testing.T) {
+	tr := newTransport(&DOHEndpoint{
+		Hostname:      "a",
+		Bootstrap:     []string{"45.90.28.0", "2a07:a8c0::"},
+		AddressFamily: AddressFamilyPreferIPv6,
+	})
+	if got, want := tr.addr, "[2a07:a8c0::]:443"; got != want {
+		t.Errorf("transport addr = %s, want %s", got, want)
+	}
+
+	tr = newTransport(&DOHEndpoint{
+		Hostname:      "a",
+		Bootstrap:     []string{"2a07:a8c0::"},
+		AddressFamily: AddressFamilyIPv4Only,
+	})
+	dial := tr.RoundTripper.(*http.Transport).DialContext
+	if _, err := dial(context.Background(), "tcp", "a:443"); err != ErrNoUsableBootstrap {
+		t.Errorf("DialContext() err = %v, want %v", err, ErrNoUsableBootstrap)
+	}
+}
@@ -29,25 +29,9 @@ func (e *DNSEndpoint) String() string {
 }
 
 func (e *DNSEndpoint) Test(ctx context.Context, testDomain string) error {
-	buf := make([]byte, 0, 514)
-	b := dnsmessage.NewBuilder(buf, dnsmessage.Header{
-		RecursionDesired: true,
-	})
-	err := b.StartQuestions()
+	buf, err := testQuery(testDomain)
 	if err != nil {
-		return fmt.Errorf("start question: %v", err)
-	}
-	err = b.Question(dnsmessage.Question{
-		Class: dnsmessage.ClassINET,
-		Type:  dnsmessage.TypeA,
-		Name:  dnsmessage.MustNewName(testDomain),
-	})
-	if err != nil {
-		return fmt.Errorf("question: %v", err)
-	}
-	buf, err = b.Finish()
-	if err != nil {
-		return fmt.Errorf("finish: %v", err)
+		return err
 	}
 	d := &net.Dialer{}
 	c, err := d.DialContext(ctx, "udp", e.Addr)
@@ -68,3 +52,28 @@ func (e *DNSEndpoint) Test(ctx context.Context, testDomain string) error {
 	}
 	return nil
 }
+
+// testQuery returns an A query for testDomain.
+func testQuery(testDomain string) ([]byte, error) {
+	buf := make([]byte, 0, 514)
+	b := dnsmessage.NewBuilder(buf, dnsmessage.Header{
+		RecursionDesired: true,
+	})
+	err := b.StartQuestions()
+	if err != nil {
+		return nil, fmt.Errorf("start question: %v", err)
+	}
+	err = b.Question(dnsmessage.Question{
+		Class: dnsmessage.ClassINET,
+		Type:  dnsmessage.TypeA,
+		Name:  dnsmessage.MustNewName(testDomain),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("question: %v", err)
+	}
+	buf, err = b.Finish()
+	if err != nil {
+		return nil, fmt.Errorf("finish: %v", err)
+	}
+	return buf, nil
+}
@@ -1,15 +1,43 @@
 package endpoint
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// StatusError is returned when a DoH server replies with a non 200 status.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("error code: %d", e.StatusCode)
+}
+
+// ErrPinMismatch is returned when none of the certificates of the verified
+// chains of the DoH server matches PinnedSPKI.
+var ErrPinMismatch = errors.New("certificate does not match pinned public keys")
+
+// ErrDataCapExceeded is returned by RoundTrip when the data cap of the
+// endpoint is reached.
+var ErrDataCapExceeded = errors.New("data cap exceeded")
+
 type ClientInfo struct {
 	ID    string
 	IP    string
@@ -32,22 +60,264 @@ type DOHEndpoint struct {
 	// used.
 	Bootstrap []string `json:"ips"`
 
-	once      sync.Once
-	transport http.RoundTripper
-	onConnect func(*ConnectInfo)
+	// AddressFamily defines which Bootstrap IPs are used, and in which order.
+	// The default uses them all, in order.
+	AddressFamily AddressFamily `json:"-"`
+
+	// DialStagger is the delay between connection attempts to successive
+	// Bootstrap IPs, in order, when the previous attempts are still pending.
+	// If zero, all Bootstrap IPs are dialed at once.
+	DialStagger time.Duration `json:"-"`
+
+	// DialContext, if set, is used to establish the TCP connections to the DoH
+	// server, for instance to bind them to a specific interface or route them
+	// through a tunnel. It is called with each Bootstrap IP, or with Hostname
+	// if no Bootstrap is provided.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error) `json:"-"`
+
+	// Proxy, if set, returns the HTTP proxy to use to reach the DoH server as
+	// for http.Transport. Connections are tunneled with CONNECT to the first
+	// Bootstrap IP, or to Hostname if no Bootstrap is provided; other
+	// Bootstrap IPs are not tried.
+	Proxy func(*http.Request) (*url.URL, error) `json:"-"`
+
+	// DialTimeout, if not zero, is the maximum time allowed to connect to each
+	// Bootstrap IP, and then to complete the TLS handshake. It lets a dead IP
+	// be abandoned quickly without limiting the time to read a response.
+	DialTimeout time.Duration `json:"-"`
+
+	// IdleConnTimeout, if not zero, is the time after which an idle
+	// connection to the DoH server is closed. If zero, idle connections are
+	// kept until the server closes them.
+	IdleConnTimeout time.Duration `json:"-"`
+
+	// KeepAlive is the TCP keep-alive period of connections to the DoH
+	// server. If zero, the net.Dialer default is used. If negative, keep-alive
+	// probes are disabled.
+	KeepAlive time.Duration `json:"-"`
+
+	// TransportWrapper is an optional function called once with the transport
+	// created for this endpoint. The returned http.RoundTripper is used in
+	// place of it, allowing to decorate the transport with instrumentation.
+	TransportWrapper func(http.RoundTripper) http.RoundTripper `json:"-"`
+
+	// DataCap is the maximum number of bytes the endpoint is allowed to send
+	// and receive, TLS overhead included. Once reached, RoundTrip returns
+	// ErrDataCapExceeded until ResetDataCounters is called. If zero, data usage
+	// is not capped.
+	DataCap uint64 `json:"-"`
+
+	// RootCAs defines the set of root certificate authorities used to verify
+	// the DoH server certificate. If nil, the host's root CA set is used.
+	RootCAs *x509.CertPool `json:"-"`
+
+	// PinnedSPKI is an optional list of SHA-256 hashes of SubjectPublicKeyInfo.
+	// If set, the TLS handshake fails with ErrPinMismatch unless a
+	// certificate of a verified chain of the server matches one of them.
+	// Pinning is in addition to the regular certificate verification.
+	PinnedSPKI [][]byte `json:"-"`
+
+	// TLSConfig is an optional base TLS configuration to use with the DoH
+	// server, for instance to set client certificates or a custom
+	// verification. It is cloned and never modified: ServerName is always set
+	// to Hostname, and RootCAs is replaced by the RootCAs field if not nil.
+	TLSConfig *tls.Config `json:"-"`
+
+	// OnRequest is called after each request sent with RoundTrip, including
+	// retries, to report its outcome.
+	OnRequest func(RequestInfo) `json:"-"`
+
+	// OnConnect is called each time a new connection is established with the
+	// DoH server, in addition to the Manager OnConnect callback if any.
+	OnConnect func(*ConnectInfo) `json:"-"`
+
+	transportMu sync.Mutex // protects transport and wrapped
+	transport   http.RoundTripper
+	wrapped     bool // transport is ready to be used by RoundTrip
+
+	countersOnce sync.Once
+	counters     *dohCounters
+
+	mu          sync.Mutex // protects the fields below
+	onConnect   func(*ConnectInfo)
+	lastConnect *ConnectInfo
+}
+
+// dohCounters are the counters of a DOHEndpoint, updated atomically. It is
+// allocated separately so its uint64 fields are 64-bit aligned on 32-bit
+// platforms.
+type dohCounters struct {
+	requests      uint64
+	errors        uint64
+	http1         uint64
+	http2         uint64
+	retries       uint64
+	failovers     uint64
+	bytesSent     uint64
+	bytesReceived uint64
+	connections   sync.Map // address -> *uint64
+	dialErrors    sync.Map // address -> *uint64
+}
+
+// RequestInfo describes the outcome of a request sent to a DoH server.
+type RequestInfo struct {
+	// StatusCode is the HTTP status of the response, or 0 if Error is set.
+	StatusCode int
+
+	// Protocol is the HTTP protocol of the response, like HTTP/2.0.
+	Protocol string
+
+	// Duration is the time until the response headers were received.
+	Duration time.Duration
+
+	// Error is the error returned by RoundTrip, if any.
+	Error error
+}
+
+// Stats is a snapshot of the counters of a DOHEndpoint.
+type Stats struct {
+	// Requests is the number of requests sent with RoundTrip.
+	Requests uint64 `json:"requests"`
+
+	// Errors is the number of requests for which RoundTrip returned an error.
+	Errors uint64 `json:"errors"`
+
+	// HTTP1Requests and HTTP2Requests are the number of responses received
+	// over HTTP/1.x and HTTP/2.
+	HTTP1Requests uint64 `json:"http1_requests"`
+	HTTP2Requests uint64 `json:"http2_requests"`
+
+	// Retries is the number of requests sent with a context marked by
+	// WithRetry.
+	Retries uint64 `json:"retries"`
+
+	// Failovers is the number of connections established with a Bootstrap IP
+	// other than the first one, because the previous ones failed or were too
+	// slow to connect.
+	Failovers uint64 `json:"failovers"`
+
+	// Connections is the number of connections successfully established per
+	// server address.
+	Connections map[string]uint64 `json:"connections"`
+
+	// DialErrors is the number of failed connection attempts per server
+	// address.
+	DialErrors map[string]uint64 `json:"dial_errors"`
+
+	// BytesSent and BytesReceived are the data usage as returned by DataUsage.
+	BytesSent     uint64 `json:"bytes_sent"`
+	BytesReceived uint64 `json:"bytes_received"`
+}
+
+type retryKey struct{}
+
+// WithRetry returns a copy of ctx marking a request as the retry of a
+// previous one, so it is counted in Stats Retries.
+func WithRetry(ctx context.Context) context.Context {
+	return context.WithValue(ctx, retryKey{}, true)
+}
+
+// setOnConnect sets the function called by RoundTrip on new connections. It
+// can be called while the endpoint is in use.
+func (e *DOHEndpoint) setOnConnect(f func(*ConnectInfo)) {
+	e.mu.Lock()
+	e.onConnect = f
+	e.mu.Unlock()
+}
+
+// tlsConfig returns the TLS configuration to use to connect to e.
+func (e *DOHEndpoint) tlsConfig() *tls.Config {
+	c := &tls.Config{}
+	if e.TLSConfig != nil {
+		c = e.TLSConfig.Clone()
+	}
+	c.ServerName = e.Hostname
+	if e.RootCAs != nil {
+		c.RootCAs = e.RootCAs
+	}
+	if len(e.PinnedSPKI) != 0 {
+		verify := c.VerifyPeerCertificate
+		pins := e.PinnedSPKI
+		c.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+			if verify != nil {
+				if err := verify(rawCerts, chains); err != nil {
+					return err
+				}
+			}
+			return verifyPins(chains, pins)
+		}
+	}
+	return c
+}
+
+// verifyPins returns ErrPinMismatch if none of the certificates of chains has
+// the SHA-256 hash of its SubjectPublicKeyInfo in pins. Only verified chains
+// must be given: certificates sent by the peer but not part of a chain would
+// let any trusted certificate pass by appending the pinned one.
+func verifyPins(chains [][]*x509.Certificate, pins [][]byte) error {
+	for _, chain := range chains {
+		for _, cert := range chain {
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if bytes.Equal(sum[:], pin) {
+					return nil
+				}
+			}
+		}
+	}
+	return ErrPinMismatch
 }
 
 func (e *DOHEndpoint) Protocol() Protocol {
 	return ProtocolDOH
 }
 
+// Equal returns true if e2 is a DOHEndpoint with the same hostname, path and
+// set of Bootstrap IPs. An empty path equals "/", and the order of Bootstrap
+// IPs is ignored.
 func (e *DOHEndpoint) Equal(e2 Endpoint) bool {
 	if e2, ok := e2.(*DOHEndpoint); ok {
-		return e.Hostname == e2.Hostname && e.Path == e2.Path
+		return strings.EqualFold(e.Hostname, e2.Hostname) &&
+			normalizePath(e.Path) == normalizePath(e2.Path) &&
+			sameIPs(e.Bootstrap, e2.Bootstrap)
 	}
 	return false
 }
 
+func normalizePath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	return p
+}
+
+// sameIPs returns true if a and b contain the same IPs, regardless of their
+// order and representation.
+func sameIPs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[string]int, len(a))
+	for _, ip := range a {
+		set[canonicalIP(ip)]++
+	}
+	for _, ip := range b {
+		k := canonicalIP(ip)
+		if set[k] == 0 {
+			return false
+		}
+		set[k]--
+	}
+	return true
+}
+
+func canonicalIP(ip string) string {
+	if i := net.ParseIP(ip); i != nil {
+		return i.String()
+	}
+	return ip
+}
+
 func (e *DOHEndpoint) String() string {
 	if len(e.Bootstrap) != 0 {
 		return fmt.Sprintf("https://%s%s#%s", e.Hostname, e.Path, strings.Join(e.Bootstrap, ","))
@@ -56,7 +326,7 @@ func (e *DOHEndpoint) String() string {
 }
 
 func (e *DOHEndpoint) Test(ctx context.Context, testDomain string) (err error) {
-	req, _ := http.NewRequest("GET", "https://nowhere?name="+testDomain, nil)
+	req, _ := http.NewRequest("GET", "https://"+e.Hostname+"?name="+testDomain, nil)
 	req = req.WithContext(ctx)
 	res, err := e.RoundTrip(req)
 	if err != nil {
@@ -71,20 +341,264 @@ func (e *DOHEndpoint) Test(ctx context.Context, testDomain string) (err error) {
 	return nil
 }
 
-func (e *DOHEndpoint) RoundTrip(req *http.Request) (resp *http.Response, err error) {
-	e.once.Do(func() {
+// ExchangeJSON resolves name for qtype using the JSON API of the DoH server
+// (application/dns-json) and returns the raw JSON response.
+func (e *DOHEndpoint) ExchangeJSON(ctx context.Context, name string, qtype uint16) ([]byte, error) {
+	if err := validateName(name); err != nil {
+		return nil, err
+	}
+	if qtype == 0 {
+		return nil, errors.New("invalid query type: 0")
+	}
+	v := url.Values{}
+	v.Set("name", name)
+	v.Set("type", strconv.Itoa(int(qtype)))
+	req, err := http.NewRequest("GET", "https://"+e.Hostname+"?"+v.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/dns-json")
+	res, err := e.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, &StatusError{StatusCode: res.StatusCode}
+	}
+	return ioutil.ReadAll(io.LimitReader(res.Body, 1<<16))
+}
+
+// validateName returns an error if name is not a valid domain name.
+func validateName(name string) error {
+	n := strings.TrimSuffix(name, ".")
+	if n == "" || len(n) > 253 {
+		return fmt.Errorf("invalid name: %q", name)
+	}
+	for _, label := range strings.Split(n, ".") {
+		if label == "" || len(label) > 63 {
+			return fmt.Errorf("invalid name: %q", name)
+		}
+	}
+	return nil
+}
+
+// Warmup establishes a connection with the DoH server by sending a test
+// query, so the next request does not pay for the TCP and TLS handshakes. It
+// is safe to call concurrently with RoundTrip.
+func (e *DOHEndpoint) Warmup(ctx context.Context) error {
+	return e.Test(ctx, TestDomain)
+}
+
+// DataUsage returns the number of bytes sent and received by the endpoint
+// since its creation or the last call to ResetDataCounters.
+func (e *DOHEndpoint) DataUsage() (sent, received uint64) {
+	c := e.stats()
+	return atomic.LoadUint64(&c.bytesSent), atomic.LoadUint64(&c.bytesReceived)
+}
+
+// ResetDataCounters resets the data usage counters of the endpoint, lifting
+// the data cap until it is reached again.
+func (e *DOHEndpoint) ResetDataCounters() {
+	c := e.stats()
+	atomic.StoreUint64(&c.bytesSent, 0)
+	atomic.StoreUint64(&c.bytesReceived, 0)
+}
+
+func (e *DOHEndpoint) addDataUsage(sent, received int) {
+	c := e.stats()
+	atomic.AddUint64(&c.bytesSent, uint64(sent))
+	atomic.AddUint64(&c.bytesReceived, uint64(received))
+}
+
+// stats returns the counters of e.
+func (e *DOHEndpoint) stats() *dohCounters {
+	e.countersOnce.Do(func() {
+		e.counters = &dohCounters{}
+	})
+	return e.counters
+}
+
+// Stats returns a snapshot of the endpoint counters. It does not lock, so the
+// counters may be updated while being read.
+func (e *DOHEndpoint) Stats() Stats {
+	c := e.stats()
+	return Stats{
+		Requests:      atomic.LoadUint64(&c.requests),
+		Errors:        atomic.LoadUint64(&c.errors),
+		HTTP1Requests: atomic.LoadUint64(&c.http1),
+		HTTP2Requests: atomic.LoadUint64(&c.http2),
+		Retries:       atomic.LoadUint64(&c.retries),
+		Failovers:     atomic.LoadUint64(&c.failovers),
+		Connections:   loadCounts(&c.connections),
+		DialErrors:    loadCounts(&c.dialErrors),
+		BytesSent:     atomic.LoadUint64(&c.bytesSent),
+		BytesReceived: atomic.LoadUint64(&c.bytesReceived),
+	}
+}
+
+func (e *DOHEndpoint) addRequest(req *http.Request, resp *http.Response, err error) {
+	c := e.stats()
+	atomic.AddUint64(&c.requests, 1)
+	if retry, _ := req.Context().Value(retryKey{}).(bool); retry {
+		atomic.AddUint64(&c.retries, 1)
+	}
+	switch {
+	case err != nil:
+		atomic.AddUint64(&c.errors, 1)
+	case resp == nil:
+	case resp.ProtoMajor == 2:
+		atomic.AddUint64(&c.http2, 1)
+	default:
+		atomic.AddUint64(&c.http1, 1)
+	}
+}
+
+func (e *DOHEndpoint) addConnection(addr string) {
+	addCount(&e.stats().connections, addr)
+}
+
+func (e *DOHEndpoint) addDialError(addr string) {
+	addCount(&e.stats().dialErrors, addr)
+}
+
+func (e *DOHEndpoint) addFailover() {
+	atomic.AddUint64(&e.stats().failovers, 1)
+}
+
+// addCount increments the *uint64 counter of key in m.
+func addCount(m *sync.Map, key string) {
+	v, ok := m.Load(key)
+	if !ok {
+		v, _ = m.LoadOrStore(key, new(uint64))
+	}
+	atomic.AddUint64(v.(*uint64), 1)
+}
+
+// loadCounts returns a snapshot of the *uint64 counters of m.
+func loadCounts(m *sync.Map) map[string]uint64 {
+	counts := map[string]uint64{}
+	m.Range(func(key, value interface{}) bool {
+		counts[key.(string)] = atomic.LoadUint64(value.(*uint64))
+		return true
+	})
+	return counts
+}
+
+// Diagnostics returns a JSON document describing the configuration, the
+// counters and the current state of the endpoint, suitable to be attached to
+// a bug report. The last connection is only known for endpoints managed by a
+// Manager with connection hooks.
+func (e *DOHEndpoint) Diagnostics() ([]byte, error) {
+	stats := e.Stats()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	d := struct {
+		Protocol    string       `json:"protocol"`
+		Hostname    string       `json:"hostname"`
+		Path        string       `json:"path"`
+		Bootstrap   []string     `json:"bootstrap"`
+		DataCap     uint64       `json:"data_cap,omitempty"`
+		Stats       Stats        `json:"stats"`
+		LastConnect *ConnectInfo `json:"last_connect,omitempty"`
+	}{
+		Protocol:    e.Protocol().String(),
+		Hostname:    e.Hostname,
+		Path:        e.Path,
+		Bootstrap:   e.Bootstrap,
+		DataCap:     e.DataCap,
+		Stats:       stats,
+		LastConnect: e.lastConnect,
+	}
+	return json.Marshal(d)
+}
+
+// Close closes the idle connections of the endpoint transport and releases
+// it. A new transport is created on the next RoundTrip. If TransportWrapper is
+// set, the wrapping http.RoundTripper must implement CloseIdleConnections for
+// connections to be closed. Close can be called while requests are in flight,
+// they complete on the released transport.
+func (e *DOHEndpoint) Close() error {
+	conns.forget(e)
+	e.transportMu.Lock()
+	t := e.transport
+	e.transport = nil
+	e.wrapped = false
+	e.transportMu.Unlock()
+	if t, ok := t.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
+	return nil
+}
+
+// CloseIdleConnections closes the idle connections of the endpoint transport,
+// if any, without releasing it.
+func (e *DOHEndpoint) CloseIdleConnections() {
+	e.transportMu.Lock()
+	t := e.transport
+	e.transportMu.Unlock()
+	if t, ok := t.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
+}
+
+// getTransport returns the transport used by RoundTrip, creating it if
+// needed.
+func (e *DOHEndpoint) getTransport() http.RoundTripper {
+	e.transportMu.Lock()
+	defer e.transportMu.Unlock()
+	if !e.wrapped {
 		if e.transport == nil {
 			e.transport = newTransport(e)
 		}
-	})
-	if e.onConnect != nil {
+		if e.TransportWrapper != nil {
+			e.transport = e.TransportWrapper(e.transport)
+		}
+		e.wrapped = true
+	}
+	return e.transport
+}
+
+func (e *DOHEndpoint) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	start := time.Now()
+	defer func() {
+		e.addRequest(req, resp, err)
+		if e.OnRequest != nil {
+			ri := RequestInfo{Duration: time.Since(start), Error: err}
+			if resp != nil && err == nil {
+				ri.StatusCode = resp.StatusCode
+				ri.Protocol = resp.Proto
+			}
+			e.OnRequest(ri)
+		}
+	}()
+	if e.DataCap > 0 {
+		if sent, received := e.DataUsage(); sent+received >= e.DataCap {
+			return nil, ErrDataCapExceeded
+		}
+	}
+	conns.touch(e)
+	t := e.getTransport()
+	e.mu.Lock()
+	onConnect := e.onConnect
+	e.mu.Unlock()
+	if onConnect != nil || e.OnConnect != nil {
 		ctx, ci := withConnectInfo(req.Context())
 		req = req.WithContext(ctx)
-		resp, err = e.transport.RoundTrip(req)
+		resp, err = t.RoundTrip(req)
 		if ci.Connect {
-			e.onConnect(ci)
+			e.mu.Lock()
+			e.lastConnect = ci
+			e.mu.Unlock()
+			if onConnect != nil {
+				onConnect(ci)
+			}
+			if e.OnConnect != nil {
+				e.OnConnect(ci)
+			}
 		}
 		return
 	}
-	return e.transport.RoundTrip(req)
+	return t.RoundTrip(req)
 }
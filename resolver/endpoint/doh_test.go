@@ -0,0 +1,527 @@
+package endpoint
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestDOHEndpoint_TransportWrapper(t *testing.T) {
+	var wrapped, called int
+	e := &DOHEndpoint{
+		Hostname:  "a",
+		transport: &errTransport{},
+		TransportWrapper: func(rt http.RoundTripper) http.RoundTripper {
+			wrapped++
+			return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				called++
+				return rt.RoundTrip(req)
+			})
+		},
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := e.RoundTrip(&http.Request{}); err != nil {
+			t.Fatalf("RoundTrip() err = %v", err)
+		}
+	}
+	if wrapped != 1 {
+		t.Errorf("TransportWrapper called %d times, want 1", wrapped)
+	}
+	if called != 2 {
+		t.Errorf("wrapped transport called %d times, want 2", called)
+	}
+}
+
+func TestDOHEndpoint_DataCap(t *testing.T) {
+	e := &DOHEndpoint{
+		Hostname:  "a",
+		transport: &errTransport{},
+		DataCap:   100,
+	}
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	c := countingConn{Conn: c1, add: e.addDataUsage}
+	go func() {
+		buf := make([]byte, 60)
+		_, _ = io.ReadFull(c2, buf)
+		_, _ = c2.Write(buf[:40])
+	}()
+	if _, err := c.Write(make([]byte, 60)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, make([]byte, 40)); err != nil {
+		t.Fatal(err)
+	}
+	if sent, received := e.DataUsage(); sent != 60 || received != 40 {
+		t.Errorf("DataUsage() = %d, %d, want 60, 40", sent, received)
+	}
+	if _, err := e.RoundTrip(&http.Request{}); err != ErrDataCapExceeded {
+		t.Errorf("RoundTrip() err = %v, want %v", err, ErrDataCapExceeded)
+	}
+	e.ResetDataCounters()
+	if _, err := e.RoundTrip(&http.Request{}); err != nil {
+		t.Errorf("RoundTrip() after reset err = %v", err)
+	}
+}
+
+func TestDOHEndpoint_Diagnostics(t *testing.T) {
+	e := &DOHEndpoint{
+		Hostname:  "a",
+		Path:      "/abcdef",
+		Bootstrap: []string{"1.2.3.4"},
+		transport: &errTransport{},
+	}
+	e.addDataUsage(10, 20)
+	b, err := e.Diagnostics()
+	if err != nil {
+		t.Fatalf("Diagnostics() err = %v", err)
+	}
+	want := `{"protocol":"doh","hostname":"a","path":"/abcdef","bootstrap":["1.2.3.4"],` +
+		`"stats":{"requests":0,"errors":0,"http1_requests":0,"http2_requests":0,"retries":0,"failovers":0,` +
+		`"connections":{},"dial_errors":{},"bytes_sent":10,"bytes_received":20}}`
+	if got := string(b); got != want {
+		t.Errorf("Diagnostics() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestDOHEndpoint_OnConnect(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	var cis []*ConnectInfo
+	e := &DOHEndpoint{
+		Hostname:  "a",
+		transport: srv.Client().Transport,
+		OnConnect: func(ci *ConnectInfo) {
+			cis = append(cis, ci)
+		},
+	}
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		res, err := e.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("RoundTrip() err = %v", err)
+		}
+		_, _ = io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+	}
+	if len(cis) != 1 {
+		t.Fatalf("OnConnect called %d times, want 1", len(cis))
+	}
+	ci := cis[0]
+	if ci.Protocol != "h2" {
+		t.Errorf("ConnectInfo.Protocol = %q, want h2", ci.Protocol)
+	}
+	if ci.ServerAddr != srv.Listener.Addr().String() {
+		t.Errorf("ConnectInfo.ServerAddr = %q, want %q", ci.ServerAddr, srv.Listener.Addr())
+	}
+	if ci.TLSVersion == "" {
+		t.Errorf("ConnectInfo.TLSVersion is empty")
+	}
+}
+
+func TestDOHEndpoint_Close(t *testing.T) {
+	closed := make(chan struct{})
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateClosed {
+			close(closed)
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	e := &DOHEndpoint{
+		Hostname:  "a",
+		transport: srv.Client().Transport,
+	}
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	res, err := e.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() err = %v", err)
+	}
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+
+	if err := e.Close(); err != nil {
+		t.Fatalf("Close() err = %v", err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Error("connection not closed after Close()")
+	}
+	if e.transport != nil {
+		t.Error("transport not released after Close()")
+	}
+}
+
+func TestDOHEndpoint_ConcurrentRoundTrip(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	// The test server certificate is valid for example.com.
+	e := &DOHEndpoint{
+		Hostname:  "example.com",
+		Bootstrap: []string{"192.0.2.1", "192.0.2.2"},
+		TLSConfig: &tls.Config{RootCAs: pool},
+		DataCap:   1 << 30,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, srv.Listener.Addr().String())
+		},
+		OnConnect: func(ci *ConnectInfo) {},
+	}
+	defer e.Close()
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			_, _ = e.Diagnostics()
+			_, _ = e.DataUsage()
+			e.ResetDataCounters()
+			// As done by Manager when the endpoint is activated.
+			e.setOnConnect(func(ci *ConnectInfo) {})
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				req, _ := http.NewRequest("GET", "https://example.com/", nil)
+				res, err := e.RoundTrip(req)
+				if err != nil {
+					t.Errorf("RoundTrip() err = %v", err)
+					return
+				}
+				_, _ = io.Copy(ioutil.Discard, res.Body)
+				res.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+}
+
+func TestDOHEndpoint_CloseConcurrent(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	// The test server certificate is valid for example.com.
+	e := &DOHEndpoint{
+		Hostname:  "example.com",
+		TLSConfig: &tls.Config{RootCAs: pool},
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, srv.Listener.Addr().String())
+		},
+	}
+	defer e.Close()
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			// As done on failover or restart while queries are in flight.
+			_ = e.Close()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				req, _ := http.NewRequest("GET", "https://example.com/", nil)
+				res, err := e.RoundTrip(req)
+				if err != nil {
+					t.Errorf("RoundTrip() err = %v", err)
+					return
+				}
+				_, _ = io.Copy(ioutil.Discard, res.Body)
+				res.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+}
+
+func TestDOHEndpoint_Stats(t *testing.T) {
+	h2 := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+	h1 := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer h1.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(h2.Certificate())
+	pool.AddCert(h1.Certificate())
+
+	roundTrips := func(ctx context.Context, e *DOHEndpoint, count int) {
+		t.Helper()
+		for i := 0; i < count; i++ {
+			req, _ := http.NewRequest("GET", "https://example.com/", nil)
+			res, err := e.RoundTrip(req.WithContext(ctx))
+			if err != nil {
+				t.Fatalf("RoundTrip() err = %v", err)
+			}
+			_, _ = io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+		}
+	}
+
+	// The test server certificates are valid for example.com. The
+	// first Bootstrap IP is down, so its connection fails over to the second.
+	e := &DOHEndpoint{
+		Hostname:    "example.com",
+		Bootstrap:   []string{"192.0.2.1", "192.0.2.2"},
+		TLSConfig:   &tls.Config{RootCAs: pool},
+		DialStagger: time.Hour, // only dial the next IP once the first failed
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if addr == "192.0.2.1:443" {
+				return nil, errors.New("down")
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, h2.Listener.Addr().String())
+		},
+	}
+	defer e.Close()
+	roundTrips(context.Background(), e, 2)
+	roundTrips(WithRetry(context.Background()), e, 1)
+	s := e.Stats()
+	want := Stats{
+		Requests:      3,
+		HTTP2Requests: 3,
+		Retries:       1,
+		Failovers:     1,
+		Connections:   map[string]uint64{h2.Listener.Addr().String(): 1},
+		DialErrors:    map[string]uint64{"192.0.2.1:443": 1},
+		BytesSent:     s.BytesSent,
+		BytesReceived: s.BytesReceived,
+	}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("Stats() = %+v, want %+v", s, want)
+	}
+	if s.BytesSent == 0 || s.BytesReceived == 0 {
+		t.Errorf("Stats() bytes sent = %d, received = %d, want non zero", s.BytesSent, s.BytesReceived)
+	}
+
+	e = &DOHEndpoint{
+		Hostname:  "example.com",
+		Bootstrap: []string{"192.0.2.1"},
+		TLSConfig: &tls.Config{RootCAs: pool},
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, h1.Listener.Addr().String())
+		},
+	}
+	defer e.Close()
+	roundTrips(context.Background(), e, 2)
+	if s := e.Stats(); s.Requests != 2 || s.HTTP1Requests != 2 || s.HTTP2Requests != 0 {
+		t.Errorf("Stats() requests = %d, http1 = %d, http2 = %d, want 2, 2, 0", s.Requests, s.HTTP1Requests, s.HTTP2Requests)
+	}
+
+	e = &DOHEndpoint{Hostname: "a", transport: &errTransport{errs: []error{errors.New("failed"), nil}}}
+	for i := 0; i < 2; i++ {
+		_, _ = e.RoundTrip(&http.Request{})
+	}
+	if s := e.Stats(); s.Requests != 2 || s.Errors != 1 {
+		t.Errorf("Stats() requests = %d, errors = %d, want 2, 1", s.Requests, s.Errors)
+	}
+}
+
+func TestDOHEndpoint_Warmup(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	var connects int
+	// The test server certificate is valid for example.com.
+	e := &DOHEndpoint{
+		Hostname:  "example.com",
+		Bootstrap: []string{"192.0.2.1"},
+		TLSConfig: &tls.Config{RootCAs: pool},
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, srv.Listener.Addr().String())
+		},
+		OnConnect: func(ci *ConnectInfo) {
+			connects++
+		},
+	}
+	defer e.Close()
+	if err := e.Warmup(context.Background()); err != nil {
+		t.Fatalf("Warmup() err = %v", err)
+	}
+	if connects != 1 {
+		t.Fatalf("Warmup() established %d connections, want 1", connects)
+	}
+	req, _ := http.NewRequest("GET", "https://example.com/", nil)
+	res, err := e.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() err = %v", err)
+	}
+	res.Body.Close()
+	if connects != 1 {
+		t.Errorf("RoundTrip() after Warmup() established a new connection")
+	}
+}
+
+func TestDOHEndpoint_ExchangeJSON(t *testing.T) {
+	const answer = `{"Status":0,"Answer":[{"name":"test.com.","type":1,"TTL":3600,"data":"69.172.200.235"}]}`
+	status := http.StatusOK
+	var got *http.Request
+	e := &DOHEndpoint{
+		Hostname: "dns.nextdns.io",
+		transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			got = req
+			return &http.Response{
+				StatusCode: status,
+				Header:     http.Header{"Content-Type": []string{"application/dns-json"}},
+				Body:       ioutil.NopCloser(strings.NewReader(answer)),
+			}, nil
+		}),
+	}
+	b, err := e.ExchangeJSON(context.Background(), "test.com.", 1)
+	if err != nil {
+		t.Fatalf("ExchangeJSON() err = %v", err)
+	}
+	if string(b) != answer {
+		t.Errorf("ExchangeJSON() = %s, want %s", b, answer)
+	}
+	if got.Method != "GET" || got.URL.Query().Get("name") != "test.com." || got.URL.Query().Get("type") != "1" {
+		t.Errorf("ExchangeJSON() sent %s %s", got.Method, got.URL)
+	}
+	if got, want := got.Header.Get("Accept"), "application/dns-json"; got != want {
+		t.Errorf("ExchangeJSON() Accept = %q, want %q", got, want)
+	}
+
+	status = http.StatusBadRequest
+	_, err = e.ExchangeJSON(context.Background(), "test.com.", 1)
+	var se *StatusError
+	if !errors.As(err, &se) || se.StatusCode != http.StatusBadRequest {
+		t.Errorf("ExchangeJSON() err = %v, want StatusError 400", err)
+	}
+
+	for _, name := range []string{"", ".", "a..b", strings.Repeat("a", 64) + ".com"} {
+		if _, err := e.ExchangeJSON(context.Background(), name, 1); err == nil {
+			t.Errorf("ExchangeJSON(%q) err = nil, want error", name)
+		}
+	}
+	if _, err := e.ExchangeJSON(context.Background(), "test.com.", 0); err == nil {
+		t.Errorf("ExchangeJSON() with type 0 err = nil, want error")
+	}
+}
+
+func TestDOHEndpoint_Test_URL(t *testing.T) {
+	var got *http.Request
+	e := &DOHEndpoint{
+		Hostname: "dns.nextdns.io",
+		transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			got = req
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		}),
+	}
+	if err := e.Test(context.Background(), TestDomain); err != nil {
+		t.Fatalf("Test() err = %v", err)
+	}
+	if got.URL.Host != e.Hostname {
+		t.Errorf("Test() request host = %s, want %s", got.URL.Host, e.Hostname)
+	}
+}
+
+func TestDOHEndpoint_Equal(t *testing.T) {
+	e := &DOHEndpoint{Hostname: "dns.nextdns.io", Bootstrap: []string{"45.90.28.0", "2a07:a8c0::"}}
+	tests := []struct {
+		name string
+		e2   Endpoint
+		want bool
+	}{
+		{"Same", &DOHEndpoint{Hostname: "dns.nextdns.io", Bootstrap: []string{"45.90.28.0", "2a07:a8c0::"}}, true},
+		{"ReorderedIPs", &DOHEndpoint{Hostname: "dns.nextdns.io", Bootstrap: []string{"2a07:a8c0::", "45.90.28.0"}}, true},
+		{"IPRepresentation", &DOHEndpoint{Hostname: "dns.nextdns.io", Bootstrap: []string{"45.90.28.0", "2a07:a8c0:0::0"}}, true},
+		{"RootPath", &DOHEndpoint{Hostname: "dns.nextdns.io", Path: "/", Bootstrap: []string{"45.90.28.0", "2a07:a8c0::"}}, true},
+		{"HostnameCase", &DOHEndpoint{Hostname: "DNS.nextdns.io", Bootstrap: []string{"45.90.28.0", "2a07:a8c0::"}}, true},
+		{"OtherPath", &DOHEndpoint{Hostname: "dns.nextdns.io", Path: "/abcdef", Bootstrap: []string{"45.90.28.0", "2a07:a8c0::"}}, false},
+		{"OtherIPs", &DOHEndpoint{Hostname: "dns.nextdns.io", Bootstrap: []string{"45.90.28.0", "2a07:a8c1::"}}, false},
+		{"FewerIPs", &DOHEndpoint{Hostname: "dns.nextdns.io", Bootstrap: []string{"45.90.28.0"}}, false},
+		{"OtherHostname", &DOHEndpoint{Hostname: "dns1.nextdns.io", Bootstrap: []string{"45.90.28.0", "2a07:a8c0::"}}, false},
+		{"OtherType", &DNSEndpoint{Addr: "45.90.28.0:53"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := e.Equal(tt.e2); got != tt.want {
+				t.Errorf("Equal() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDOHEndpoint_OnRequest(t *testing.T) {
+	errFailed := errors.New("failed")
+	var infos []RequestInfo
+	e := &DOHEndpoint{
+		Hostname:  "a",
+		transport: &errTransport{errs: []error{errFailed, nil}},
+		OnRequest: func(ri RequestInfo) {
+			infos = append(infos, ri)
+		},
+	}
+	// First attempt fails, the retry succeeds.
+	for i := 0; i < 2; i++ {
+		_, _ = e.RoundTrip(&http.Request{})
+	}
+	if len(infos) != 2 {
+		t.Fatalf("OnRequest called %d times, want 2", len(infos))
+	}
+	if infos[0].Error != errFailed || infos[0].StatusCode != 0 {
+		t.Errorf("first RequestInfo = %+v, want error %v", infos[0], errFailed)
+	}
+	if infos[1].Error != nil || infos[1].StatusCode != http.StatusOK {
+		t.Errorf("second RequestInfo = %+v, want status 200", infos[1])
+	}
+}
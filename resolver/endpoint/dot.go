@@ -0,0 +1,290 @@
+package endpoint
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultDOTPort is the port of DoT servers as defined by RFC7858.
+const DefaultDOTPort = "853"
+
+// DefaultDOTTimeout is the default maximum duration of an exchange with a DoT
+// server when the context has no deadline.
+const DefaultDOTTimeout = 5 * time.Second
+
+// dotMaxIdleConns is the maximum number of idle connections kept per DoT
+// endpoint.
+const dotMaxIdleConns = 4
+
+var errIDMismatch = errors.New("response ID mismatch")
+
+// DOTEndpoint is a DNS-over-TLS endpoint as defined by RFC7858.
+type DOTEndpoint struct {
+	// Hostname is the name of the DoT server, used for TLS verification and to
+	// contact the server if Bootstrap is empty.
+	Hostname string
+
+	// Port is the port of the DoT server. If empty, DefaultDOTPort is used.
+	Port string
+
+	// Bootstrap is the IPs to use to contact the DoT server. When set, the
+	// Hostname is only used for TLS verification.
+	Bootstrap []string
+
+	// TLSConfig is an optional base TLS configuration to use with the DoT
+	// server. ServerName is always set to Hostname and NextProtos to "dot".
+	TLSConfig *tls.Config `json:"-"`
+
+	// DialContext, if set, is used to establish the TCP connections to the
+	// DoT server in place of a net.Dialer.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error) `json:"-"`
+
+	// Timeout is the maximum duration of an exchange, including the
+	// connection establishment, when the context has no deadline. If zero,
+	// DefaultDOTTimeout is used.
+	Timeout time.Duration
+
+	mu   sync.Mutex
+	idle []net.Conn
+}
+
+func (e *DOTEndpoint) Protocol() Protocol {
+	return ProtocolDOT
+}
+
+func (e *DOTEndpoint) Equal(e2 Endpoint) bool {
+	if e2, ok := e2.(*DOTEndpoint); ok {
+		return strings.EqualFold(e.Hostname, e2.Hostname) &&
+			e.port() == e2.port() &&
+			sameIPs(e.Bootstrap, e2.Bootstrap)
+	}
+	return false
+}
+
+func (e *DOTEndpoint) String() string {
+	host := e.Hostname
+	if e.Port != "" {
+		host = net.JoinHostPort(host, e.Port)
+	} else if strings.IndexByte(host, ':') >= 0 {
+		host = "[" + host + "]"
+	}
+	s := "tls://" + host
+	if len(e.Bootstrap) != 0 {
+		s += "#" + strings.Join(e.Bootstrap, ",")
+	}
+	return s
+}
+
+func (e *DOTEndpoint) Test(ctx context.Context, testDomain string) error {
+	q, err := testQuery(testDomain)
+	if err != nil {
+		return err
+	}
+	if _, err = e.Exchange(ctx, q, make([]byte, 65535)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Exchange sends the DNS message payload to the DoT server and reads the
+// response into buf. Connections are kept open and reused by subsequent
+// exchanges. A connection answering with an ID other than the one of payload
+// is discarded.
+func (e *DOTEndpoint) Exchange(ctx context.Context, payload, buf []byte) (n int, err error) {
+	if _, ok := ctx.Deadline(); !ok {
+		timeout := e.Timeout
+		if timeout == 0 {
+			timeout = DefaultDOTTimeout
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	conns.touch(e)
+	for {
+		c, reused, err := e.getConn(ctx)
+		if err != nil {
+			return -1, err
+		}
+		if n, err = exchangeConn(ctx, c, payload, buf); err != nil {
+			c.Close()
+			if reused && ctx.Err() == nil {
+				// The server may have closed the idle connection.
+				continue
+			}
+			return -1, err
+		}
+		e.putConn(c)
+		return n, nil
+	}
+}
+
+// Close closes the idle connections of the endpoint.
+func (e *DOTEndpoint) Close() error {
+	conns.forget(e)
+	e.CloseIdleConnections()
+	return nil
+}
+
+// CloseIdleConnections closes the idle connections of the endpoint.
+func (e *DOTEndpoint) CloseIdleConnections() {
+	e.mu.Lock()
+	idle := e.idle
+	e.idle = nil
+	e.mu.Unlock()
+	for _, c := range idle {
+		c.Close()
+	}
+}
+
+func (e *DOTEndpoint) port() string {
+	if e.Port == "" {
+		return DefaultDOTPort
+	}
+	return e.Port
+}
+
+// getConn returns an idle connection if any, or a new one.
+func (e *DOTEndpoint) getConn(ctx context.Context) (c net.Conn, reused bool, err error) {
+	e.mu.Lock()
+	if l := len(e.idle); l > 0 {
+		c = e.idle[l-1]
+		e.idle = e.idle[:l-1]
+	}
+	e.mu.Unlock()
+	if c != nil {
+		return c, true, nil
+	}
+	c, err = e.dial(ctx)
+	return c, false, err
+}
+
+// putConn returns c to the idle pool, or closes it if the pool is full.
+func (e *DOTEndpoint) putConn(c net.Conn) {
+	e.mu.Lock()
+	if len(e.idle) < dotMaxIdleConns {
+		e.idle = append(e.idle, c)
+		c = nil
+	}
+	e.mu.Unlock()
+	if c != nil {
+		c.Close()
+	}
+}
+
+// dial establishes a new TLS connection with the DoT server.
+func (e *DOTEndpoint) dial(ctx context.Context) (net.Conn, error) {
+	addrs := []string{net.JoinHostPort(e.Hostname, e.port())}
+	if len(e.Bootstrap) != 0 {
+		addrs = addrs[:0]
+		for _, ip := range e.Bootstrap {
+			addrs = append(addrs, net.JoinHostPort(ip, e.port()))
+		}
+	}
+	if err := conns.acquire(e); err != nil {
+		return nil, err
+	}
+	d := &parallelDialer{DialFunc: e.DialContext}
+	c, err := d.DialParallel(ctx, "tcp", addrs)
+	if err != nil {
+		conns.release()
+		return nil, fmt.Errorf("dial: %v", err)
+	}
+	c = conns.track(c)
+	tc := tls.Client(c, e.tlsConfig())
+	if t, ok := ctx.Deadline(); ok {
+		_ = tc.SetDeadline(t)
+	}
+	stop := watchContext(ctx, c)
+	err = tc.Handshake()
+	stop()
+	if err != nil {
+		c.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("tls handshake: %v", err)
+	}
+	return tc, nil
+}
+
+// tlsConfig returns the TLS configuration to use to connect to e.
+func (e *DOTEndpoint) tlsConfig() *tls.Config {
+	c := &tls.Config{}
+	if e.TLSConfig != nil {
+		c = e.TLSConfig.Clone()
+	}
+	c.ServerName = e.Hostname
+	c.NextProtos = []string{"dot"}
+	return c
+}
+
+// watchContext interrupts the pending I/O on c when ctx is done. The returned
+// function must be called once the I/O completed, before c is reused.
+func watchContext(ctx context.Context, c net.Conn) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			_ = c.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// exchangeConn sends payload on c and reads the response into buf, messages
+// being framed with their length as defined by RFC1035, section 4.2.2.
+func exchangeConn(ctx context.Context, c net.Conn, payload, buf []byte) (n int, err error) {
+	var deadline time.Time
+	if t, ok := ctx.Deadline(); ok {
+		deadline = t
+	}
+	_ = c.SetDeadline(deadline)
+	stop := watchContext(ctx, c)
+	n, err = writeReadConn(c, payload, buf)
+	stop()
+	if err != nil && ctx.Err() != nil {
+		return -1, ctx.Err()
+	}
+	if err == nil && len(payload) >= 2 && (n < 2 || buf[0] != payload[0] || buf[1] != payload[1]) {
+		return -1, errIDMismatch
+	}
+	return n, err
+}
+
+func writeReadConn(c net.Conn, payload, buf []byte) (n int, err error) {
+	msg := make([]byte, 2+len(payload))
+	binary.BigEndian.PutUint16(msg, uint16(len(payload)))
+	copy(msg[2:], payload)
+	if _, err = c.Write(msg); err != nil {
+		return -1, fmt.Errorf("write: %v", err)
+	}
+	var length uint16
+	if err = binary.Read(c, binary.BigEndian, &length); err != nil {
+		return -1, fmt.Errorf("read: %v", err)
+	}
+	if int(length) > len(buf) {
+		return -1, errors.New("read: response too large")
+	}
+	if n, err = io.ReadFull(c, buf[:length]); err != nil {
+		return -1, fmt.Errorf("read: %v", err)
+	}
+	return n, nil
+}
@@ -0,0 +1,226 @@
+package endpoint
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startDOTServer starts a DoT server echoing queries as responses. If once is
+// true, connections are closed after the first response. If respond is not
+// nil, it is called with each query and its result is sent as the response, or
+// no response at all if nil.
+func startDOTServer(t *testing.T, once bool, respond func(q []byte) []byte) (e *DOTEndpoint, accepts *int32, stop func()) {
+	t.Helper()
+	s := httptest.NewUnstartedServer(nil)
+	s.StartTLS()
+	cert := s.TLS.Certificates[0]
+	roots := x509.NewCertPool()
+	roots.AddCert(s.Certificate())
+	s.Close()
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"dot"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepts = new(int32)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(accepts, 1)
+			go func(c *tls.Conn) {
+				defer c.Close()
+				if err := c.Handshake(); err != nil || c.ConnectionState().NegotiatedProtocol != "dot" {
+					return
+				}
+				for {
+					var length uint16
+					if err := binary.Read(c, binary.BigEndian, &length); err != nil {
+						return
+					}
+					msg := make([]byte, 2+int(length))
+					binary.BigEndian.PutUint16(msg, length)
+					if _, err := io.ReadFull(c, msg[2:]); err != nil {
+						return
+					}
+					if respond != nil {
+						resp := respond(msg[2:])
+						if resp == nil {
+							continue
+						}
+						msg = make([]byte, 2+len(resp))
+						binary.BigEndian.PutUint16(msg, uint16(len(resp)))
+						copy(msg[2:], resp)
+					}
+					if _, err := c.Write(msg); err != nil || once {
+						return
+					}
+				}
+			}(c.(*tls.Conn))
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	e = &DOTEndpoint{
+		Hostname:  "example.com",
+		Port:      port,
+		Bootstrap: []string{"127.0.0.1"},
+		TLSConfig: &tls.Config{RootCAs: roots},
+	}
+	return e, accepts, func() { l.Close() }
+}
+
+func TestDOTEndpoint_Exchange(t *testing.T) {
+	for _, once := range []bool{false, true} {
+		e, accepts, stop := startDOTServer(t, once, nil)
+		defer stop()
+		defer e.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		q, err := testQuery("test.com.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 512)
+		for i := 0; i < 3; i++ {
+			n, err := e.Exchange(ctx, q, buf)
+			if err != nil {
+				t.Fatalf("once=%v: Exchange() err = %v", once, err)
+			}
+			if string(buf[:n]) != string(q) {
+				t.Errorf("once=%v: Exchange() = %x, want %x", once, buf[:n], q)
+			}
+		}
+		want := int32(1)
+		if once {
+			// Closed idle connections are replaced transparently.
+			want = 3
+		}
+		if got := atomic.LoadInt32(accepts); got != want {
+			t.Errorf("once=%v: %d connections, want %d", once, got, want)
+		}
+	}
+}
+
+func TestDOTEndpoint_Test(t *testing.T) {
+	e, _, stop := startDOTServer(t, false, nil)
+	defer stop()
+	defer e.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := e.Test(ctx, TestDomain); err != nil {
+		t.Errorf("Test() err = %v", err)
+	}
+	// The server certificate is not valid for another name.
+	e2 := &DOTEndpoint{Hostname: "other.com", Port: e.Port, Bootstrap: e.Bootstrap, TLSConfig: e.TLSConfig}
+	if err := e2.Test(ctx, TestDomain); err == nil {
+		t.Errorf("Test() with wrong hostname: err = nil")
+	}
+}
+
+func TestDOTEndpoint_Exchange_Silent(t *testing.T) {
+	e, _, stop := startDOTServer(t, false, func(q []byte) []byte { return nil })
+	defer stop()
+	defer e.Close()
+	q, err := testQuery("test.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 512)
+
+	// A cancelled context without deadline aborts the exchange.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := e.Exchange(ctx, q, buf); err != context.Canceled {
+		t.Errorf("Exchange() err = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Exchange() returned after %v", elapsed)
+	}
+
+	// Without deadline, the exchange times out after Timeout.
+	e.Timeout = 100 * time.Millisecond
+	start = time.Now()
+	if _, err := e.Exchange(context.Background(), q, buf); err == nil {
+		t.Error("Exchange() err = nil")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Exchange() returned after %v", elapsed)
+	}
+}
+
+func TestDOTEndpoint_Exchange_IDMismatch(t *testing.T) {
+	e, accepts, stop := startDOTServer(t, false, func(q []byte) []byte {
+		resp := append([]byte{}, q...)
+		resp[1]++
+		return resp
+	})
+	defer stop()
+	defer e.Close()
+	q, err := testQuery("test.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	buf := make([]byte, 512)
+	for i := 0; i < 2; i++ {
+		if _, err := e.Exchange(ctx, q, buf); err != errIDMismatch {
+			t.Errorf("Exchange() err = %v, want %v", err, errIDMismatch)
+		}
+	}
+	// The connection is discarded after a mismatch.
+	if got := atomic.LoadInt32(accepts); got != 2 {
+		t.Errorf("%d connections, want 2", got)
+	}
+}
+
+func TestDOTEndpoint_MaxConns(t *testing.T) {
+	defer func(l *connLimiter) { conns = l }(conns)
+	conns = &connLimiter{}
+	SetMaxConns(1)
+
+	e1, accepts, stop := startDOTServer(t, false, nil)
+	defer stop()
+	defer e1.Close()
+	e2 := &DOTEndpoint{Hostname: e1.Hostname, Port: e1.Port, Bootstrap: e1.Bootstrap, TLSConfig: e1.TLSConfig}
+	defer e2.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	q, err := testQuery("test.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 512)
+	for _, e := range []*DOTEndpoint{e1, e2, e1} {
+		if _, err := e.Exchange(ctx, q, buf); err != nil {
+			t.Fatalf("Exchange() err = %v", err)
+		}
+		// The idle connection of the other endpoint is closed to make room.
+		if got := OpenConns(); got != 1 {
+			t.Errorf("OpenConns() = %d, want 1", got)
+		}
+	}
+	if got := atomic.LoadInt32(accepts); got != 3 {
+		t.Errorf("accepts = %d, want 3", got)
+	}
+	if got := MaxConns(); got != 1 {
+		t.Errorf("MaxConns() = %d, want 1", got)
+	}
+}
@@ -20,6 +20,8 @@ func (p Protocol) String() string {
 		return "doh"
 	case ProtocolDNS:
 		return "dns"
+	case ProtocolDOT:
+		return "dot"
 	default:
 		return "unknown"
 	}
@@ -28,6 +30,7 @@ func (p Protocol) String() string {
 const (
 	ProtocolDOH Protocol = iota
 	ProtocolDNS
+	ProtocolDOT
 )
 
 // Endpoint represents a DNS server endpoint.
@@ -50,6 +53,8 @@ type Endpoint interface {
 //
 //   * DoH:   https://doh.server.com/path
 //   * DoH:   https://doh.server.com/path#1.2.3.4 // with bootstrap
+//   * DoT:   tls://dot.server.com
+//   * DoT:   tls://dot.server.com:853#1.2.3.4 // with bootstrap
 //   * DNS53: 1.2.3.4
 //   * DNS53: 1.2.3.4:5353
 func New(server string) (Endpoint, error) {
@@ -58,15 +63,48 @@ func New(server string) (Endpoint, error) {
 		if err != nil {
 			return nil, err
 		}
+		if u.Host == "" {
+			return nil, errors.New("missing DoH hostname")
+		}
 		e := &DOHEndpoint{
 			Hostname: u.Host,
 			Path:     u.Path,
 		}
 		if u.Fragment != "" {
 			e.Bootstrap = strings.Split(u.Fragment, ",")
+			for _, ip := range e.Bootstrap {
+				if net.ParseIP(ip) == nil {
+					return nil, fmt.Errorf("invalid bootstrap IP: %q", ip)
+				}
+			}
 		}
 		return e, nil
 	}
+	if strings.HasPrefix(server, "tls://") {
+		u, err := url.Parse(server)
+		if err != nil {
+			return nil, err
+		}
+		if u.Hostname() == "" {
+			return nil, errors.New("missing DoT hostname")
+		}
+		e := &DOTEndpoint{
+			Hostname: u.Hostname(),
+			Port:     u.Port(),
+		}
+		if u.Fragment != "" {
+			e.Bootstrap = strings.Split(u.Fragment, ",")
+			for _, ip := range e.Bootstrap {
+				if net.ParseIP(ip) == nil {
+					return nil, fmt.Errorf("invalid bootstrap IP: %q", ip)
+				}
+			}
+		}
+		return e, nil
+	}
+	if i := strings.Index(server, "://"); i >= 0 {
+		return nil, fmt.Errorf("unsupported scheme: %s", server[:i])
+	}
 
 	host, port, err := net.SplitHostPort(server)
 	if err != nil {
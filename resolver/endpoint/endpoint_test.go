@@ -0,0 +1,57 @@
+package endpoint
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		server  string
+		want    Endpoint
+		wantErr bool
+	}{
+		{"https://dns.nextdns.io/abcdef", &DOHEndpoint{Hostname: "dns.nextdns.io", Path: "/abcdef"}, false},
+		{
+			"https://dns.nextdns.io/abcdef#45.90.28.0,2a07:a8c0::",
+			&DOHEndpoint{Hostname: "dns.nextdns.io", Path: "/abcdef", Bootstrap: []string{"45.90.28.0", "2a07:a8c0::"}},
+			false,
+		},
+		{"https://dns.nextdns.io/abcdef#45.90.28", nil, true},
+		{"https://dns.nextdns.io/abcdef#45.90.28.0,", nil, true},
+		{"https:///abcdef", nil, true},
+		{"http://dns.nextdns.io/abcdef", nil, true},
+		{"tls://dns.nextdns.io", &DOTEndpoint{Hostname: "dns.nextdns.io"}, false},
+		{
+			"tls://dns.nextdns.io:853#45.90.28.0",
+			&DOTEndpoint{Hostname: "dns.nextdns.io", Port: "853", Bootstrap: []string{"45.90.28.0"}},
+			false,
+		},
+		{"tls://[2a07:a8c0::]", &DOTEndpoint{Hostname: "2a07:a8c0::"}, false},
+		{"tls://:853", nil, true},
+		{"1.2.3.4", &DNSEndpoint{Addr: "1.2.3.4:53"}, false},
+		{"[2a07:a8c0::]:5353", &DNSEndpoint{Addr: "[2a07:a8c0::]:5353"}, false},
+		{"dns.nextdns.io", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.server, func(t *testing.T) {
+			got, err := New(tt.server)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("New() = %#v, want %#v", got, tt.want)
+			}
+			e2, err := New(got.String())
+			if err != nil {
+				t.Fatalf("New(String()) err = %v", err)
+			}
+			if !reflect.DeepEqual(e2, got) {
+				t.Errorf("New(String()) = %#v, want %#v", e2, got)
+			}
+		})
+	}
+}
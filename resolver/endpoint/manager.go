@@ -20,6 +20,10 @@ const (
 	// DefaultMinTestInterval defines the default value for Manager MinTestInterval.
 	DefaultMinTestInterval = 2 * time.Hour
 
+	// DefaultCertExpiryWarning defines the default value for Manager
+	// CertExpiryWarning.
+	DefaultCertExpiryWarning = 7 * 24 * time.Hour
+
 	// minTestIntervalFailed define the test interval to use when all endpoints
 	// are failed.
 	minTestIntervalFailed = 10 * time.Second
@@ -55,6 +59,11 @@ type Manager struct {
 	// returned, Test is called on e.
 	EndpointTester func(e Endpoint) Tester
 
+	// Strategy orders the endpoints returned by each provider before they are
+	// tested and is told the result of each test. If nil, endpoints are tested
+	// in the order returned by their provider.
+	Strategy SelectionStrategy
+
 	// OnChange is called whenever the active endpoint changes.
 	OnChange func(e Endpoint)
 
@@ -62,6 +71,15 @@ type Manager struct {
 	// endpoints).
 	OnConnect func(*ConnectInfo)
 
+	// CertExpiryWarning is the remaining validity under which the certificate
+	// of a connected endpoint triggers OnCertExpiringSoon. If zero,
+	// DefaultCertExpiryWarning is used.
+	CertExpiryWarning time.Duration
+
+	// OnCertExpiringSoon is called when an endpoint connects with a server
+	// certificate expiring within CertExpiryWarning.
+	OnCertExpiringSoon func(e Endpoint, notAfter time.Time)
+
 	// OnError is called each time a test on e failed, forcing Manager to
 	// fallback to the next endpoint. If e is nil, the error happended on the
 	// Provider.
@@ -72,6 +90,7 @@ type Manager struct {
 
 	mu             sync.RWMutex
 	activeEndpoint *activeEnpoint
+	endpoints      map[string]Endpoint // by name, as listed by the last test
 
 	testNewTransport func(e *DOHEndpoint) http.RoundTripper
 	testNow          func() time.Time
@@ -124,6 +143,12 @@ func (m *Manager) findBestEndpointLocked(ctx context.Context) (*activeEnpoint, e
 			}
 			continue
 		}
+		if m.Strategy != nil {
+			endpoints = m.Strategy.Order(endpoints)
+		}
+		for _, e := range endpoints {
+			m.addEndpointLocked(e)
+		}
 		for _, e := range endpoints {
 			if firstEndpoint == nil {
 				firstEndpoint = e
@@ -131,13 +156,7 @@ func (m *Manager) findBestEndpointLocked(ctx context.Context) (*activeEnpoint, e
 			ae := m.newActiveEndpointLocked(e)
 			ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 			defer cancel()
-			tester := e.Test
-			if m.EndpointTester != nil {
-				if t := m.EndpointTester(e); t != nil {
-					tester = t
-				}
-			}
-			if err = tester(ctx, TestDomain); err != nil {
+			if err = m.testEndpoint(ctx, e); err != nil {
 				if isErrNetUnreachable(err) {
 					// Do not report network unreachable errors, bubble them up.
 					return nil, err
@@ -156,6 +175,26 @@ func (m *Manager) findBestEndpointLocked(ctx context.Context) (*activeEnpoint, e
 	return ae, nil
 }
 
+// tester returns the Tester to use for e.
+func (m *Manager) tester(e Endpoint) Tester {
+	if m.EndpointTester != nil {
+		if t := m.EndpointTester(e); t != nil {
+			return t
+		}
+	}
+	return e.Test
+}
+
+// testEndpoint tests e and reports the result to Strategy.
+func (m *Manager) testEndpoint(ctx context.Context, e Endpoint) error {
+	start := time.Now()
+	err := m.tester(e)(ctx, TestDomain)
+	if m.Strategy != nil {
+		m.Strategy.Observe(e, time.Since(start), err)
+	}
+	return err
+}
+
 func isErrNetUnreachable(err error) bool {
 	for ; err != nil; err = errors.Unwrap(err) {
 		if sysErr, ok := err.(*os.SyscallError); ok {
@@ -187,14 +226,52 @@ func (m *Manager) newActiveEndpointLocked(e Endpoint) (ae *activeEnpoint) {
 	if m.testNow != nil {
 		ae.lastTest = m.testNow()
 	}
+	m.addEndpointLocked(e)
+	return ae
+}
+
+// addEndpointLocked registers e so it can be selected by name with
+// WithEndpoint, and sets up the hooks of the manager on e.
+func (m *Manager) addEndpointLocked(e Endpoint) {
+	if m.endpoints == nil {
+		m.endpoints = map[string]Endpoint{}
+	}
+	m.endpoints[e.String()] = e
 	if doh, ok := e.(*DOHEndpoint); ok {
 		if m.testNewTransport != nil {
 			// Used in unit test to provide fake transport.
+			doh.transportMu.Lock()
 			doh.transport = m.testNewTransport(doh)
+			doh.transportMu.Unlock()
+		}
+		var onConnect func(*ConnectInfo)
+		if m.OnConnect != nil || m.OnCertExpiringSoon != nil {
+			onConnect = func(ci *ConnectInfo) {
+				m.connected(doh, ci)
+			}
+		}
+		doh.setOnConnect(onConnect)
+	}
+}
+
+// connected is called each time e establishes a new connection.
+func (m *Manager) connected(e Endpoint, ci *ConnectInfo) {
+	if m.OnConnect != nil {
+		m.OnConnect(ci)
+	}
+	if m.OnCertExpiringSoon != nil && !ci.TLSCertExpiry.IsZero() {
+		warn := m.CertExpiryWarning
+		if warn == 0 {
+			warn = DefaultCertExpiryWarning
+		}
+		now := time.Now()
+		if m.testNow != nil {
+			now = m.testNow()
+		}
+		if ci.TLSCertExpiry.Sub(now) < warn {
+			m.OnCertExpiringSoon(e, ci.TLSCertExpiry)
 		}
-		doh.onConnect = m.OnConnect
 	}
-	return ae
 }
 
 func (m *Manager) getActiveEndpoint() (*activeEnpoint, error) {
@@ -224,6 +301,19 @@ func (m *Manager) getActiveEndpoint() (*activeEnpoint, error) {
 	return ae, nil
 }
 
+type endpointKey struct{}
+
+// WithEndpoint returns a copy of ctx requesting Manager Do to use the endpoint
+// with the given name, as returned by its String method, instead of the active
+// one. This lets callers keep queries on an endpoint chosen earlier. If the
+// endpoint is unknown to the manager or its action fails, Do fails over to the
+// active endpoint.
+func WithEndpoint(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, endpointKey{}, name)
+}
+
+// Do calls action with the active endpoint, or with the endpoint requested
+// with WithEndpoint, if any.
 func (m *Manager) Do(ctx context.Context, action func(e Endpoint) error) error {
 	ae, err := m.getActiveEndpoint()
 	if err != nil {
@@ -232,9 +322,67 @@ func (m *Manager) Do(ctx context.Context, action func(e Endpoint) error) error {
 	if ae == nil {
 		return errors.New("no active endpoint")
 	}
+	if name, _ := ctx.Value(endpointKey{}).(string); name != "" && name != ae.Endpoint.String() {
+		m.mu.RLock()
+		e := m.endpoints[name]
+		m.mu.RUnlock()
+		if e != nil {
+			if err = action(e); err == nil || ctx.Err() != nil {
+				return err
+			}
+			// Fail over to the active endpoint.
+		}
+	}
 	return ae.do(action)
 }
 
+// Health describes the state of the active endpoint as returned by
+// HealthCheck.
+type Health struct {
+	// Endpoint is the active endpoint at the time of the check.
+	Endpoint Endpoint
+
+	// Protocol is the protocol of Endpoint.
+	Protocol Protocol
+
+	// Healthy is true if the test of Endpoint succeeded.
+	Healthy bool
+
+	// Latency is the time it took to test Endpoint.
+	Latency time.Duration
+
+	// Error is the error returned by the test if not Healthy.
+	Error error
+}
+
+// HealthCheck tests the active endpoint and returns its health, so it can be
+// used for liveness or readiness checks. The active endpoint is left untouched
+// if healthy. Otherwise, a recovery test is triggered in the background the
+// same way it is after consecutive errors.
+func (m *Manager) HealthCheck(ctx context.Context) (Health, error) {
+	ae, err := m.getActiveEndpoint()
+	if err != nil {
+		return Health{}, err
+	}
+	if ae == nil {
+		return Health{}, errors.New("no active endpoint")
+	}
+	h := Health{Endpoint: ae.Endpoint, Protocol: ae.Endpoint.Protocol()}
+	start := time.Now()
+	err = m.tester(ae.Endpoint)(ctx, TestDomain)
+	h.Latency = time.Since(start)
+	if m.Strategy != nil {
+		m.Strategy.Observe(ae.Endpoint, h.Latency, err)
+	}
+	if err != nil {
+		h.Error = err
+		ae.test()
+		return h, nil
+	}
+	h.Healthy = true
+	return h, nil
+}
+
 // activeEnpoint handles request successes and errors and perform opportunistic
 // and recovery tests.
 type activeEnpoint struct {
@@ -207,3 +207,105 @@ func TestManager_OpportunisticTest(t *testing.T) {
 		})
 	}
 }
+
+func TestManager_CertExpiringSoon(t *testing.T) {
+	m := newTestManager(t)
+	var expiring []string
+	m.OnCertExpiringSoon = func(e Endpoint, notAfter time.Time) {
+		expiring = append(expiring, e.String())
+	}
+	e := &DOHEndpoint{Hostname: "a"}
+	m.connected(e, &ConnectInfo{Connect: true, TLSCertExpiry: m.now.Add(30 * 24 * time.Hour)})
+	m.connected(e, &ConnectInfo{Connect: true})
+	if len(expiring) != 0 {
+		t.Errorf("OnCertExpiringSoon called for %v, want no call", expiring)
+	}
+	m.connected(e, &ConnectInfo{Connect: true, TLSCertExpiry: m.now.Add(24 * time.Hour)})
+	if want := []string{"https://a"}; !reflect.DeepEqual(expiring, want) {
+		t.Errorf("OnCertExpiringSoon called for %v, want %v", expiring, want)
+	}
+}
+
+func TestManager_HealthCheck(t *testing.T) {
+	m := newTestManager(t)
+
+	_ = m.Test(context.Background())
+	m.wantElected(t, "https://a")
+
+	h, err := m.HealthCheck(context.Background())
+	if err != nil {
+		t.Fatalf("HealthCheck() err = %v", err)
+	}
+	if !h.Healthy || h.Endpoint.String() != "https://a" || h.Protocol != ProtocolDOH {
+		t.Errorf("HealthCheck() = %+v, want healthy https://a over doh", h)
+	}
+
+	m.transports["https://a"].errs = []error{errors.New("a failed")}
+	h, err = m.HealthCheck(context.Background())
+	if err != nil {
+		t.Fatalf("HealthCheck() err = %v", err)
+	}
+	if h.Healthy || h.Error == nil {
+		t.Errorf("HealthCheck() = %+v, want unhealthy", h)
+	}
+	for i := 0; i < 100; i++ { // recovery happens in a goroutine
+		runtime.Gosched()
+		time.Sleep(time.Millisecond)
+		m.mu.Lock()
+		elected := m.elected
+		m.mu.Unlock()
+		if elected == "https://b" {
+			break
+		}
+	}
+	m.wantElected(t, "https://b")
+}
+
+func TestManager_Strategy(t *testing.T) {
+	m := newTestManager(t)
+	m.Strategy = &RoundRobinStrategy{}
+
+	_ = m.Test(context.Background())
+	m.wantElected(t, "https://a")
+	_ = m.Test(context.Background())
+	m.wantElected(t, "https://b")
+	_ = m.Test(context.Background())
+	m.wantElected(t, "https://a")
+	m.wantErrors(t, []string{})
+}
+
+func TestManager_WithEndpoint(t *testing.T) {
+	m := newTestManager(t)
+	_ = m.Test(context.Background())
+	m.wantElected(t, "https://a")
+
+	do := func(ctx context.Context) (used []string) {
+		_ = m.Do(ctx, func(e Endpoint) error {
+			used = append(used, e.String())
+			_, err := e.(*DOHEndpoint).RoundTrip(&http.Request{})
+			return err
+		})
+		return used
+	}
+	for _, tt := range []struct {
+		name     string
+		endpoint string
+		bErrs    []error
+		want     []string
+	}{
+		{"active", "", nil, []string{"https://a"}},
+		{"override", "https://b", nil, []string{"https://b"}},
+		{"unknown", "https://c", nil, []string{"https://a"}},
+		{"failover", "https://b", []error{errors.New("b failed")}, []string{"https://b", "https://a"}},
+	} {
+		m.transports["https://b"].errs = tt.bErrs
+		ctx := context.Background()
+		if tt.endpoint != "" {
+			ctx = WithEndpoint(ctx, tt.endpoint)
+		}
+		if got := do(ctx); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Do() used %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	m.wantElected(t, "https://a")
+}
@@ -0,0 +1,192 @@
+package endpoint
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Check is the result of one of the checks performed by SelfTest.
+type Check struct {
+	Name        string        `json:"name"`
+	OK          bool          `json:"ok"`
+	Duration    time.Duration `json:"duration"`
+	Detail      string        `json:"detail,omitempty"`
+	Error       string        `json:"error,omitempty"`
+	Remediation string        `json:"remediation,omitempty"`
+}
+
+// Report is the result of SelfTest.
+type Report struct {
+	Endpoint string  `json:"endpoint"`
+	Protocol string  `json:"protocol"`
+	Checks   []Check `json:"checks"`
+}
+
+// OK returns true if all checks passed.
+func (r Report) OK() bool {
+	for _, c := range r.Checks {
+		if !c.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns a human readable version of the report.
+func (r Report) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s (%s)\n", r.Endpoint, r.Protocol)
+	for _, c := range r.Checks {
+		status := "PASS"
+		if !c.OK {
+			status = "FAIL"
+		}
+		fmt.Fprintf(&b, "  %s %s", status, c.Name)
+		if c.Duration > 0 {
+			fmt.Fprintf(&b, " %dms", c.Duration/time.Millisecond)
+		}
+		if c.Detail != "" {
+			fmt.Fprintf(&b, ": %s", c.Detail)
+		}
+		if c.Error != "" {
+			fmt.Fprintf(&b, ": %s", c.Error)
+		}
+		b.WriteByte('\n')
+		if c.Remediation != "" {
+			fmt.Fprintf(&b, "       %s\n", c.Remediation)
+		}
+	}
+	return b.String()
+}
+
+// SelfTest runs a series of checks on e to diagnose connectivity issues: for
+// DoH and DoT endpoints, TCP connectivity, TLS handshake, certificate chain
+// and negotiated protocol with each address, then a test query for all
+// endpoints. The returned error is only set if e is not supported.
+func SelfTest(ctx context.Context, e Endpoint) (Report, error) {
+	r := Report{
+		Endpoint: e.String(),
+		Protocol: e.Protocol().String(),
+	}
+	switch e := e.(type) {
+	case *DOHEndpoint:
+		config := e.tlsConfig()
+		config.NextProtos = []string{"h2", "http/1.1"}
+		for _, addr := range selfTestAddrs(e.Hostname, "443", e.Bootstrap) {
+			r.Checks = append(r.Checks, selfTestTLS(ctx, e.DialContext, addr, config)...)
+		}
+	case *DOTEndpoint:
+		for _, addr := range selfTestAddrs(e.Hostname, e.port(), e.Bootstrap) {
+			r.Checks = append(r.Checks, selfTestTLS(ctx, e.DialContext, addr, e.tlsConfig())...)
+		}
+	case *DNSEndpoint:
+	default:
+		return r, fmt.Errorf("unsupported endpoint type: %T", e)
+	}
+	c := Check{Name: "query"}
+	start := time.Now()
+	err := e.Test(ctx, TestDomain)
+	c.Duration = time.Since(start)
+	c.OK = err == nil
+	if err != nil {
+		c.Error = err.Error()
+		c.Remediation = "The server did not answer the test query; check the endpoint URL or address."
+	}
+	r.Checks = append(r.Checks, c)
+	return r, nil
+}
+
+// selfTestAddrs returns the addresses to test for a server with hostname,
+// reached on port with the bootstrap IPs if any.
+func selfTestAddrs(hostname, port string, bootstrap []string) []string {
+	if len(bootstrap) == 0 {
+		return []string{net.JoinHostPort(hostname, port)}
+	}
+	addrs := make([]string, 0, len(bootstrap))
+	for _, ip := range bootstrap {
+		addrs = append(addrs, net.JoinHostPort(ip, port))
+	}
+	return addrs
+}
+
+// selfTestTLS returns the connect, tls, certificate and protocol checks
+// performed against addr.
+func selfTestTLS(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error), addr string, config *tls.Config) []Check {
+	_, port, _ := net.SplitHostPort(addr)
+	connect := Check{Name: "connect " + addr}
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	start := time.Now()
+	conn, err := dial(ctx, "tcp", addr)
+	connect.Duration = time.Since(start)
+	if err != nil {
+		connect.Error = err.Error()
+		connect.Remediation = fmt.Sprintf("TCP/%s seems blocked or the address is unreachable from this network.", port)
+		return []Check{connect}
+	}
+	defer conn.Close()
+	connect.OK = true
+
+	handshake := Check{Name: "tls " + addr}
+	if t, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(t)
+	}
+	tc := tls.Client(conn, config)
+	start = time.Now()
+	err = tc.Handshake()
+	handshake.Duration = time.Since(start)
+	if err != nil {
+		handshake.Error = err.Error()
+		handshake.Remediation = "The TLS handshake failed; check the system clock and for TLS interception on this network."
+		return []Check{connect, handshake}
+	}
+	handshake.OK = true
+	cs := tc.ConnectionState()
+	return []Check{connect, handshake, certificateCheck(addr, cs), protocolCheck(addr, cs, config.NextProtos)}
+}
+
+// certificateCheck reports the certificate chain of cs, failing if the server
+// certificate expires within DefaultCertExpiryWarning.
+func certificateCheck(addr string, cs tls.ConnectionState) Check {
+	c := Check{Name: "certificate " + addr}
+	chain := cs.PeerCertificates
+	if len(cs.VerifiedChains) > 0 {
+		chain = cs.VerifiedChains[0]
+	}
+	if len(chain) == 0 {
+		c.Error = "no certificate"
+		return c
+	}
+	names := make([]string, 0, len(chain))
+	for _, cert := range chain {
+		names = append(names, cert.Subject.CommonName)
+	}
+	notAfter := chain[0].NotAfter
+	c.Detail = fmt.Sprintf("%s, expires %s", strings.Join(names, " < "), notAfter.Format("2006-01-02"))
+	c.OK = time.Until(notAfter) >= DefaultCertExpiryWarning
+	if !c.OK {
+		c.Error = "certificate expires soon"
+		c.Remediation = "Check the system clock; if it is right, the server certificate is about to expire."
+	}
+	return c
+}
+
+// protocolCheck reports the protocol negotiated with ALPN in cs among protos,
+// and the TLS version.
+func protocolCheck(addr string, cs tls.ConnectionState, protos []string) Check {
+	c := Check{Name: "protocol " + addr, OK: true}
+	proto := cs.NegotiatedProtocol
+	if proto == "" {
+		proto = "no ALPN"
+	}
+	c.Detail = fmt.Sprintf("%s, %s", proto, tlsVersion(cs.Version))
+	if len(protos) > 1 && cs.NegotiatedProtocol != protos[0] {
+		c.Remediation = fmt.Sprintf("%s unavailable, %s working.", protos[0], proto)
+	}
+	return c
+}
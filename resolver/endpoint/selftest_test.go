@@ -0,0 +1,80 @@
+package endpoint
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelfTest_DNS(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		buf := make([]byte, 514)
+		for {
+			n, addr, err := l.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = l.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	r, err := SelfTest(ctx, &DNSEndpoint{Addr: l.LocalAddr().String()})
+	if err != nil {
+		t.Fatalf("SelfTest() err = %v", err)
+	}
+	if !r.OK() || len(r.Checks) != 1 || r.Checks[0].Name != "query" {
+		t.Errorf("SelfTest() = %+v, want a passing query check", r)
+	}
+}
+
+func TestSelfTest_DOH(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	e := &DOHEndpoint{
+		Hostname:  "example.com",
+		Bootstrap: []string{"192.0.2.1"},
+		RootCAs:   roots,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+		},
+		transport: srv.Client().Transport,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	r, err := SelfTest(ctx, e)
+	if err != nil {
+		t.Fatalf("SelfTest() err = %v", err)
+	}
+	var names []string
+	for _, c := range r.Checks {
+		names = append(names, c.Name)
+	}
+	want := []string{"connect 192.0.2.1:443", "tls 192.0.2.1:443", "certificate 192.0.2.1:443", "protocol 192.0.2.1:443", "query"}
+	if !r.OK() || !reflect.DeepEqual(names, want) {
+		t.Fatalf("SelfTest() = %+v, want passing %v checks", r, want)
+	}
+	if got, want := r.Checks[3].Detail, "h2, TLS13"; got != want {
+		t.Errorf("protocol detail = %q, want %q", got, want)
+	}
+	if got := r.Checks[2].Detail; !strings.Contains(got, ", expires ") {
+		t.Errorf("certificate detail = %q, want the chain expiry", got)
+	}
+}
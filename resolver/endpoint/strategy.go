@@ -0,0 +1,205 @@
+package endpoint
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// SelectionStrategy defines the order in which the Manager tests the
+// endpoints of a provider, the first healthy one being selected.
+//
+// Implementations must be safe for concurrent use.
+type SelectionStrategy interface {
+	// Order returns endpoints in the order they should be tested. The
+	// endpoints slice must not be modified.
+	Order(endpoints []Endpoint) []Endpoint
+
+	// Observe is called with the result of each test performed on e.
+	Observe(e Endpoint, latency time.Duration, err error)
+}
+
+// ewmaWeight is the weight of the last observation in the moving averages
+// maintained by strategies.
+const ewmaWeight = 0.3
+
+func ewma(avg, v float64, seen bool) float64 {
+	if !seen {
+		return v
+	}
+	return avg + ewmaWeight*(v-avg)
+}
+
+// FastestStrategy orders endpoints by the moving average of their test
+// latency, fastest first. Endpoints not tested yet come first so they get
+// measured, and endpoints whose last test failed come last.
+type FastestStrategy struct {
+	mu    sync.Mutex
+	stats map[string]*fastestStat
+}
+
+type fastestStat struct {
+	latency float64
+	failed  bool
+}
+
+// Order implements the SelectionStrategy interface.
+func (s *FastestStrategy) Order(endpoints []Endpoint) []Endpoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rank := func(e Endpoint) (int, float64) {
+		st, found := s.stats[e.String()]
+		switch {
+		case !found:
+			return 0, 0
+		case st.failed:
+			return 2, st.latency
+		}
+		return 1, st.latency
+	}
+	ordered := append([]Endpoint(nil), endpoints...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		gi, li := rank(ordered[i])
+		gj, lj := rank(ordered[j])
+		if gi != gj {
+			return gi < gj
+		}
+		return li < lj
+	})
+	return ordered
+}
+
+// Observe implements the SelectionStrategy interface.
+func (s *FastestStrategy) Observe(e Endpoint, latency time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stats == nil {
+		s.stats = map[string]*fastestStat{}
+	}
+	st, found := s.stats[e.String()]
+	if !found {
+		st = &fastestStat{}
+		s.stats[e.String()] = st
+	}
+	st.failed = err != nil
+	if err == nil {
+		st.latency = ewma(st.latency, float64(latency), found)
+	}
+}
+
+// LowestErrorRateStrategy orders endpoints by the moving average of their
+// test failures, most reliable first. Endpoints with the same error rate keep
+// the order of their provider.
+type LowestErrorRateStrategy struct {
+	mu    sync.Mutex
+	rates map[string]float64
+}
+
+// Order implements the SelectionStrategy interface.
+func (s *LowestErrorRateStrategy) Order(endpoints []Endpoint) []Endpoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ordered := append([]Endpoint(nil), endpoints...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return s.rates[ordered[i].String()] < s.rates[ordered[j].String()]
+	})
+	return ordered
+}
+
+// Observe implements the SelectionStrategy interface.
+func (s *LowestErrorRateStrategy) Observe(e Endpoint, latency time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rates == nil {
+		s.rates = map[string]float64{}
+	}
+	var v float64
+	if err != nil {
+		v = 1
+	}
+	rate, found := s.rates[e.String()]
+	s.rates[e.String()] = ewma(rate, v, found)
+}
+
+// RoundRobinStrategy rotates the order in which endpoints are tested each
+// time the Manager selects an endpoint: on the first query, on opportunistic
+// tests and on failover. All the queries are sent to the selected endpoint
+// until the next selection, so the load is spread over time rather than per
+// request. If Weight is set, an endpoint is given as many turns as its weight.
+type RoundRobinStrategy struct {
+	// Weight returns the weight of e. Endpoints with a weight lower than 1
+	// are given one turn. If nil, all endpoints have a weight of 1.
+	Weight func(e Endpoint) int
+
+	mu   sync.Mutex
+	next int
+}
+
+// Order implements the SelectionStrategy interface.
+func (s *RoundRobinStrategy) Order(endpoints []Endpoint) []Endpoint {
+	if len(endpoints) == 0 {
+		return endpoints
+	}
+	var turns []int // index of the endpoint of each turn
+	for i, e := range endpoints {
+		w := 1
+		if s.Weight != nil {
+			if w = s.Weight(e); w < 1 {
+				w = 1
+			}
+		}
+		for ; w > 0; w-- {
+			turns = append(turns, i)
+		}
+	}
+	s.mu.Lock()
+	start := s.next % len(turns)
+	s.next = start + 1
+	s.mu.Unlock()
+	ordered := make([]Endpoint, 0, len(endpoints))
+	seen := make([]bool, len(endpoints))
+	for k := range turns {
+		if i := turns[(start+k)%len(turns)]; !seen[i] {
+			seen[i] = true
+			ordered = append(ordered, endpoints[i])
+		}
+	}
+	return ordered
+}
+
+// Observe implements the SelectionStrategy interface.
+func (s *RoundRobinStrategy) Observe(e Endpoint, latency time.Duration, err error) {}
+
+// StickyStrategy keeps the selected endpoint first as long as its tests
+// succeed, so opportunistic tests do not switch back to a preferred endpoint.
+// When it fails, the endpoints following it in the provider order are tried
+// in turn, the first healthy one becoming the new sticky endpoint.
+type StickyStrategy struct {
+	mu      sync.Mutex
+	current string
+}
+
+// Order implements the SelectionStrategy interface.
+func (s *StickyStrategy) Order(endpoints []Endpoint) []Endpoint {
+	s.mu.Lock()
+	current := s.current
+	s.mu.Unlock()
+	for i, e := range endpoints {
+		if e.String() == current {
+			ordered := make([]Endpoint, 0, len(endpoints))
+			ordered = append(ordered, endpoints[i:]...)
+			return append(ordered, endpoints[:i]...)
+		}
+	}
+	return endpoints
+}
+
+// Observe implements the SelectionStrategy interface.
+func (s *StickyStrategy) Observe(e Endpoint, latency time.Duration, err error) {
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current = e.String()
+}
@@ -0,0 +1,101 @@
+package endpoint
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func endpointNames(endpoints []Endpoint) []string {
+	names := make([]string, 0, len(endpoints))
+	for _, e := range endpoints {
+		names = append(names, e.String())
+	}
+	return names
+}
+
+func testEndpoints() []Endpoint {
+	return []Endpoint{
+		&DNSEndpoint{Addr: "a"},
+		&DNSEndpoint{Addr: "b"},
+		&DNSEndpoint{Addr: "c"},
+	}
+}
+
+func TestFastestStrategy(t *testing.T) {
+	endpoints := testEndpoints()
+	s := &FastestStrategy{}
+	s.Observe(endpoints[0], 30*time.Millisecond, nil)
+	s.Observe(endpoints[1], 10*time.Millisecond, errors.New("failed"))
+	if got, want := endpointNames(s.Order(endpoints)), []string{"c", "a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Order() = %v, want %v", got, want)
+	}
+	s.Observe(endpoints[1], 10*time.Millisecond, nil)
+	s.Observe(endpoints[2], 20*time.Millisecond, nil)
+	if got, want := endpointNames(s.Order(endpoints)), []string{"b", "c", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Order() = %v, want %v", got, want)
+	}
+	if got := endpointNames(endpoints); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("Order() modified its input: %v", got)
+	}
+}
+
+func TestLowestErrorRateStrategy(t *testing.T) {
+	endpoints := testEndpoints()
+	s := &LowestErrorRateStrategy{}
+	s.Observe(endpoints[0], 0, errors.New("failed"))
+	s.Observe(endpoints[1], 0, errors.New("failed"))
+	s.Observe(endpoints[1], 0, nil)
+	if got, want := endpointNames(s.Order(endpoints)), []string{"c", "b", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Order() = %v, want %v", got, want)
+	}
+}
+
+func TestRoundRobinStrategy(t *testing.T) {
+	endpoints := testEndpoints()
+	s := &RoundRobinStrategy{
+		Weight: func(e Endpoint) int {
+			if e.String() == "a" {
+				return 2
+			}
+			return 1
+		},
+	}
+	want := [][]string{
+		{"a", "b", "c"},
+		{"a", "b", "c"},
+		{"b", "c", "a"},
+		{"c", "a", "b"},
+		{"a", "b", "c"},
+	}
+	for i, w := range want {
+		if got := endpointNames(s.Order(endpoints)); !reflect.DeepEqual(got, w) {
+			t.Errorf("Order() #%d = %v, want %v", i, got, w)
+		}
+	}
+}
+
+func TestStickyStrategy(t *testing.T) {
+	endpoints := testEndpoints()
+	s := &StickyStrategy{}
+	if got, want := endpointNames(s.Order(endpoints)), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Order() = %v, want %v", got, want)
+	}
+	// a fails over to b, which stays first once a recovers.
+	s.Observe(endpoints[0], 0, errors.New("failed"))
+	s.Observe(endpoints[1], 0, nil)
+	s.Observe(endpoints[0], 0, errors.New("failed"))
+	if got, want := endpointNames(s.Order(endpoints)), []string{"b", "c", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Order() = %v, want %v", got, want)
+	}
+	// b fails over to the next one, c.
+	s.Observe(endpoints[1], 0, errors.New("failed"))
+	s.Observe(endpoints[2], 0, nil)
+	if got, want := endpointNames(s.Order(endpoints)), []string{"c", "a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Order() = %v, want %v", got, want)
+	}
+	if got := endpointNames(endpoints); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("Order() modified its input: %v", got)
+	}
+}
@@ -15,6 +15,10 @@ type ConnectInfo struct {
 	ConnectTimes map[string]time.Duration
 	TLSTime      time.Duration
 	TLSVersion   string
+	// Protocol is the application protocol negotiated with ALPN, like h2.
+	Protocol string
+	// TLSCertExpiry is the NotAfter time of the server's leaf certificate.
+	TLSCertExpiry time.Time
 }
 
 type timer struct {
@@ -50,6 +54,10 @@ func withConnectInfo(ctx context.Context) (context.Context, *ConnectInfo) {
 		TLSHandshakeDone: func(cs tls.ConnectionState, err error) {
 			ci.TLSTime = time.Since(tlsStart)
 			ci.TLSVersion = tlsVersion(cs.Version)
+			ci.Protocol = cs.NegotiatedProtocol
+			if len(cs.PeerCertificates) > 0 {
+				ci.TLSCertExpiry = cs.PeerCertificates[0].NotAfter
+			}
 		},
 		GotConn: func(hci httptrace.GotConnInfo) {
 			mu.Lock()
@@ -2,7 +2,6 @@ package endpoint
 
 import (
 	"context"
-	"crypto/tls"
 	"net"
 	"net/http"
 	"runtime"
@@ -18,26 +17,68 @@ type transport struct {
 func newTransport(e *DOHEndpoint) transport {
 	var addr string
 	var addrs []string
-	if len(e.Bootstrap) != 0 {
-		addr = net.JoinHostPort(e.Bootstrap[0], "443")
-		for _, addr := range e.Bootstrap {
+	bootstrap := e.AddressFamily.filter(e.Bootstrap)
+	if len(bootstrap) != 0 {
+		addr = net.JoinHostPort(bootstrap[0], "443")
+		for _, addr := range bootstrap {
 			addrs = append(addrs, net.JoinHostPort(addr, "443"))
 		}
 	} else {
 		addr = e.Hostname
 	}
-	d := &parallelDialer{}
+	// All Bootstrap IPs are excluded by AddressFamily.
+	excluded := len(e.Bootstrap) != 0 && len(bootstrap) == 0
+	v6Only := allIPv6(addrs)
+	d := &parallelDialer{
+		Stagger:  e.DialStagger,
+		DialFunc: e.DialContext,
+		OnDialError: func(addr string, err error) {
+			e.addDialError(addr)
+		},
+		OnFailover: e.addFailover,
+	}
 	d.FallbackDelay = -1 // disable happy eyeball, we do our own
+	d.Timeout = e.DialTimeout
+	d.KeepAlive = e.KeepAlive
 	t := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			ServerName: e.Hostname,
-		},
-		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			if addrs != nil {
-				return d.DialParallel(ctx, network, addrs)
+		TLSClientConfig:     e.tlsConfig(),
+		TLSHandshakeTimeout: e.DialTimeout,
+		IdleConnTimeout:     e.IdleConnTimeout,
+		DialContext: func(ctx context.Context, network, addr string) (c net.Conn, err error) {
+			if err = conns.acquire(e); err != nil {
+				return nil, err
+			}
+			defer func() {
+				if err != nil {
+					conns.release()
+				}
+			}()
+			switch {
+			case excluded:
+				return nil, ErrNoUsableBootstrap
+			case e.Proxy != nil:
+				// addr is the proxy, or the first Bootstrap IP if the request
+				// is not proxied.
+				c, err = d.dial(ctx, network, addr)
+			case v6Only && !hasIPv6Route():
+				// Fail fast instead of waiting for each dial to timeout.
+				return nil, ErrNoUsableBootstrap
+			case addrs != nil:
+				c, err = d.DialParallel(ctx, network, addrs)
+			default:
+				c, err = d.dial(ctx, network, addr)
 			}
-			return d.DialContext(ctx, network, addr)
+			if err != nil {
+				if e.Proxy != nil || addrs == nil {
+					// DialParallel reports its own errors.
+					e.addDialError(addr)
+				}
+				return nil, err
+			}
+			e.addConnection(c.RemoteAddr().String())
+			return countingConn{Conn: conns.track(c), add: e.addDataUsage}, nil
 		},
+		Proxy:             e.Proxy,
 		ForceAttemptHTTP2: true,
 	}
 	runtime.SetFinalizer(t, func(t *http.Transport) {
@@ -52,6 +93,11 @@ func newTransport(e *DOHEndpoint) transport {
 }
 
 func (t transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Route the request without modifying the caller's one.
+	r := *req
+	u := *req.URL
+	r.URL = &u
+	req = &r
 	req.URL.Host = t.addr
 	req.Host = t.hostname
 	if t.path != "" {
@@ -59,3 +105,9 @@ func (t transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	}
 	return t.RoundTripper.RoundTrip(req)
 }
+
+func (t transport) CloseIdleConnections() {
+	if c, ok := t.RoundTripper.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,440 @@
+package endpoint
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewTransport_RootCAs(t *testing.T) {
+	pool := x509.NewCertPool()
+	tr := newTransport(&DOHEndpoint{Hostname: "a", RootCAs: pool})
+	if got := tr.RoundTripper.(*http.Transport).TLSClientConfig.RootCAs; got != pool {
+		t.Errorf("TLSClientConfig.RootCAs = %v, want %v", got, pool)
+	}
+}
+
+func TestNewTransport_TLSConfig(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	tests := []struct {
+		name    string
+		config  *tls.Config
+		wantErr bool
+	}{
+		{"SystemRoots", nil, true},
+		{"CustomRoots", &tls.Config{RootCAs: pool}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The test server certificate is valid for example.com.
+			e := &DOHEndpoint{Hostname: "example.com", TLSConfig: tt.config}
+			tr := newTransport(e).RoundTripper.(*http.Transport)
+			defer tr.CloseIdleConnections()
+			req, _ := http.NewRequest("GET", srv.URL, nil)
+			res, err := tr.RoundTrip(req)
+			if err == nil {
+				res.Body.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("RoundTrip() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.config != nil && tt.config.ServerName != "" {
+				t.Errorf("TLSConfig was modified")
+			}
+		})
+	}
+}
+
+func TestNewTransport_DialContext(t *testing.T) {
+	errDial := errors.New("dial")
+	var addrs []string
+	e := &DOHEndpoint{
+		Hostname:  "a",
+		Bootstrap: []string{"192.0.2.1"},
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			addrs = append(addrs, addr)
+			return nil, errDial
+		},
+	}
+	dial := newTransport(e).RoundTripper.(*http.Transport).DialContext
+	if _, err := dial(context.Background(), "tcp", "a:443"); err != errDial {
+		t.Errorf("DialContext() err = %v, want %v", err, errDial)
+	}
+	if want := []string{"192.0.2.1:443"}; !reflect.DeepEqual(addrs, want) {
+		t.Errorf("DialContext called with %v, want %v", addrs, want)
+	}
+}
+
+// startConnectProxy starts an HTTP proxy tunneling all CONNECT requests to
+// target. The requested hosts are sent to tunnels.
+func startConnectProxy(t *testing.T, target string, tunnels chan<- string) (u *url.URL, stop func()) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				req, err := http.ReadRequest(br)
+				if err != nil || req.Method != "CONNECT" {
+					return
+				}
+				tunnels <- req.Host
+				tc, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer tc.Close()
+				_, _ = io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go func() { _, _ = io.Copy(tc, br) }()
+				_, _ = io.Copy(c, tc)
+			}()
+		}
+	}()
+	return &url.URL{Scheme: "http", Host: l.Addr().String()}, func() { l.Close() }
+}
+
+func TestNewTransport_Proxy(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	tunnels := make(chan string, 10)
+	proxyURL, stop := startConnectProxy(t, srv.Listener.Addr().String(), tunnels)
+	defer stop()
+
+	// The test server certificate is valid for example.com.
+	e := &DOHEndpoint{
+		Hostname:  "example.com",
+		Bootstrap: []string{"192.0.2.1", "192.0.2.2"},
+		TLSConfig: &tls.Config{RootCAs: pool},
+		Proxy:     http.ProxyURL(proxyURL),
+	}
+	defer e.Close()
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", "https://example.com/", nil)
+		res, err := e.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("RoundTrip() err = %v", err)
+		}
+		_, _ = io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+	}
+	close(tunnels)
+	var hosts []string
+	for host := range tunnels {
+		hosts = append(hosts, host)
+	}
+	if want := []string{"192.0.2.1:443"}; !reflect.DeepEqual(hosts, want) {
+		t.Errorf("tunnels = %v, want %v", hosts, want)
+	}
+}
+
+func TestTransport_RoundTrip(t *testing.T) {
+	var got *http.Request
+	tr := newTransport(&DOHEndpoint{Hostname: "dns.nextdns.io", Path: "/abcdef", Bootstrap: []string{"45.90.28.0"}})
+	tr.RoundTripper = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		got = req
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	})
+	req, _ := http.NewRequest("GET", "https://dns.nextdns.io?name=test.com", nil)
+	if _, err := tr.RoundTrip(req); err != nil {
+		t.Fatalf("RoundTrip() err = %v", err)
+	}
+	if got.URL.Host != "45.90.28.0:443" || got.Host != "dns.nextdns.io" || got.URL.Path != "/abcdef" {
+		t.Errorf("RoundTrip() sent host %s, Host header %s, path %s", got.URL.Host, got.Host, got.URL.Path)
+	}
+	if req.URL.Host != "dns.nextdns.io" || req.URL.Path != "" {
+		t.Errorf("RoundTrip() modified the request URL to %s", req.URL)
+	}
+}
+
+func TestNewTransport_PinnedSPKI(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	pin := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+
+	tests := []struct {
+		name    string
+		pins    [][]byte
+		wantErr error
+	}{
+		{"Match", [][]byte{make([]byte, 32), pin[:]}, nil},
+		{"Mismatch", [][]byte{make([]byte, 32)}, ErrPinMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The test server certificate is valid for example.com.
+			e := &DOHEndpoint{
+				Hostname:   "example.com",
+				TLSConfig:  &tls.Config{RootCAs: pool},
+				PinnedSPKI: tt.pins,
+			}
+			tr := newTransport(e).RoundTripper.(*http.Transport)
+			defer tr.CloseIdleConnections()
+			req, _ := http.NewRequest("GET", srv.URL, nil)
+			res, err := tr.RoundTrip(req)
+			if err == nil {
+				res.Body.Close()
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("RoundTrip() err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// newTestCert returns a certificate for example.com signed by parent, or
+// self-signed if parent is nil, with its key.
+func newTestCert(t *testing.T, serial int64, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: fmt.Sprintf("test %d", serial)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		DNSNames:              []string{"example.com"},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestNewTransport_PinnedSPKIUnchained(t *testing.T) {
+	ca, caKey := newTestCert(t, 1, nil, nil)
+	leaf, leafKey := newTestCert(t, 2, ca, caKey)
+	pinned, _ := newTestCert(t, 3, nil, nil)
+
+	// The server sends a valid chain plus the pinned certificate, which is
+	// not part of the chain.
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{{
+		Certificate: [][]byte{leaf.Raw, pinned.Raw},
+		PrivateKey:  leafKey,
+	}}}
+	srv.StartTLS()
+	defer srv.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	pin := sha256.Sum256(pinned.RawSubjectPublicKeyInfo)
+	caPin := sha256.Sum256(ca.RawSubjectPublicKeyInfo)
+	tests := []struct {
+		name    string
+		pin     []byte
+		wantErr error
+	}{
+		{"Unchained", pin[:], ErrPinMismatch},
+		{"Chained", caPin[:], nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &DOHEndpoint{
+				Hostname:   "example.com",
+				TLSConfig:  &tls.Config{RootCAs: pool},
+				PinnedSPKI: [][]byte{tt.pin},
+			}
+			tr := newTransport(e).RoundTripper.(*http.Transport)
+			defer tr.CloseIdleConnections()
+			req, _ := http.NewRequest("GET", srv.URL, nil)
+			res, err := tr.RoundTrip(req)
+			if err == nil {
+				res.Body.Close()
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("RoundTrip() err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewTransport_DialTimeout(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond) // slower than DialTimeout
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	// The test server certificate is valid for example.com.
+	e := &DOHEndpoint{
+		Hostname:    "example.com",
+		Bootstrap:   []string{"192.0.2.1", "192.0.2.2"},
+		TLSConfig:   &tls.Config{RootCAs: pool},
+		DialTimeout: 100 * time.Millisecond,
+		DialStagger: time.Hour, // only dial the next IP once the first failed
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if addr == "192.0.2.1:443" {
+				<-ctx.Done() // blackholed
+				return nil, ctx.Err()
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, srv.Listener.Addr().String())
+		},
+	}
+	defer e.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	start := time.Now()
+	req, _ := http.NewRequest("GET", "https://example.com/", nil)
+	res, err := e.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		t.Fatalf("RoundTrip() err = %v", err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil || string(b) != "ok" {
+		t.Errorf("response body = %q, %v, want ok", b, err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > time.Second {
+		t.Errorf("RoundTrip() took %v, want about 400ms", elapsed)
+	}
+}
+
+func TestNewTransport_IdleConnTimeout(t *testing.T) {
+	tr := newTransport(&DOHEndpoint{Hostname: "a", IdleConnTimeout: 90 * time.Second})
+	if got, want := tr.RoundTripper.(*http.Transport).IdleConnTimeout, 90*time.Second; got != want {
+		t.Errorf("IdleConnTimeout = %v, want %v", got, want)
+	}
+}
+
+func TestDOHEndpoint_CancelStream(t *testing.T) {
+	started := make(chan struct{})
+	reset := make(chan struct{})
+	var conns int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-r.Context().Done() // stream reset by the client
+			close(reset)
+			return
+		}
+		_, _ = io.WriteString(w, "ok")
+	}))
+	srv.EnableHTTP2 = true
+	srv.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	// The test server certificate is valid for example.com.
+	t2 := &http.Transport{
+		TLSClientConfig:   &tls.Config{ServerName: "example.com", RootCAs: pool},
+		ForceAttemptHTTP2: true,
+	}
+	defer t2.CloseIdleConnections()
+	e := &DOHEndpoint{
+		Hostname: "example.com",
+		transport: transport{
+			RoundTripper: t2,
+			hostname:     "example.com",
+			addr:         srv.Listener.Addr().String(),
+		},
+	}
+	get := func(ctx context.Context, path string) error {
+		req, _ := http.NewRequest("GET", "https://example.com"+path, nil)
+		res, err := e.RoundTrip(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.ProtoMajor != 2 {
+			return fmt.Errorf("protocol %s, want HTTP/2", res.Proto)
+		}
+		b, err := ioutil.ReadAll(res.Body)
+		if err == nil && string(b) != "ok" {
+			err = fmt.Errorf("body %q, want ok", b)
+		}
+		return err
+	}
+	// Establish the connection shared by all the streams.
+	if err := get(context.Background(), "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	slowErr := make(chan error, 1)
+	go func() { slowErr <- get(ctx, "/slow") }()
+	<-started
+	const concurrent = 10
+	errs := make(chan error, concurrent)
+	for i := 0; i < concurrent; i++ {
+		go func() { errs <- get(context.Background(), "/") }()
+	}
+	cancel()
+	if err := <-slowErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled RoundTrip() err = %v, want %v", err, context.Canceled)
+	}
+	select {
+	case <-reset:
+	case <-time.After(2 * time.Second):
+		t.Fatal("cancelled stream not reset on the server")
+	}
+	for i := 0; i < concurrent; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("concurrent RoundTrip() err = %v", err)
+		}
+	}
+	// The connection is still usable once the stream is reset.
+	if err := get(context.Background(), "/"); err != nil {
+		t.Errorf("RoundTrip() after cancel err = %v", err)
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("connections = %d, want 1", n)
+	}
+}
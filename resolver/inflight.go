@@ -0,0 +1,66 @@
+package resolver
+
+import (
+	"context"
+	"sync"
+)
+
+// inflight coalesces concurrent identical queries.
+type inflight struct {
+	mu    sync.Mutex
+	calls map[inflightKey]*inflightCall
+}
+
+type inflightKey struct {
+	url string
+	ci  ClientInfo
+	msg string // query message without its ID
+}
+
+type inflightCall struct {
+	done chan struct{}
+	n    int
+	msg  []byte
+	i    ResolveInfo
+	err  error
+}
+
+// do calls fetch with buf and returns its result. If an identical call is
+// already in flight, fetch is not called: the result of the in flight call is
+// copied to buf instead, with the message ID set to id.
+func (f *inflight) do(ctx context.Context, key inflightKey, buf []byte, id uint16, fetch func(buf []byte) (int, ResolveInfo, error)) (int, ResolveInfo, error) {
+	f.mu.Lock()
+	if c, found := f.calls[key]; found {
+		f.mu.Unlock()
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return -1, ResolveInfo{}, ctx.Err()
+		}
+		if c.n <= 0 {
+			return c.n, c.i, c.err
+		}
+		n := copy(buf, c.msg)
+		if n >= 2 {
+			packUint16(buf, id)
+		}
+		return n, c.i, c.err
+	}
+	c := &inflightCall{done: make(chan struct{})}
+	if f.calls == nil {
+		f.calls = map[inflightKey]*inflightCall{}
+	}
+	f.calls[key] = c
+	f.mu.Unlock()
+
+	c.n, c.i, c.err = fetch(buf)
+	if c.n > 0 {
+		c.msg = make([]byte, c.n)
+		copy(c.msg, buf[:c.n])
+	}
+	f.mu.Lock()
+	delete(f.calls, key)
+	f.mu.Unlock()
+	close(c.done)
+	return c.n, c.i, c.err
+}
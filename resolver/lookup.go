@@ -0,0 +1,230 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+
+	"github.com/nextdns/nextdns/internal/dnsmessage"
+	"github.com/nextdns/nextdns/resolver/query"
+)
+
+// maxCNAMEChain is the maximum number of CNAME records followed by a lookup.
+const maxCNAMEChain = 8
+
+// Lookup performs net.Resolver style lookups using Resolver, so any endpoint
+// supported by Resolver can be used to resolve host names.
+type Lookup struct {
+	Resolver Resolver
+}
+
+// LookupHost looks up host and returns a slice of its IPv4 and IPv6
+// addresses.
+func (l Lookup) LookupHost(ctx context.Context, host string) ([]string, error) {
+	ips, err := l.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, ip.String())
+	}
+	return addrs, nil
+}
+
+// LookupIPAddr looks up host and returns a slice of its IPv4 and IPv6
+// addresses. The A and AAAA queries are sent concurrently and their results
+// merged, IPv4 addresses first. An error is only returned if both queries
+// failed or no address was found.
+func (l Lookup) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	name := host
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	type result struct {
+		ips []net.IPAddr
+		err error
+	}
+	ch := make(chan result, 2)
+	for _, qtype := range []query.Type{query.TypeA, query.TypeAAAA} {
+		go func(qtype query.Type) {
+			ips, err := l.lookup(ctx, name, qtype)
+			ch <- result{ips, err}
+		}(qtype)
+	}
+	var ips4, ips6 []net.IPAddr
+	var err error
+	for i := 0; i < 2; i++ {
+		r := <-ch
+		if r.err != nil {
+			if err == nil || isNotFound(err) {
+				err = r.err
+			}
+			continue
+		}
+		for _, ip := range r.ips {
+			if ip.IP.To4() != nil {
+				ips4 = append(ips4, ip)
+			} else {
+				ips6 = append(ips6, ip)
+			}
+		}
+	}
+	ips := append(ips4, ips6...)
+	if len(ips) == 0 {
+		if err == nil {
+			err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return nil, err
+	}
+	return ips, nil
+}
+
+// lookup resolves the addresses of type qtype of the fully qualified name,
+// following CNAMEs not resolved by the upstream.
+func (l Lookup) lookup(ctx context.Context, name string, qtype query.Type) ([]net.IPAddr, error) {
+	buf := make([]byte, 65535)
+	for hops := 0; hops <= maxCNAMEChain; {
+		payload, err := newQuery(name, qtype)
+		if err != nil {
+			return nil, &net.DNSError{Err: err.Error(), Name: name}
+		}
+		q := query.Query{
+			ID:      unpackUint16(payload),
+			Class:   query.ClassINET,
+			Type:    qtype,
+			Name:    name,
+			Payload: payload,
+		}
+		n, _, err := l.Resolver.Resolve(ctx, q, buf)
+		if err != nil && n <= 0 {
+			return nil, &net.DNSError{Err: err.Error(), Name: name, IsTimeout: ctx.Err() == context.DeadlineExceeded}
+		}
+		ips, target, chain, err := parseAnswers(buf[:n], name, qtype)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) > 0 || target == name {
+			return ips, nil
+		}
+		// The upstream returned a CNAME chain without the addresses of its
+		// target: resolve the target.
+		name = target
+		hops += chain
+	}
+	return nil, &net.DNSError{Err: "too many CNAME records", Name: name}
+}
+
+// newQuery returns a recursive DNS query for name and qtype with a random ID.
+func newQuery(name string, qtype query.Type) ([]byte, error) {
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), dnsmessage.Header{
+		ID:               uint16(rand.Intn(1 << 16)),
+		RecursionDesired: true,
+	})
+	_ = b.StartQuestions()
+	if err := b.Question(dnsmessage.Question{
+		Name:  n,
+		Type:  dnsmessage.Type(qtype),
+		Class: dnsmessage.ClassINET,
+	}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// parseAnswers returns the addresses of type qtype of name found in the answer
+// section of msg, following the CNAME chain starting at name. target is the
+// last name of the chain and chain its length.
+func parseAnswers(msg []byte, name string, qtype query.Type) (ips []net.IPAddr, target string, chain int, err error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return nil, "", 0, badResponse(name, err)
+	}
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, "", 0, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	default:
+		return nil, "", 0, &net.DNSError{Err: fmt.Sprintf("server misbehaving: %v", h.RCode), Name: name}
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, "", 0, badResponse(name, err)
+	}
+	cnames := map[string]string{}
+	type record struct {
+		owner string
+		ip    net.IP
+	}
+	var records []record
+	for {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, "", 0, badResponse(name, err)
+		}
+		owner := strings.ToLower(rh.Name.String())
+		switch {
+		case rh.Type == dnsmessage.TypeCNAME:
+			r, err := p.CNAMEResource()
+			if err != nil {
+				return nil, "", 0, badResponse(name, err)
+			}
+			cnames[owner] = strings.ToLower(r.CNAME.String())
+		case rh.Type == dnsmessage.TypeA && qtype == query.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return nil, "", 0, badResponse(name, err)
+			}
+			records = append(records, record{owner, net.IP(r.A[:])})
+		case rh.Type == dnsmessage.TypeAAAA && qtype == query.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return nil, "", 0, badResponse(name, err)
+			}
+			records = append(records, record{owner, net.IP(r.AAAA[:])})
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return nil, "", 0, badResponse(name, err)
+			}
+		}
+	}
+	target = strings.ToLower(name)
+	for next, found := cnames[target]; found; next, found = cnames[target] {
+		if chain++; chain > maxCNAMEChain {
+			return nil, "", 0, &net.DNSError{Err: "too many CNAME records", Name: name}
+		}
+		target = next
+	}
+	for _, r := range records {
+		if r.owner == target {
+			ips = append(ips, net.IPAddr{IP: r.ip})
+		}
+	}
+	if chain == 0 {
+		target = name
+	}
+	return ips, target, chain, nil
+}
+
+// badResponse returns the error reported when the response to the query of
+// name cannot be parsed.
+func badResponse(name string, err error) error {
+	return &net.DNSError{Err: fmt.Sprintf("cannot parse response: %v", err), Name: name}
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(*net.DNSError)
+	return ok && e.IsNotFound
+}
@@ -0,0 +1,152 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/nextdns/nextdns/internal/dnsmessage"
+	"github.com/nextdns/nextdns/resolver/query"
+)
+
+// zoneResolver is a Resolver answering queries from canned records.
+type zoneResolver struct {
+	rcode   dnsmessage.RCode
+	records map[string][]dnsmessage.Resource // by lowercased "name type"
+	err     error
+}
+
+func (r zoneResolver) Resolve(ctx context.Context, q query.Query, buf []byte) (int, ResolveInfo, error) {
+	if r.err != nil {
+		return 0, ResolveInfo{}, r.err
+	}
+	b := dnsmessage.NewBuilder(buf[:0], dnsmessage.Header{ID: q.ID, Response: true, RCode: r.rcode})
+	_ = b.StartQuestions()
+	_ = b.StartAnswers()
+	for _, rr := range r.records[q.Name+" "+q.Type.String()] {
+		var err error
+		switch body := rr.Body.(type) {
+		case *dnsmessage.CNAMEResource:
+			err = b.CNAMEResource(rr.Header, *body)
+		case *dnsmessage.AResource:
+			err = b.AResource(rr.Header, *body)
+		case *dnsmessage.AAAAResource:
+			err = b.AAAAResource(rr.Header, *body)
+		}
+		if err != nil {
+			return 0, ResolveInfo{}, err
+		}
+	}
+	msg, err := b.Finish()
+	return len(msg), ResolveInfo{}, err
+}
+
+func cnameRR(name, target string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET},
+		Body:   &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(target)},
+	}
+}
+
+func addrRR(name, ip string) dnsmessage.Resource {
+	h := dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Class: dnsmessage.ClassINET}
+	if ip4 := net.ParseIP(ip).To4(); ip4 != nil {
+		h.Type = dnsmessage.TypeA
+		var a [4]byte
+		copy(a[:], ip4)
+		return dnsmessage.Resource{Header: h, Body: &dnsmessage.AResource{A: a}}
+	}
+	h.Type = dnsmessage.TypeAAAA
+	var a [16]byte
+	copy(a[:], net.ParseIP(ip))
+	return dnsmessage.Resource{Header: h, Body: &dnsmessage.AAAAResource{AAAA: a}}
+}
+
+func TestLookup_LookupIPAddr(t *testing.T) {
+	tests := []struct {
+		name     string
+		resolver zoneResolver
+		host     string
+		want     []string
+		notFound bool
+	}{
+		{
+			name: "A and AAAA",
+			resolver: zoneResolver{records: map[string][]dnsmessage.Resource{
+				"test.com. A":    {addrRR("test.com.", "1.2.3.4"), addrRR("test.com.", "1.2.3.5")},
+				"test.com. AAAA": {addrRR("test.com.", "2001:db8::1")},
+			}},
+			host: "test.com",
+			want: []string{"1.2.3.4", "1.2.3.5", "2001:db8::1"},
+		},
+		{
+			name: "A only",
+			resolver: zoneResolver{records: map[string][]dnsmessage.Resource{
+				"test.com. A": {addrRR("test.com.", "1.2.3.4")},
+			}},
+			host: "test.com.",
+			want: []string{"1.2.3.4"},
+		},
+		{
+			name: "CNAME chain",
+			resolver: zoneResolver{records: map[string][]dnsmessage.Resource{
+				"www.test.com. A": {
+					cnameRR("www.test.com.", "cdn.test.net."),
+					cnameRR("cdn.test.net.", "edge.test.org."),
+					addrRR("edge.test.org.", "1.2.3.4"),
+					addrRR("other.test.org.", "5.6.7.8"),
+				},
+				"www.test.com. AAAA": {cnameRR("www.test.com.", "cdn.test.net.")},
+				// The target of the chain is resolved when not in the response.
+				"cdn.test.net. AAAA": {addrRR("cdn.test.net.", "2001:db8::1")},
+			}},
+			host: "www.test.com",
+			want: []string{"1.2.3.4", "2001:db8::1"},
+		},
+		{
+			name:     "NXDOMAIN",
+			resolver: zoneResolver{rcode: dnsmessage.RCodeNameError},
+			host:     "nx.test.com",
+			notFound: true,
+		},
+		{
+			name:     "NODATA",
+			resolver: zoneResolver{},
+			host:     "test.com",
+			notFound: true,
+		},
+		{
+			name: "IP",
+			host: "1.2.3.4",
+			want: []string{"1.2.3.4"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Lookup{Resolver: tt.resolver}.LookupHost(context.Background(), tt.host)
+			if tt.notFound {
+				var dnsErr *net.DNSError
+				if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+					t.Fatalf("LookupHost() err = %v, want not found", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LookupHost() err = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LookupHost() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLookup_LookupIPAddr_Error(t *testing.T) {
+	_, err := Lookup{Resolver: zoneResolver{err: errors.New("boom")}}.LookupIPAddr(context.Background(), "test.com")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || dnsErr.IsNotFound || dnsErr.Err != "boom" {
+		t.Errorf("LookupIPAddr() err = %v, want boom", err)
+	}
+}
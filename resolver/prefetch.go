@@ -0,0 +1,95 @@
+package resolver
+
+import (
+	"context"
+	"time"
+
+	"github.com/nextdns/nextdns/resolver/query"
+)
+
+// DefaultPrefetchTTL is the default value for DNS PrefetchTTL.
+const DefaultPrefetchTTL = 10
+
+// maxPrefetchTracked is the number of questions whose hits are tracked for
+// prefetching. The counters are reset once reached.
+const maxPrefetchTracked = 10000
+
+// prefetchTimeout is the timeout of prefetch queries.
+const prefetchTimeout = 10 * time.Second
+
+type prefetchKey struct {
+	qclass query.Class
+	qtype  query.Type
+	qname  string
+}
+
+type prefetchCtxKey struct{}
+
+// withPrefetch returns a context marking a prefetch query. Resolvers ignore
+// cached responses for such queries but still store the response in the
+// cache, and the query is not counted in the cache stats.
+func withPrefetch(ctx context.Context) context.Context {
+	return context.WithValue(ctx, prefetchCtxKey{}, true)
+}
+
+func isPrefetch(ctx context.Context) bool {
+	prefetch, _ := ctx.Value(prefetchCtxKey{}).(bool)
+	return prefetch
+}
+
+// bypassCache returns true if cached responses must be ignored for queries
+// made with ctx.
+func bypassCache(ctx context.Context) bool {
+	return isPrefetch(ctx)
+}
+
+// shouldPrefetch counts a cache hit for q, answered with a remaining TTL of
+// ttl, and returns true if q must be prefetched.
+func (r *DNS) shouldPrefetch(q query.Query, ttl uint32) bool {
+	threshold := r.PrefetchTTL
+	if threshold == 0 {
+		threshold = DefaultPrefetchTTL
+	}
+	key := prefetchKey{q.Class, q.Type, q.Name}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.prefetchHits == nil || len(r.prefetchHits) >= maxPrefetchTracked {
+		r.prefetchHits = map[prefetchKey]uint32{}
+	}
+	hits := r.prefetchHits[key] + 1
+	if hits >= r.PrefetchHits && ttl <= threshold {
+		// Start counting again once refreshed.
+		delete(r.prefetchHits, key)
+		return true
+	}
+	r.prefetchHits[key] = hits
+	return false
+}
+
+// prefetch refreshes the cached response to q in the background, unless a
+// prefetch of q is already in flight.
+func (r *DNS) prefetch(q query.Query) {
+	key := prefetchKey{q.Class, q.Type, q.Name}
+	r.mu.Lock()
+	if _, found := r.prefetching[key]; found {
+		r.mu.Unlock()
+		return
+	}
+	if r.prefetching == nil {
+		r.prefetching = map[prefetchKey]struct{}{}
+	}
+	r.prefetching[key] = struct{}{}
+	r.mu.Unlock()
+	// q.Payload may be reused by the caller for the response.
+	q.Payload = append([]byte(nil), q.Payload...)
+	go func() {
+		defer func() {
+			r.mu.Lock()
+			delete(r.prefetching, key)
+			r.mu.Unlock()
+		}()
+		ctx, cancel := context.WithTimeout(withPrefetch(context.Background()), prefetchTimeout)
+		defer cancel()
+		_, _, _ = r.Resolve(ctx, q, make([]byte, 65535))
+	}()
+}
@@ -0,0 +1,138 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nextdns/nextdns/resolver/endpoint"
+	"github.com/nextdns/nextdns/resolver/query"
+)
+
+// prefetchTransport answers testResponse to every request. Requests after
+// the first one are blocked until block is closed, if not nil.
+type prefetchTransport struct {
+	block chan struct{}
+
+	mu   sync.Mutex
+	reqs int
+}
+
+func (t *prefetchTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.reqs++
+	n := t.reqs
+	t.mu.Unlock()
+	if n > 1 && t.block != nil {
+		<-t.block
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewReader(testResponse)),
+		Header:     http.Header{"Content-Type": []string{"application/dns-message"}},
+	}, nil
+}
+
+func (t *prefetchTransport) requests() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.reqs
+}
+
+type lockedCache struct {
+	mu sync.Mutex
+	c  mapCache
+}
+
+func (c *lockedCache) Add(key, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.c.Add(key, value)
+}
+
+func (c *lockedCache) Get(key interface{}) (value interface{}, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.c.Get(key)
+}
+
+func newPrefetchDNS(rt http.RoundTripper, hits uint32) *DNS {
+	e := &endpoint.DOHEndpoint{
+		Hostname:         "doh.test",
+		TransportWrapper: func(http.RoundTripper) http.RoundTripper { return rt },
+	}
+	return &DNS{
+		DOH: DOH{Cache: &lockedCache{c: mapCache{}}},
+		Manager: &endpoint.Manager{
+			Providers: []endpoint.Provider{endpoint.StaticProvider{e}},
+			EndpointTester: func(endpoint.Endpoint) endpoint.Tester {
+				return func(ctx context.Context, testDomain string) error { return nil }
+			},
+		},
+		PrefetchHits: hits,
+		PrefetchTTL:  3600,
+	}
+}
+
+// waitPrefetch waits for the prefetches of r to complete.
+func waitPrefetch(t *testing.T, r *DNS) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		r.mu.Lock()
+		inFlight := len(r.prefetching)
+		r.mu.Unlock()
+		if inFlight == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d prefetches still in flight", inFlight)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func resolveN(t *testing.T, r *DNS, n int) {
+	t.Helper()
+	buf := make([]byte, 512)
+	for i := 0; i < n; i++ {
+		q := query.Query{Class: query.ClassINET, Type: query.TypeA, Name: "test.com.", Payload: testQuery}
+		if _, _, err := r.Resolve(context.Background(), q, buf); err != nil {
+			t.Fatalf("Resolve() err = %v", err)
+		}
+	}
+}
+
+func TestDNS_Prefetch(t *testing.T) {
+	rt := &prefetchTransport{}
+	r := newPrefetchDNS(rt, 2)
+	// 1 miss and 2 hits, the second hit triggering a prefetch.
+	resolveN(t, r, 3)
+	waitPrefetch(t, r)
+	if got, want := rt.requests(), 2; got != want {
+		t.Errorf("upstream requests = %d, want %d", got, want)
+	}
+	// The prefetch itself is not counted as a miss.
+	if got, want := r.CacheStats(), (CacheStats{Hits: 2, Misses: 1}); got != want {
+		t.Errorf("CacheStats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestDNS_PrefetchInFlight(t *testing.T) {
+	rt := &prefetchTransport{block: make(chan struct{})}
+	r := newPrefetchDNS(rt, 1)
+	// Every hit requests a prefetch while the first one is still blocked.
+	resolveN(t, r, 5)
+	close(rt.block)
+	waitPrefetch(t, r)
+	if got, want := rt.requests(), 2; got != want {
+		t.Errorf("upstream requests = %d, want %d", got, want)
+	}
+	if got, want := r.CacheStats(), (CacheStats{Hits: 4, Misses: 1}); got != want {
+		t.Errorf("CacheStats() = %+v, want %+v", got, want)
+	}
+}
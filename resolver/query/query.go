@@ -138,14 +138,18 @@ func (qry *Query) parse() error {
 		return fmt.Errorf("parse query: %v", err)
 	}
 
+	qry.ID = h.ID
 	q, err := p.Question()
-	if err != nil {
+	switch err {
+	case nil:
+		qry.Class = Class(q.Class)
+		qry.Type = Type(q.Type)
+		qry.Name = q.Name.String()
+	case dnsmessage.ErrSectionDone:
+		// No question, like in DNS cookie only queries.
+	default:
 		return fmt.Errorf("parse question: %v", err)
 	}
-	qry.ID = h.ID
-	qry.Class = Class(q.Class)
-	qry.Type = Type(q.Type)
-	qry.Name = q.Name.String()
 	_ = p.SkipAllQuestions()
 	_ = p.SkipAllAnswers()
 	_ = p.SkipAllAuthorities()
@@ -0,0 +1,77 @@
+package query
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ErrInvalidQuery is returned by Validate when a payload is not a well formed
+// DNS query.
+var ErrInvalidQuery = errors.New("invalid DNS query")
+
+const headerLen = 12
+
+// Validate checks that payload is a DNS query with a full header, exactly one
+// question and no data after its records. A query without question is valid
+// if it has an OPT record, like the DNS cookie only queries of RFC7873,
+// section 5.4. It only walks the message framing so it is cheap enough to be
+// run on every packet.
+func Validate(payload []byte) error {
+	if len(payload) < headerLen {
+		return ErrInvalidQuery
+	}
+	qdcount := binary.BigEndian.Uint16(payload[4:6])
+	if qdcount > 1 {
+		return ErrInvalidQuery
+	}
+	off := headerLen
+	if qdcount == 1 {
+		var ok bool
+		if off, ok = skipName(payload, off); !ok || off+4 > len(payload) {
+			return ErrInvalidQuery
+		}
+		off += 4 // type and class
+	}
+	additionals := int(binary.BigEndian.Uint16(payload[10:12]))
+	rrs := int(binary.BigEndian.Uint16(payload[6:8])) +
+		int(binary.BigEndian.Uint16(payload[8:10])) +
+		additionals
+	hasOPT := false
+	for i := 0; i < rrs; i++ {
+		var ok bool
+		if off, ok = skipName(payload, off); !ok || off+10 > len(payload) {
+			return ErrInvalidQuery
+		}
+		if i >= rrs-additionals && Type(binary.BigEndian.Uint16(payload[off:off+2])) == TypeOPT {
+			hasOPT = true
+		}
+		off += 10 + int(binary.BigEndian.Uint16(payload[off+8:off+10])) // header and rdata
+		if off > len(payload) {
+			return ErrInvalidQuery
+		}
+	}
+	if off != len(payload) || (qdcount == 0 && !hasOPT) {
+		return ErrInvalidQuery
+	}
+	return nil
+}
+
+// skipName returns the offset following the name starting at off in b.
+func skipName(b []byte, off int) (int, bool) {
+	for off < len(b) {
+		l := int(b[off])
+		switch {
+		case l == 0:
+			return off + 1, true
+		case l&0xc0 == 0xc0: // compression pointer ending the name
+			if off+2 > len(b) {
+				return 0, false
+			}
+			return off + 2, true
+		case l > 63:
+			return 0, false
+		}
+		off += 1 + l
+	}
+	return 0, false
+}
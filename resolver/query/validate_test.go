@@ -0,0 +1,50 @@
+package query
+
+import (
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	header := func(qd, an, ns, ar byte) []byte {
+		return []byte{0x12, 0x34, 0x01, 0x00, 0, qd, 0, an, 0, ns, 0, ar}
+	}
+	question := []byte{7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 1, 0, 1}
+	opt := []byte{0, 0, 41, 0x10, 0, 0, 0, 0, 0, 0, 0}
+	cat := func(parts ...[]byte) []byte {
+		var b []byte
+		for _, p := range parts {
+			b = append(b, p...)
+		}
+		return b
+	}
+	tests := []struct {
+		name    string
+		payload []byte
+		wantErr bool
+	}{
+		{"Valid", cat(header(1, 0, 0, 0), question), false},
+		{"ValidOPT", cat(header(1, 0, 0, 1), question, opt), false},
+		{"ValidPointer", cat(header(1, 0, 0, 1), question, []byte{0xc0, 12}, opt[1:]), false},
+		{"Empty", nil, true},
+		{"ShortHeader", header(1, 0, 0, 0)[:11], true},
+		{"NoQuestion", header(0, 0, 0, 0), true},
+		{"NoQuestionOPT", cat(header(0, 0, 0, 1), opt), false},
+		{"NoQuestionNoOPT", cat(header(0, 0, 0, 1), []byte{0, 0, 1}, opt[3:]), true},
+		{"TwoQuestions", cat(header(2, 0, 0, 0), question, question), true},
+		{"TruncatedQuestion", cat(header(1, 0, 0, 0), question[:len(question)-2]), true},
+		{"InvalidLabel", cat(header(1, 0, 0, 0), []byte{64}, question), true},
+		{"MissingRecord", cat(header(1, 0, 0, 1), question), true},
+		{"TruncatedRecord", cat(header(1, 0, 0, 1), question, opt[:len(opt)-1]), true},
+		{"TrailingGarbage", cat(header(1, 0, 0, 0), question, []byte{0xde, 0xad}), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate(tt.payload)
+			if tt.wantErr && err != ErrInvalidQuery {
+				t.Errorf("Validate() = %v, want %v", err, ErrInvalidQuery)
+			} else if !tt.wantErr && err != nil {
+				t.Errorf("Validate() = %v, want nil", err)
+			}
+		})
+	}
+}
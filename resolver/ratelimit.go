@@ -0,0 +1,82 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrRateLimitExceeded is returned when DOH MaxQPS is set and a query cannot
+// get a slot before its context deadline.
+var ErrRateLimitExceeded = errors.New("query rate limit exceeded")
+
+// rateLimiter is a token bucket smoothing the queries sent upstream to rate
+// per second, with bursts of up to burst queries.
+type rateLimiter struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// wait takes a token from the bucket, waiting for one to be available if
+// needed. It returns ErrRateLimitExceeded without waiting if no token would be
+// available before the ctx deadline or if burst queries are already waiting,
+// and ctx.Err() if ctx is done while waiting.
+func (l *rateLimiter) wait(ctx context.Context, rate, burst int) error {
+	d, ok := l.reserve(rate, burst, time.Now())
+	if !ok {
+		return ErrRateLimitExceeded
+	}
+	if d <= 0 {
+		return nil
+	}
+	if deadline, found := ctx.Deadline(); found && time.Until(deadline) < d {
+		l.cancel()
+		return ErrRateLimitExceeded
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		l.cancel()
+		return ctx.Err()
+	}
+}
+
+// reserve takes a token and returns the delay after which it can be used. The
+// token is not taken and ok is false if more than burst queries are already
+// waiting.
+func (l *rateLimiter) reserve(rate, burst int, now time.Time) (d time.Duration, ok bool) {
+	if burst <= 0 {
+		burst = rate
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.last.IsZero() {
+		l.tokens = float64(burst)
+	} else if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens += elapsed.Seconds() * float64(rate)
+		if l.tokens > float64(burst) {
+			l.tokens = float64(burst)
+		}
+	}
+	l.last = now
+	if l.tokens < 1-float64(burst) {
+		return time.Duration(float64(time.Second) * (1 - l.tokens) / float64(rate)), false
+	}
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0, true
+	}
+	return time.Duration(float64(time.Second) * -l.tokens / float64(rate)), true
+}
+
+// cancel gives back a token taken by a reservation that was not used.
+func (l *rateLimiter) cancel() {
+	l.mu.Lock()
+	l.tokens++
+	l.mu.Unlock()
+}
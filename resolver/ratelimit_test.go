@@ -0,0 +1,59 @@
+package resolver
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func Test_rateLimiter_reserve(t *testing.T) {
+	var l rateLimiter
+	now := time.Now()
+	tests := []struct {
+		name   string
+		now    time.Time
+		wantD  time.Duration
+		wantOK bool
+	}{
+		{"burst 1", now, 0, true},
+		{"burst 2", now, 0, true},
+		{"wait 1", now, 100 * time.Millisecond, true},
+		{"wait 2", now, 200 * time.Millisecond, true},
+		{"queue full", now, 0, false},
+		{"refilled", now.Add(time.Second), 0, true},
+	}
+	for _, tt := range tests {
+		d, ok := l.reserve(10, 2, tt.now)
+		if ok != tt.wantOK || (ok && d != tt.wantD) {
+			t.Errorf("%s: reserve() = %v, %v, want %v, %v", tt.name, d, ok, tt.wantD, tt.wantOK)
+		}
+	}
+}
+
+func Test_rateLimiter_wait(t *testing.T) {
+	var l rateLimiter
+	ctx := context.Background()
+	if err := l.wait(ctx, 10, 1); err != nil {
+		t.Fatalf("wait() = %v, want nil", err)
+	}
+
+	// No slot is available before the deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := l.wait(ctx, 10, 1); err != ErrRateLimitExceeded {
+		t.Fatalf("wait() = %v, want %v", err, ErrRateLimitExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Millisecond {
+		t.Errorf("wait() took %v, want no wait", elapsed)
+	}
+
+	// The slot given back is used by the next query.
+	start = time.Now()
+	if err := l.wait(context.Background(), 10, 1); err != nil {
+		t.Fatalf("wait() = %v, want nil", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("wait() took %v, want about 100ms", elapsed)
+	}
+}
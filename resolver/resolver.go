@@ -4,7 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/nextdns/nextdns/resolver/endpoint"
 	"github.com/nextdns/nextdns/resolver/query"
@@ -31,12 +34,67 @@ type Cacher interface {
 type DNS struct {
 	DOH     DOH
 	DNS53   DNS53
+	DOT     DOT
 	Manager *endpoint.Manager
+
+	// ShuffleAnswers specifies that the addresses of A and AAAA answers are
+	// returned in a random order for each response, round-robin style.
+	ShuffleAnswers bool
+
+	// PrefetchHits is the number of cache hits after which a cached response
+	// about to expire is refreshed in the background, so popular names are
+	// always answered from the cache. If zero, prefetching is disabled.
+	PrefetchHits uint32
+
+	// PrefetchTTL is the remaining TTL in second under which a cached
+	// response is prefetched. If zero, DefaultPrefetchTTL is used.
+	PrefetchTTL uint32
+
+	// ECSMode defines how the EDNS Client Subnet option of queries is
+	// handled before being sent upstream, whatever the endpoint protocol.
+	ECSMode ECSMode
+
+	// ECSSubnet is the client subnet sent with ECSOverride. If nil, the
+	// option is stripped.
+	ECSSubnet *net.IPNet
+
+	// ECSPrefixIPv4 and ECSPrefixIPv6 are the number of bits of the client IP
+	// sent with ECSClient. If zero, DefaultECSPrefixIPv4 and
+	// DefaultECSPrefixIPv6 are used.
+	ECSPrefixIPv4 int
+	ECSPrefixIPv6 int
+
+	mu           sync.Mutex
+	cacheStats   CacheStats
+	prefetchHits map[prefetchKey]uint32
+	prefetching  map[prefetchKey]struct{}
 }
 
 type ResolveInfo struct {
 	Transport string
 	FromCache bool
+
+	// Endpoint is the endpoint used to resolve the query, if any.
+	Endpoint string
+
+	// UpstreamDuration is the time spent waiting for Endpoint to answer, not
+	// including the failed attempts on other endpoints. Zero when FromCache.
+	UpstreamDuration time.Duration
+
+	// Blocked is true if the query was answered by a local filter.
+	Blocked bool
+
+	// CacheTTL is the remaining TTL in second of the cached response when
+	// FromCache is true.
+	CacheTTL uint32
+
+	// Truncated is true if the response received from the upstream had the TC
+	// bit set. With DNS53, the query is then retried over TCP.
+	Truncated bool
+
+	// cacheLookup is true if the cache was looked up for the query, which is
+	// not the case for PTR queries or when the cache is disabled.
+	cacheLookup bool
 }
 
 // New instances a DNS53 or DoH resolver for endpoint.
@@ -46,6 +104,8 @@ type ResolveInfo struct {
 //   * DoH:   https://doh.server.com/path
 //   * DoH:   https://doh.server.com/path#1.2.3.4 // with bootstrap
 //   * DoH:   https://doh.server.com/path,https://doh2.server.com/path
+//   * DoT:   tls://dot.server.com
+//   * DoT:   tls://dot.server.com#1.2.3.4 // with bootstrap
 //   * DNS53: 1.2.3.4
 //   * DNS53: 1.2.3.4,1.2.3.5
 //
@@ -70,21 +130,82 @@ func New(servers string) (Resolver, error) {
 
 // Resolve implements Resolver interface.
 func (r *DNS) Resolve(ctx context.Context, q query.Query, buf []byte) (n int, i ResolveInfo, err error) {
+	// Checked first as buf may be aliased with q.Payload.
+	edns := hasOPT(q.Payload)
+	if r.ECSMode != ECSPassthrough {
+		p, err := r.rewriteECS(q)
+		if err != nil {
+			return -1, i, err
+		}
+		q.Payload = p
+	}
+	var truncated error
 	err = r.Manager.Do(ctx, func(e endpoint.Endpoint) error {
 		var err2 error
+		start := time.Now()
 		switch e := e.(type) {
 		case *endpoint.DOHEndpoint:
 			if n, i, err2 = r.DOH.resolve(ctx, q, buf, e); err2 != nil {
-				return fmt.Errorf("doh resolve: %v", err2)
+				if err2 != ErrTruncatedResponse {
+					return fmt.Errorf("doh resolve: %w", err2)
+				}
+				// The server answered: not an endpoint failure.
+				truncated = err2
 			}
 		case *endpoint.DNSEndpoint:
 			if n, i, err2 = r.DNS53.resolve(ctx, q, buf, e.Addr); err2 != nil {
-				return fmt.Errorf("dns resolve: %v", err2)
+				return fmt.Errorf("dns resolve: %w", err2)
+			}
+		case *endpoint.DOTEndpoint:
+			if n, i, err2 = r.DOT.resolve(ctx, q, buf, e); err2 != nil {
+				return fmt.Errorf("dot resolve: %w", err2)
 			}
 		default:
 			return fmt.Errorf("dns resolve: unsupported type: %T", e)
 		}
+		i.Endpoint = e.String()
+		if !i.FromCache {
+			i.UpstreamDuration = time.Since(start)
+		}
 		return nil
 	})
+	if err == nil {
+		err = truncated
+	}
+	if !edns && n > 0 {
+		// An OPT record may have been added to the query sent upstream for
+		// padding or client subnet.
+		n = stripOPT(buf[:n])
+	}
+	if !isPrefetch(ctx) {
+		r.addCacheStat(n, i, err)
+	}
+	if r.PrefetchHits > 0 && i.FromCache && err == nil && r.shouldPrefetch(q, i.CacheTTL) {
+		r.prefetch(q)
+	}
+	if r.ShuffleAnswers && n > 0 {
+		shuffleAnswers(buf[:n])
+	}
 	return n, i, err
 }
+
+// CacheStats returns a snapshot of the cache counters of r.
+func (r *DNS) CacheStats() CacheStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cacheStats
+}
+
+func (r *DNS) addCacheStat(n int, i ResolveInfo, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case !i.cacheLookup:
+	case !i.FromCache:
+		r.cacheStats.Misses++
+	case err == nil:
+		r.cacheStats.Hits++
+	case n > 0:
+		r.cacheStats.Stale++
+	}
+}
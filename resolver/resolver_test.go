@@ -0,0 +1,110 @@
+package resolver
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/nextdns/nextdns/resolver/endpoint"
+	"github.com/nextdns/nextdns/resolver/query"
+)
+
+func TestDNS_Resolve_NoEDNS(t *testing.T) {
+	// The upstream always answers with an OPT record.
+	respOPT := append([]byte{}, testResponse...)
+	respOPT[11] = 1 // Additionals
+	respOPT = append(respOPT,
+		0x00,       // Label <root>
+		0x00, 0x29, // Type OPT
+		0x04, 0xd0, // UDP payload size 1232
+		0x00,       // Extended RCODE
+		0x00,       // EDNS Version
+		0x00, 0x00, // Flags
+		0x00, 0x00, // Data len
+	)
+	tests := []struct {
+		name    string
+		payload []byte
+		padding int
+		wantOPT bool
+	}{
+		{"NoEDNS", testQuery, 0, false},
+		{"EDNS", testQueryOPT, 0, true},
+		{"NoEDNSPadded", testQuery, DefaultPaddingBlockSize, false},
+		{"EDNSPadded", testQueryOPT, DefaultPaddingBlockSize, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := &fakeTransport{
+				responses: []fakeResponse{
+					{status: http.StatusOK, contentType: "application/dns-message", body: respOPT},
+				},
+			}
+			e := &endpoint.DOHEndpoint{
+				Hostname:         "doh.test",
+				TransportWrapper: func(http.RoundTripper) http.RoundTripper { return rt },
+			}
+			r := &DNS{
+				DOH: DOH{PaddingBlockSize: tt.padding},
+				Manager: &endpoint.Manager{
+					Providers: []endpoint.Provider{endpoint.StaticProvider{e}},
+					EndpointTester: func(endpoint.Endpoint) endpoint.Tester {
+						return func(ctx context.Context, testDomain string) error { return nil }
+					},
+				},
+			}
+			q := query.Query{Class: query.ClassINET, Type: query.TypeA, Name: "test.com.", Payload: tt.payload}
+			buf := make([]byte, 512)
+			n, _, err := r.Resolve(context.Background(), q, buf)
+			if err != nil {
+				t.Fatalf("Resolve() err = %v", err)
+			}
+			if got := hasOPT(buf[:n]); got != tt.wantOPT {
+				t.Errorf("response has OPT = %v, want %v", got, tt.wantOPT)
+			}
+			if _, err := locateOPT(buf[:n]); err != nil {
+				t.Errorf("Resolve() returned an invalid message: %v", err)
+			}
+			if tt.padding > 0 {
+				body, _ := ioutil.ReadAll(rt.reqs[0].Body)
+				if len(body)%tt.padding != 0 {
+					t.Errorf("query of %d bytes is not padded", len(body))
+				}
+			}
+		})
+	}
+}
+
+func TestDNS_Resolve_Truncated(t *testing.T) {
+	resp := append([]byte{}, testResponse...)
+	resp[2] |= 0x2 // TC
+	rt := &fakeTransport{
+		responses: []fakeResponse{
+			{status: http.StatusOK, contentType: "application/dns-message", body: resp},
+		},
+	}
+	e := &endpoint.DOHEndpoint{
+		Hostname:         "doh.test",
+		TransportWrapper: func(http.RoundTripper) http.RoundTripper { return rt },
+	}
+	r := &DNS{
+		Manager: &endpoint.Manager{
+			Providers: []endpoint.Provider{endpoint.StaticProvider{e}},
+			EndpointTester: func(endpoint.Endpoint) endpoint.Tester {
+				return func(ctx context.Context, testDomain string) error { return nil }
+			},
+		},
+	}
+	q := query.Query{Class: query.ClassINET, Type: query.TypeA, Name: "test.com.", Payload: testQuery}
+	n, i, err := r.Resolve(context.Background(), q, make([]byte, 512))
+	if err != ErrTruncatedResponse {
+		t.Errorf("Resolve() err = %v, want %v", err, ErrTruncatedResponse)
+	}
+	if n != len(resp) || !i.Truncated {
+		t.Errorf("Resolve() n = %d, truncated = %v, want %d, true", n, i.Truncated, len(resp))
+	}
+	if i.Endpoint != e.String() {
+		t.Errorf("Resolve() endpoint = %q, want %q", i.Endpoint, e.String())
+	}
+}
@@ -0,0 +1,78 @@
+package resolver
+
+import (
+	"bytes"
+	"math/rand"
+
+	"github.com/nextdns/nextdns/resolver/query"
+)
+
+// shuffleAnswers randomizes in place the order of the addresses of the A and
+// AAAA RRsets found in the answer section of msg. Only the record data is
+// swapped between records of the same type and owner, so the message layout,
+// including name compression, is left untouched.
+func shuffleAnswers(msg []byte) {
+	if len(msg) < 12 {
+		return
+	}
+	questions := unpackUint16(msg[4:])
+	answers := unpackUint16(msg[6:])
+	off := 12
+	for i := questions; i > 0; i-- {
+		l := skipName(msg[off:])
+		if l == 0 {
+			return
+		}
+		off += l + 4 // qtype(uint16) + qclass(uint16)
+		if off > len(msg) {
+			return
+		}
+	}
+	var owner []byte
+	var qtype query.Type
+	var rdata []int // offsets of the data of the current RRset records
+	for i := uint16(0); i < answers; i++ {
+		if off >= len(msg) {
+			break
+		}
+		l := skipName(msg[off:])
+		if l == 0 || off+l+10 > len(msg) {
+			break
+		}
+		name := msg[off : off+l]
+		off += l + 10 // qtype(uint16) + qclass(uint16) + ttl(int32) + RDLENGTH(uint16)
+		t := query.Type(unpackUint16(msg[off-10:]))
+		rdlen := int(unpackUint16(msg[off-2:]))
+		if off+rdlen > len(msg) {
+			break
+		}
+		if t != qtype || !bytes.Equal(name, owner) {
+			shuffleRecords(msg, rdata, qtype)
+			owner, qtype, rdata = name, t, rdata[:0]
+		}
+		if (t == query.TypeA && rdlen == 4) || (t == query.TypeAAAA && rdlen == 16) {
+			rdata = append(rdata, off)
+		}
+		off += rdlen
+	}
+	shuffleRecords(msg, rdata, qtype)
+}
+
+// shuffleRecords shuffles the data of the records of type qtype located at
+// offs in msg.
+func shuffleRecords(msg []byte, offs []int, qtype query.Type) {
+	if len(offs) < 2 {
+		return
+	}
+	size := 4
+	if qtype == query.TypeAAAA {
+		size = 16
+	}
+	var tmp [16]byte
+	rand.Shuffle(len(offs), func(i, j int) {
+		a, b := msg[offs[i]:offs[i]+size], msg[offs[j]:offs[j]+size]
+		copy(tmp[:], a)
+		copy(a, b)
+		copy(b, tmp[:size])
+	})
+}
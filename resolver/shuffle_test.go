@@ -0,0 +1,75 @@
+package resolver
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func Test_shuffleAnswers(t *testing.T) {
+	msg := []byte{
+		0xa6, 0xed, // ID
+		0x81, 0x80, // Flags
+		0x00, 0x01, // Questions
+		0x00, 0x04, // Answers
+		0x00, 0x00, // Authorities
+		0x00, 0x00, // Additionals
+		// Questions
+		0x04, 0x74, 0x65, 0x73, 0x74, 0x03, 0x63, 0x6f, 0x6d, 0x00, // Label test.com.
+		0x00, 0x01, // Type A
+		0x00, 0x01, // Class IN
+		// Answers
+		0xc0, 0x0c, // Label pointer test.com.
+		0x00, 0x05, // Type CNAME
+		0x00, 0x01, // Class IN
+		0x00, 0x00, 0x0e, 0x10, // TTL 3600
+		0x00, 0x04, // Data len 4
+		0x01, 0x61, 0xc0, 0x0c, // Label a.test.com.
+		0xc0, 0x26, // Label pointer a.test.com.
+		0x00, 0x01, // Type A
+		0x00, 0x01, // Class IN
+		0x00, 0x00, 0x0e, 0x10, // TTL 3600
+		0x00, 0x04, // Data len 4
+		0x0a, 0x00, 0x00, 0x01, // 10.0.0.1
+		0xc0, 0x26, // Label pointer a.test.com.
+		0x00, 0x01, // Type A
+		0x00, 0x01, // Class IN
+		0x00, 0x00, 0x0e, 0x10, // TTL 3600
+		0x00, 0x04, // Data len 4
+		0x0a, 0x00, 0x00, 0x02, // 10.0.0.2
+		0xc0, 0x26, // Label pointer a.test.com.
+		0x00, 0x01, // Type A
+		0x00, 0x01, // Class IN
+		0x00, 0x00, 0x0e, 0x10, // TTL 3600
+		0x00, 0x04, // Data len 4
+		0x0a, 0x00, 0x00, 0x03, // 10.0.0.3
+	}
+	addrs := func(msg []byte) []string {
+		var ips []string
+		for _, off := range []int{54, 70, 86} {
+			ips = append(ips, string(msg[off:off+4]))
+		}
+		return ips
+	}
+	orig := append([]byte{}, msg...)
+	origAddrs := addrs(orig)
+	changed := false
+	for i := 0; i < 100; i++ {
+		shuffleAnswers(msg)
+		got := addrs(msg)
+		if !reflect.DeepEqual(got, origAddrs) {
+			changed = true
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, origAddrs) {
+			t.Fatalf("shuffleAnswers() addresses = %q, want a permutation of %q", got, origAddrs)
+		}
+		if !bytes.Equal(msg[:54], orig[:54]) {
+			t.Fatalf("shuffleAnswers() modified the message outside of the A records data")
+		}
+	}
+	if !changed {
+		t.Errorf("shuffleAnswers() never changed the order of the addresses")
+	}
+}
@@ -21,6 +21,7 @@ import (
 
 	"github.com/nextdns/nextdns/config"
 	"github.com/nextdns/nextdns/discovery"
+	"github.com/nextdns/nextdns/filter"
 	"github.com/nextdns/nextdns/host"
 	"github.com/nextdns/nextdns/host/service"
 	"github.com/nextdns/nextdns/netstatus"
@@ -35,6 +36,7 @@ type proxySvc struct {
 	proxy.Proxy
 	log      host.Logger
 	resolver *resolver.DNS
+	cache    *lru.ARCCache
 	stopFunc func()
 	stopped  chan struct{}
 
@@ -152,6 +154,8 @@ func run(args []string) error {
 		log = host.NewConsoleLogger("nextdns")
 		log.Warningf("Service logger error (switching to console): %v", err)
 	}
+	levelLog := &host.LevelLogger{Logger: log}
+	log = levelLog
 	p := &proxySvc{
 		log: log,
 	}
@@ -209,6 +213,19 @@ func run(args []string) error {
 			return time.Since(startup) < 10*time.Minute
 		}),
 	}
+	switch c.EndpointStrategy {
+	case "", "ordered":
+	case "fastest":
+		p.resolver.Manager.Strategy = &endpoint.FastestStrategy{}
+	case "lowest-error-rate":
+		p.resolver.Manager.Strategy = &endpoint.LowestErrorRateStrategy{}
+	case "round-robin":
+		p.resolver.Manager.Strategy = &endpoint.RoundRobinStrategy{}
+	case "sticky":
+		p.resolver.Manager.Strategy = &endpoint.StickyStrategy{}
+	default:
+		return fmt.Errorf("%s: invalid endpoint strategy", c.EndpointStrategy)
+	}
 
 	cacheSize, err := config.ParseBytes(c.CacheSize)
 	if err != nil {
@@ -220,15 +237,70 @@ func run(args []string) error {
 			log.Errorf("Cache init failed: %v", err)
 		} else {
 			maxAge := uint32(c.CacheMaxAge / time.Second)
+			maxStale := uint32(c.CacheMaxStale / time.Second)
+			negMaxAge := uint32(c.CacheNegativeMaxAge / time.Second)
+			p.cache = cache
 			p.resolver.DNS53.Cache = cache
 			p.resolver.DNS53.CacheMaxAge = maxAge
+			p.resolver.DNS53.CacheMaxStale = maxStale
+			p.resolver.DNS53.CacheNegativeMaxAge = negMaxAge
+			p.resolver.DNS53.NoNegativeCache = !c.CacheNegative
 			p.resolver.DOH.Cache = cache
 			p.resolver.DOH.CacheMaxAge = maxAge
+			p.resolver.DOH.CacheMaxStale = maxStale
+			p.resolver.DOH.CacheNegativeMaxAge = negMaxAge
+			p.resolver.DOH.NoNegativeCache = !c.CacheNegative
+			p.resolver.DOT.Cache = cache
+			p.resolver.DOT.CacheMaxAge = maxAge
+			p.resolver.DOT.CacheMaxStale = maxStale
+			p.resolver.DOT.CacheNegativeMaxAge = negMaxAge
+			p.resolver.DOT.NoNegativeCache = !c.CacheNegative
+			if c.PrefetchHits != "" {
+				hits, err := strconv.ParseUint(c.PrefetchHits, 10, 32)
+				if err != nil {
+					return fmt.Errorf("%s: invalid prefetch hits", c.PrefetchHits)
+				}
+				p.resolver.PrefetchHits = uint32(hits)
+			}
+			p.resolver.PrefetchTTL = uint32(c.PrefetchTTL / time.Second)
 		}
 	}
+	if c.UDPPayloadSize != "" {
+		size, err := strconv.ParseUint(c.UDPPayloadSize, 10, 16)
+		if err != nil || size < 512 {
+			return fmt.Errorf("%s: invalid udp payload size", c.UDPPayloadSize)
+		}
+		p.resolver.DNS53.UDPPayloadSize = uint16(size)
+	}
 	maxTTL := uint32(c.MaxTTL / time.Second)
 	p.resolver.DNS53.MaxTTL = maxTTL
 	p.resolver.DOH.MaxTTL = maxTTL
+	p.resolver.DOT.MaxTTL = maxTTL
+	if c.Padding {
+		p.resolver.DOH.PaddingBlockSize = resolver.DefaultPaddingBlockSize
+		p.resolver.DOT.PaddingBlockSize = resolver.DefaultPaddingBlockSize
+	}
+	if c.MaxQPS != "" {
+		qps, err := strconv.ParseUint(c.MaxQPS, 10, 31)
+		if err != nil {
+			return fmt.Errorf("%s: invalid max qps", c.MaxQPS)
+		}
+		p.resolver.DOH.MaxQPS = int(qps)
+	}
+	switch c.ECS {
+	case "", "passthrough":
+	case "strip":
+		p.resolver.ECSMode = resolver.ECSStrip
+	case "client":
+		p.resolver.ECSMode = resolver.ECSClient
+	default:
+		_, subnet, err := net.ParseCIDR(c.ECS)
+		if err != nil {
+			return fmt.Errorf("%s: cannot parse ecs: %v", c.ECS, err)
+		}
+		p.resolver.ECSMode = resolver.ECSOverride
+		p.resolver.ECSSubnet = subnet
+	}
 
 	if len(c.Conf) == 0 || (len(c.Conf) == 1 && c.Conf.Get(nil, nil) != "") {
 		// Optimize for no dynamic configuration.
@@ -240,23 +312,68 @@ func run(args []string) error {
 	}
 
 	p.Proxy = proxy.Proxy{
-		Addr:      c.Listen,
-		Upstream:  p.resolver,
-		BogusPriv: c.BogusPriv,
-		UseHosts:  c.UseHosts,
-		Timeout:   c.Timeout,
+		Addr:                c.Listen,
+		Upstream:            p.resolver,
+		BogusPriv:           c.BogusPriv,
+		SkipQueryValidation: !c.ValidateQueries,
+		UseHosts:            c.UseHosts,
+		LocalZone:           c.LocalRecords.Zone(c.LocalDomains),
+		Hosts:               c.HostsFiles.Source(),
+		Timeout:             c.Timeout,
+	}
+
+	if p.Hosts != nil {
+		p.OnInit = append(p.OnInit, p.Hosts.Start)
+	}
+
+	if len(c.Blocklists) > 0 {
+		var resp filter.Response
+		switch c.BlockResponse {
+		case "", "nxdomain":
+			resp = filter.ResponseNXDomain
+		case "null":
+			resp = filter.ResponseNull
+		case "refused":
+			resp = filter.ResponseRefused
+		default:
+			return fmt.Errorf("%s: invalid block response", c.BlockResponse)
+		}
+		filters := config.NewClientFilters(c.Blocklists, c.Allowlists)
+		for _, f := range filters.All() {
+			f.Response = resp
+			f.RefreshInterval = c.BlocklistRefresh
+			f.ErrorLog = func(err error) {
+				log.Errorf("Filter: %v", err)
+			}
+			p.OnInit = append(p.OnInit, f.Start)
+		}
+		if all := filters.All(); len(all) == 1 {
+			// Optimize for no per client filtering.
+			p.Filter = all[0]
+		} else {
+			p.GetFilter = func(q query.Query) *filter.Filter {
+				return filters.Get(q.PeerIP, q.MAC)
+			}
+		}
 	}
 
 	if len(c.Forwarders) > 0 {
 		// Append default doh server at the end of the forwarder list as a catch all.
 		fwd := make(config.Forwarders, 0, len(c.Forwarders)+1)
 		fwd = append(fwd, c.Forwarders...)
+		for _, f := range c.Forwarders {
+			// Forwarders get the same client subnet policy as NextDNS.
+			if r, ok := f.Resolver.(*resolver.DNS); ok {
+				r.ECSMode = p.resolver.ECSMode
+				r.ECSSubnet = p.resolver.ECSSubnet
+			}
+		}
 		fwd = append(fwd, config.Resolver{Resolver: p.resolver})
 		p.Upstream = &fwd
 	}
 
 	p.QueryLog = func(q proxy.QueryInfo) {
-		if !c.LogQueries && q.Error == nil {
+		if !c.LogQueries && levelLog.Level() > host.LevelDebug && q.Error == nil {
 			return
 		}
 		var errStr string
@@ -284,6 +401,23 @@ func run(args []string) error {
 	p.ErrorLog = func(err error) {
 		log.Error(err)
 	}
+	p.DebugLog = func(msg string) {
+		if levelLog.Level() <= host.LevelDebug {
+			log.Info(msg)
+		}
+	}
+	if err := setupQueryLog(p, &c); err != nil {
+		return err
+	}
+	if c.DNSTap != "" {
+		setupDNSTap(p, c.DNSTap)
+	}
+	if c.MetricsListen != "" {
+		setupMetrics(p, c.MetricsListen)
+	}
+	if c.Control != "" {
+		setupControl(p, c.Control, levelLog)
+	}
 	localhostMode := isLocalhostMode(&c)
 	if c.ReportClientInfo {
 		// Only enable discovery if configured to listen to requests outside
@@ -384,6 +518,9 @@ func nextdnsEndpointManager(log host.Logger, hpm bool, canFallback func() bool)
 				ci.TLSTime/time.Millisecond,
 				ci.TLSVersion)
 		},
+		OnCertExpiringSoon: func(e endpoint.Endpoint, notAfter time.Time) {
+			log.Warningf("Endpoint certificate expires soon: %v: %s", e, notAfter.Format(time.RFC3339))
+		},
 		OnChange: func(e endpoint.Endpoint) {
 			log.Infof("Switching endpoint: %s", e)
 		},
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nextdns/nextdns/resolver/endpoint"
+)
+
+func selfTest(args []string) error {
+	fs := flag.NewFlagSet("nextdns "+args[0], flag.ExitOnError)
+	jsonOutput := fs.Bool("json", false, "Output the report as JSON.")
+	timeout := fs.Duration("timeout", 10*time.Second, "Maximum duration allowed to test each server.")
+	_ = fs.Parse(args[1:])
+
+	var endpoints []endpoint.Endpoint
+	for _, addr := range fs.Args() {
+		e, err := endpoint.New(addr)
+		if err != nil {
+			return fmt.Errorf("%s: %v", addr, err)
+		}
+		endpoints = append(endpoints, e)
+	}
+	if len(endpoints) == 0 {
+		// Test NextDNS when no server is given.
+		endpoints = []endpoint.Endpoint{
+			endpoint.MustNew("https://dns1.nextdns.io#45.90.28.0,2a07:a8c0::"),
+			endpoint.MustNew("https://dns2.nextdns.io#45.90.30.0,2a07:a8c1::"),
+		}
+	}
+
+	reports := make([]endpoint.Report, 0, len(endpoints))
+	ok := true
+	for _, e := range endpoints {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		r, err := endpoint.SelfTest(ctx, e)
+		cancel()
+		if err != nil {
+			return err
+		}
+		ok = ok && r.OK()
+		reports = append(reports, r)
+	}
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(reports); err != nil {
+			return err
+		}
+	} else {
+		for _, r := range reports {
+			fmt.Print(r)
+		}
+	}
+	if !ok {
+		os.Exit(1)
+	}
+	return nil
+}